@@ -0,0 +1,236 @@
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/lithammer/dedent"
+	"github.com/spf13/cobra"
+
+	"github.com/jessesomerville/ephemeral-iam/internal/agent"
+	"github.com/jessesomerville/ephemeral-iam/internal/appconfig"
+	util "github.com/jessesomerville/ephemeral-iam/internal/eiamutil"
+	errorsutil "github.com/jessesomerville/ephemeral-iam/internal/errors"
+	"github.com/jessesomerville/ephemeral-iam/internal/gcpclient"
+	"github.com/jessesomerville/ephemeral-iam/internal/lifecycle"
+	"github.com/jessesomerville/ephemeral-iam/internal/shellrc"
+	"github.com/jessesomerville/ephemeral-iam/pkg/options"
+)
+
+var (
+	agentSocket      string
+	agentIdleTimeout time.Duration
+)
+
+func newCmdAgent() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "agent",
+		Short: "Run a token broker that caches access tokens for other eiam commands",
+		Long: dedent.Dedent(`
+			The "agent" command runs a long-running token broker, similar to ssh-agent. It holds access
+			tokens in memory, keyed by service account, scopes and delegates, and serves them over a Unix
+			socket that only you can connect to.
+			
+			When the EIAM_AGENT_SOCK environment variable is set to the agent's socket, the gcloud,
+			kubectl and cloud_sql_proxy commands get their access tokens from the agent instead of
+			checking access and generating a new token every time they run. Access to a service account
+			is checked the first time a token is requested for it. Tokens are refreshed before they
+			expire, and dropped once they have not been requested for the idle timeout.
+			
+			The command prints the export statement for EIAM_AGENT_SOCK and runs until it is interrupted.`),
+		Example: dedent.Dedent(`
+			# In one terminal
+			eiam agent
+			
+			# In another terminal
+			export EIAM_AGENT_SOCK="$HOME/.config/ephemeral-iam/agent.sock"
+			eiam kubectl get pods -s example@my-project.iam.gserviceaccount.com -R "JIRA-1234" -y`),
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runAgent()
+		},
+	}
+
+	cmd.Flags().StringVar(&agentSocket, "socket", filepath.Join(appconfig.GetConfigDir(), "agent.sock"), "The path to the agent's socket")
+	cmd.Flags().DurationVar(&agentIdleTimeout, "idle-timeout", time.Hour, "How long a token is kept after it was last requested")
+
+	cmd.AddCommand(newCmdAgentList())
+
+	return cmd
+}
+
+func newCmdAgentList() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "list",
+		Short: "List the access tokens cached by the agent",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			socketPath, err := agentSocketPath()
+			if err != nil {
+				return err
+			}
+			infos, err := agent.ListTokens(socketPath)
+			if err != nil {
+				return errorsutil.EiamError{
+					Log: util.Logger.WithError(err),
+					Msg: "Failed to list the agent's tokens",
+					Err: err,
+				}
+			}
+			if len(infos) == 0 {
+				util.Logger.Info("The agent has no cached tokens")
+				return nil
+			}
+
+			var buf bytes.Buffer
+			w := tabwriter.NewWriter(&buf, 0, 4, 4, ' ', 0)
+			fmt.Fprintln(w, "SERVICE ACCOUNT\tDELEGATES\tSUBJECT\tSCOPES\tEXPIRES\tREQUESTS")
+			for _, info := range infos {
+				delegates := strings.Join(info.Delegates, " -> ")
+				if delegates == "" {
+					delegates = "-"
+				}
+				subject := info.Subject
+				if subject == "" {
+					subject = "-"
+				}
+				fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%d\n",
+					info.ServiceAccount,
+					delegates,
+					subject,
+					strings.Join(info.Scopes, ", "),
+					time.Until(info.Expiry).Round(time.Second),
+					info.Requests,
+				)
+			}
+			w.Flush()
+			fmt.Print(buf.String())
+			return nil
+		},
+	}
+	return cmd
+}
+
+func runAgent() error {
+	l, err := agent.Listen(agentSocket)
+	if err != nil {
+		return errorsutil.EiamError{
+			Log: util.Logger.WithError(err),
+			Msg: "Failed to start the agent",
+			Err: err,
+		}
+	}
+
+	lc := lifecycle.New()
+	lc.Start()
+	defer lc.Stop()
+	defer lc.Cleanup()
+	lc.OnCleanup("close agent socket", func() error {
+		l.Close()
+		if err := os.Remove(agentSocket); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	})
+
+	srv := &agent.Server{
+		Generate: func(req agent.TokenRequest) (string, time.Time, error) {
+			resp, err := gcpclient.GenerateTemporaryAccessToken(req.ServiceAccount, req.Subject, req.Reason, req.Scopes, req.Delegates...)
+			if err != nil {
+				return "", time.Time{}, err
+			}
+			return resp.GetAccessToken(), resp.GetExpireTime().AsTime(), nil
+		},
+		CanImpersonate: func(req agent.TokenRequest) (bool, error) {
+			return gcpclient.CanGenerateAccessToken(req.Project, req.ServiceAccount, req.Subject, req.Reason, req.Delegates...)
+		},
+		IdleTimeout: agentIdleTimeout,
+		Log:         util.Logger,
+	}
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- srv.Serve(l)
+	}()
+
+	fmt.Printf("export %s=%s\n", agent.EnvSocket, shellrc.Quote(agentSocket))
+	util.Logger.Infof("Agent listening on %s", agentSocket)
+
+	select {
+	case <-lc.Done():
+		util.Logger.Infof("Received %s, stopping the agent", lc.Signal())
+		return nil
+	case err := <-serveErr:
+		return errorsutil.EiamError{
+			Log: util.Logger.WithError(err),
+			Msg: "The agent stopped unexpectedly",
+			Err: err,
+		}
+	}
+}
+
+// agentSocketPath returns the socket of the agent that EIAM_AGENT_SOCK points to
+func agentSocketPath() (string, error) {
+	socketPath := os.Getenv(agent.EnvSocket)
+	if socketPath == "" {
+		err := fmt.Errorf("%s is not set", agent.EnvSocket)
+		return "", errorsutil.EiamError{
+			Log: util.Logger.WithError(err),
+			Msg: "Failed to find the agent",
+			Err: err,
+		}
+	}
+	return socketPath, nil
+}
+
+// fetchAccessToken returns an access token for the service account. If
+// EIAM_AGENT_SOCK is set, the token is requested from the agent, which checks
+// access and caches the token. Otherwise access to the service account is
+// checked and a new token is generated.
+func fetchAccessToken(cfg *options.CmdConfig) (string, error) {
+	if socketPath := os.Getenv(agent.EnvSocket); socketPath != "" {
+		scopes := cfg.Scopes
+		if len(scopes) == 0 {
+			var err error
+			if scopes, err = resolveScopes(nil, cfg.ServiceAccountEmail); err != nil {
+				return "", err
+			}
+		}
+
+		util.Logger.Infof("Fetching access token for %s from the agent", cfg.ServiceAccountEmail)
+		resp, err := agent.RequestToken(socketPath, agent.TokenRequest{
+			ServiceAccount: cfg.ServiceAccountEmail,
+			Project:        cfg.Project,
+			Delegates:      cfg.Delegates,
+			Scopes:         scopes,
+			Subject:        cfg.Subject,
+			Reason:         cfg.Reason,
+		})
+		if err != nil {
+			return "", errorsutil.EiamError{
+				Log: util.Logger.WithError(err),
+				Msg: "Failed to fetch access token from the agent",
+				Err: err,
+			}
+		}
+		return resp.AccessToken, nil
+	}
+
+	hasAccess, err := gcpclient.CanGenerateAccessToken(cfg.Project, cfg.ServiceAccountEmail, cfg.Subject, cfg.Reason, cfg.Delegates...)
+	if err != nil {
+		return "", err
+	} else if !hasAccess {
+		util.Logger.Fatalln("You do not have access to impersonate this service account")
+	}
+
+	util.Logger.Infof("Fetching access token for %s", cfg.ServiceAccountEmail)
+	accessToken, err := gcpclient.GenerateTemporaryAccessToken(cfg.ServiceAccountEmail, cfg.Subject, cfg.Reason, cfg.Scopes, cfg.Delegates...)
+	if err != nil {
+		return "", err
+	}
+	return accessToken.GetAccessToken(), nil
+}
@@ -1,11 +1,18 @@
 package cmd
 
 import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
 	"github.com/lithammer/dedent"
 	"github.com/manifoldco/promptui"
 	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
 
 	util "github.com/jessesomerville/ephemeral-iam/internal/eiamutil"
+	errorsutil "github.com/jessesomerville/ephemeral-iam/internal/errors"
 	"github.com/jessesomerville/ephemeral-iam/internal/gcpclient"
 	"github.com/jessesomerville/ephemeral-iam/internal/proxy"
 	"github.com/jessesomerville/ephemeral-iam/pkg/options"
@@ -15,54 +22,227 @@ var apCmdConfig options.CmdConfig
 
 func newCmdAssumePrivileges() *cobra.Command {
 	cmd := &cobra.Command{
-		Use:     "assume-privileges",
+		Use:     "assume-privileges [-- COMMAND [ARGS...]]",
 		Aliases: []string{"priv"},
 		Short:   "Configure gcloud to make API calls as the provided service account [alias: priv]",
 		Long: dedent.Dedent(`
 			The "assume-privileges" command fetches short-lived credentials for the provided service Account
 			and configures gcloud to proxy its traffic through an auth proxy. This auth proxy sets the
-			authorization header to the OAuth2 token generated for the provided service account. Once
-			the credentials have expired, the auth proxy is shut down and the gcloud config is restored.
+			authorization header to the OAuth2 token generated for the provided service account. The
+			token is refreshed in the background until the session duration has elapsed, at which point
+			the auth proxy is shut down. The session is also shut down cleanly if eiam receives SIGTERM,
+			SIGHUP or SIGQUIT, e.g. when the terminal window is closed.
+			
+			Each session uses its own copy of your gcloud config, which is only used inside of the
+			privileged sub-shell. Your gcloud config is never modified, so multiple sessions can run at
+			the same time. If the configured proxy port is already in use, a free port is used instead.
+			
+			The privileged sub-shell runs the shell set by the session.shell config value, or $SHELL if
+			it is not set. For bash, zsh and fish, your own rc files are loaded before eiam sets its
+			prompt, so your aliases and history settings are kept.
+			
+			If a command is provided after "--", it is run in the session instead of the privileged
+			sub-shell. The command uses the same gcloud config and kubeconfig as the sub-shell, its
+			output is passed through unchanged, and eiam exits with the command's exit code once the
+			session has been torn down. If the session ends before the command exits, the command is
+			sent SIGTERM.
+			
+			The delegate flag impersonates the service account through a chain of other service accounts.
+			Each service account in the chain must be able to impersonate the next one, which is checked
+			before the session starts. Repeat the flag for each hop, starting with the service account
+			that you are able to impersonate.
+			
+			The scopes flag sets the OAuth scopes of the session's access tokens, e.g. to use Google
+			Workspace APIs or to narrow the token's access. Scopes can be given as their full URL or
+			as the part after https://www.googleapis.com/auth/. If the flag is not set, the scopes of
+			the service account's entry in the session.scopeprofiles config value are used, and
+			otherwise the session.defaultscopes config value.
+			
+			The duration flag sets how long the session lasts. It defaults to the session.defaultduration
+			config value and cannot exceed the session.maxduration config value.
+			
+			The read-only flag limits the session to requests that read resources: GET and HEAD
+			requests, and read-only RPCs such as getIamPolicy and testIamPermissions. Every other
+			request is rejected by the auth proxy. The reason of a read-only session is prefixed with
+			'[read-only]' so that audit logs show that the session could not modify resources.
+			kubectl talks to clusters directly rather than through the auth proxy, so it is not
+			authenticated as the service account in read-only sessions.
+			
+			The credentials-file flag sets GOOGLE_APPLICATION_CREDENTIALS in the privileged sub-shell to
+			a credentials file that impersonates the service account using your application default
+			credentials. Client libraries and tools that use application default credentials, such as
+			Terraform, then act as the service account without going through the auth proxy, so their
+			requests are not checked by --read-only and the flags cannot be used together. The access
+			tokens they generate last for the session's duration, up to an hour, and the file is deleted
+			when the session ends. Without it, your own application default credentials are not
+			available in the privileged sub-shell.
+			
+			The metadata-server flag starts a local GCE metadata server that serves the service
+			account's access token instead, and points GCE_METADATA_HOST at it in the privileged
+			sub-shell. The credentials file is not written, since it would take precedence over the
+			metadata server, so application default credentials expire with the session. The metadata
+			server hands the raw access token to any local process that asks for it, and requests made
+			with the token are neither policy-checked nor audited by the auth proxy, so it can't be used
+			with --read-only.
+			
+			The record flag records everything that is printed in the privileged sub-shell to an
+			asciicast file in the auth proxy's log directory. Recordings can be played back with the
+			"session replay" command.
 			
 			The reason flag is used to add additional metadata to audit logs.  The provided reason will
 			be in 'protoPayload.requestMetadata.requestAttributes.reason'.`),
 		Example: dedent.Dedent(`
 				eiam assume-privileges \
 				  --service-account-email example@my-project.iam.gserviceaccount.com \
-				  --reason "Emergency security patch (JIRA-1234)"`),
+				  --reason "Emergency security patch (JIRA-1234)"
+				
+				eiam assume-privileges \
+				  --service-account-email example@my-project.iam.gserviceaccount.com \
+				  --reason "Incident response (INC-5678)" \
+				  --duration 45m
+				
+				eiam assume-privileges \
+				  --service-account-email example@my-project.iam.gserviceaccount.com \
+				  --reason "Investigating outage (INC-9012)" \
+				  --read-only
+				
+				eiam assume-privileges \
+				  --service-account-email example@my-project.iam.gserviceaccount.com \
+				  --reason "Rotate keys (JIRA-3456)" \
+				  -- sh -c 'gcloud kms keys list --location global --keyring prod && kubectl get pods'
+				
+				eiam assume-privileges \
+				  --service-account-email reports@my-project.iam.gserviceaccount.com \
+				  --reason "Export quarterly report (JIRA-4567)" \
+				  --scopes cloud-platform,spreadsheets,drive.readonly
+				
+				eiam assume-privileges \
+				  --service-account-email break-glass@prod-project.iam.gserviceaccount.com \
+				  --delegate gateway@admin-project.iam.gserviceaccount.com \
+				  --reason "Break glass (INC-7890)"
+				
+				eiam assume-privileges \
+				  --service-account-email workspace-admin@my-project.iam.gserviceaccount.com \
+				  --reason "Offboard departing employee (JIRA-5678)" \
+				  --subject admin@example.com --scopes admin.directory.user`),
+		Args: checkSessionCommand,
 		PreRunE: func(cmd *cobra.Command, args []string) error {
 			cmd.Flags().VisitAll(options.CheckRequired)
 
+			if err := checkSessionDuration(apCmdConfig.Duration); err != nil {
+				return err
+			}
+			if err := checkReadOnlySession(&apCmdConfig); err != nil {
+				return err
+			}
+
+			if apCmdConfig.ReadOnly {
+				apCmdConfig.Reason = util.ReadOnlyReasonPrefix + apCmdConfig.Reason
+			}
+			apCmdConfig.Reason = util.ReasonWithSubject(apCmdConfig.Subject, apCmdConfig.Reason)
 			if err := util.FormatReason(&apCmdConfig.Reason); err != nil {
 				return err
 			}
+			scopes, err := resolveScopes(apCmdConfig.Scopes, apCmdConfig.ServiceAccountEmail)
+			if err != nil {
+				return err
+			}
+			apCmdConfig.Scopes = scopes
 
 			if !options.YesOption {
-				util.Confirm(map[string]string{
-					"Project":         apCmdConfig.Project,
-					"Service Account": apCmdConfig.ServiceAccountEmail,
-					"Reason":          apCmdConfig.Reason,
-				})
+				fields := map[string]string{
+					"Duration":         apCmdConfig.Duration.String(),
+					"Read-Only":        strconv.FormatBool(apCmdConfig.ReadOnly),
+					"Recorded":         strconv.FormatBool(apCmdConfig.Record),
+					"Metadata Server":  strconv.FormatBool(apCmdConfig.MetadataServer),
+					"Credentials File": strconv.FormatBool(apCmdConfig.CredentialsFile),
+				}
+				if len(args) > 0 {
+					fields["Command"] = strings.Join(args, " ")
+				}
+				util.Confirm(confirmFields(&apCmdConfig, fields))
 			}
 			return nil
 		},
 		RunE: func(cmd *cobra.Command, args []string) error {
-			return startPrivilegedSession()
+			return startPrivilegedSession(args)
 		},
 	}
 
 	options.AddServiceAccountEmailFlag(cmd.Flags(), &apCmdConfig.ServiceAccountEmail, true)
 	options.AddReasonFlag(cmd.Flags(), &apCmdConfig.Reason, true)
 	options.AddProjectFlag(cmd.Flags(), &apCmdConfig.Project)
+	options.AddDelegateFlag(cmd.Flags(), &apCmdConfig.Delegates)
+	options.AddScopesFlag(cmd.Flags(), &apCmdConfig.Scopes)
+	options.AddSubjectFlag(cmd.Flags(), &apCmdConfig.Subject)
+	options.AddDurationFlag(cmd.Flags(), &apCmdConfig.Duration)
+	options.AddReadOnlyFlag(cmd.Flags(), &apCmdConfig.ReadOnly)
+	options.AddRecordFlag(cmd.Flags(), &apCmdConfig.Record)
+	options.AddMetadataServerFlag(cmd.Flags(), &apCmdConfig.MetadataServer)
+	options.AddCredentialsFileFlag(cmd.Flags(), &apCmdConfig.CredentialsFile)
 
 	return cmd
 }
 
-func startPrivilegedSession() error {
-	hasAccess, err := gcpclient.CanImpersonate(
+// checkSessionCommand ensures that the only arguments are the command to run in
+// the session, which must come after "--" so that its flags are not parsed by
+// eiam
+func checkSessionCommand(cmd *cobra.Command, args []string) error {
+	if len(args) > 0 && cmd.ArgsLenAtDash() != 0 {
+		err := fmt.Errorf("unexpected arguments %q, the command to run must come after \"--\"", args)
+		return errorsutil.EiamError{
+			Log: util.Logger.WithError(err),
+			Msg: "Invalid arguments",
+			Err: err,
+		}
+	}
+	return nil
+}
+
+// checkReadOnlySession ensures that a read-only session doesn't give the
+// sub-shell credentials whose requests bypass the auth proxy
+func checkReadOnlySession(cfg *options.CmdConfig) error {
+	var flag string
+	switch {
+	case !cfg.ReadOnly:
+		return nil
+	case cfg.CredentialsFile:
+		flag = options.CredentialsFileFlag.Name
+	case cfg.MetadataServer:
+		flag = options.MetadataServerFlag.Name
+	default:
+		return nil
+	}
+	err := fmt.Errorf("--%s can't be used with --%s, since requests made with its credentials don't go through the auth proxy", flag, options.ReadOnlyFlag.Name)
+	return errorsutil.EiamError{
+		Log: util.Logger.WithError(err),
+		Msg: "Invalid session options",
+		Err: err,
+	}
+}
+
+// checkSessionDuration ensures that the requested privileged session length
+// is positive and does not exceed the configured maximum
+func checkSessionDuration(duration time.Duration) error {
+	maxDuration := viper.GetDuration("session.maxduration")
+	if duration <= 0 || duration > maxDuration {
+		err := fmt.Errorf("the session duration must be greater than 0s and at most %s", maxDuration)
+		return errorsutil.EiamError{
+			Log: util.Logger.WithError(err),
+			Msg: "Invalid session duration",
+			Err: err,
+		}
+	}
+	return nil
+}
+
+func startPrivilegedSession(command []string) error {
+	hasAccess, err := gcpclient.CanGenerateAccessToken(
 		apCmdConfig.Project,
 		apCmdConfig.ServiceAccountEmail,
+		apCmdConfig.Subject,
 		apCmdConfig.Reason,
+		apCmdConfig.Delegates...,
 	)
 	if err != nil {
 		return err
@@ -71,24 +251,48 @@ func startPrivilegedSession() error {
 	}
 
 	util.Logger.Info("Fetching short-lived access token for ", apCmdConfig.ServiceAccountEmail)
-	accessToken, err := gcpclient.GenerateTemporaryAccessToken(apCmdConfig.ServiceAccountEmail, apCmdConfig.Reason)
+	accessToken, err := gcpclient.GenerateTemporaryAccessToken(apCmdConfig.ServiceAccountEmail, apCmdConfig.Subject, apCmdConfig.Reason, apCmdConfig.Scopes, apCmdConfig.Delegates...)
 	if err != nil {
 		return err
 	}
 
-	util.Logger.Info("Configuring gcloud to use auth proxy")
-	if err := gcpclient.ConfigureGcloudProxy(apCmdConfig.Project); err != nil {
+	defaultCluster := map[string]string{}
+	if apCmdConfig.ReadOnly {
+		// kubectl talks to the clusters directly, so it is only given the
+		// service account's credentials when requests can't bypass the proxy
+		util.Logger.Warn("kubectl is not authenticated as the service account in read-only sessions")
+	} else if defaultCluster, err = selectDefaultCluster(apCmdConfig.Project, apCmdConfig.Reason); err != nil {
 		return err
 	}
+	return proxy.StartProxyServer(proxy.SessionOptions{
+		AccessToken:     accessToken,
+		Reason:          apCmdConfig.Reason,
+		ServiceAccount:  apCmdConfig.ServiceAccountEmail,
+		Subject:         apCmdConfig.Subject,
+		Project:         apCmdConfig.Project,
+		Delegates:       apCmdConfig.Delegates,
+		Scopes:          apCmdConfig.Scopes,
+		Duration:        apCmdConfig.Duration,
+		ReadOnly:        apCmdConfig.ReadOnly,
+		Record:          apCmdConfig.Record,
+		MetadataServer:  apCmdConfig.MetadataServer,
+		CredentialsFile: apCmdConfig.CredentialsFile,
+		Command:         command,
+		DefaultCluster:  defaultCluster,
+	})
+}
 
-	clusters, err := gcpclient.GetClusters(apCmdConfig.Project, apCmdConfig.Reason)
+// selectDefaultCluster returns the cluster that kubectl is configured for in
+// the session, prompting the user to pick one if the project has several.
+func selectDefaultCluster(project, reason string) (map[string]string, error) {
+	clusters, err := gcpclient.GetClusters(project, reason)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	defaultCluster := map[string]string{}
 	if len(clusters) == 0 {
-		util.Logger.Warnf("No clusters found in %s", apCmdConfig.Project)
+		util.Logger.Warnf("No clusters found in %s", project)
 	} else if len(clusters) == 1 {
 		defaultCluster = clusters[0]
 	} else {
@@ -116,14 +320,5 @@ func startPrivilegedSession() error {
 			}
 		}
 	}
-	token := accessToken.GetAccessToken()
-	expirationDate := accessToken.GetExpireTime().AsTime()
-	return proxy.StartProxyServer(
-		token,
-		apCmdConfig.Reason,
-		apCmdConfig.ServiceAccountEmail,
-		apCmdConfig.Project,
-		expirationDate,
-		defaultCluster,
-	)
+	return defaultCluster, nil
 }
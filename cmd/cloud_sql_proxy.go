@@ -13,7 +13,6 @@ import (
 
 	util "github.com/jessesomerville/ephemeral-iam/internal/eiamutil"
 	errorsutil "github.com/jessesomerville/ephemeral-iam/internal/errors"
-	"github.com/jessesomerville/ephemeral-iam/internal/gcpclient"
 	"github.com/jessesomerville/ephemeral-iam/pkg/options"
 )
 
@@ -48,17 +47,20 @@ func newCmdCloudSqlProxy() *cobra.Command {
 			cmd.Flags().VisitAll(options.CheckRequired)
 
 			cloudSqlProxyCmdArgs = util.ExtractUnknownArgs(cmd.Flags(), os.Args)
+			cloudSqlProxyCmdConfig.Reason = util.ReasonWithSubject(cloudSqlProxyCmdConfig.Subject, cloudSqlProxyCmdConfig.Reason)
 			if err := util.FormatReason(&cloudSqlProxyCmdConfig.Reason); err != nil {
 				return err
 			}
+			scopes, err := resolveScopes(cloudSqlProxyCmdConfig.Scopes, cloudSqlProxyCmdConfig.ServiceAccountEmail)
+			if err != nil {
+				return err
+			}
+			cloudSqlProxyCmdConfig.Scopes = scopes
 
 			if !options.YesOption {
-				util.Confirm(map[string]string{
-					"Project":         cloudSqlProxyCmdConfig.Project,
-					"Service Account": cloudSqlProxyCmdConfig.ServiceAccountEmail,
-					"Reason":          cloudSqlProxyCmdConfig.Reason,
-					"Command":         fmt.Sprintf("cloud_sql_proxy %s", strings.Join(cloudSqlProxyCmdArgs, " ")),
-				})
+				util.Confirm(confirmFields(&cloudSqlProxyCmdConfig, map[string]string{
+					"Command": fmt.Sprintf("cloud_sql_proxy %s", strings.Join(cloudSqlProxyCmdArgs, " ")),
+				}))
 			}
 			return nil
 		},
@@ -70,30 +72,21 @@ func newCmdCloudSqlProxy() *cobra.Command {
 	options.AddServiceAccountEmailFlag(cmd.Flags(), &cloudSqlProxyCmdConfig.ServiceAccountEmail, true)
 	options.AddReasonFlag(cmd.Flags(), &cloudSqlProxyCmdConfig.Reason, true)
 	options.AddProjectFlag(cmd.Flags(), &cloudSqlProxyCmdConfig.Project)
+	options.AddDelegateFlag(cmd.Flags(), &cloudSqlProxyCmdConfig.Delegates)
+	options.AddScopesFlag(cmd.Flags(), &cloudSqlProxyCmdConfig.Scopes)
+	options.AddSubjectFlag(cmd.Flags(), &cloudSqlProxyCmdConfig.Subject)
 
 	return cmd
 }
 
 func runCloudSqlProxyCommand() error {
-	hasAccess, err := gcpclient.CanImpersonate(
-		cloudSqlProxyCmdConfig.Project,
-		cloudSqlProxyCmdConfig.ServiceAccountEmail,
-		cloudSqlProxyCmdConfig.Reason,
-	)
-	if err != nil {
-		return err
-	} else if !hasAccess {
-		util.Logger.Fatalln("You do not have access to impersonate this service account")
-	}
-
-	util.Logger.Infof("Fetching access token for %s", cloudSqlProxyCmdConfig.ServiceAccountEmail)
-	accessToken, err := gcpclient.GenerateTemporaryAccessToken(cloudSqlProxyCmdConfig.ServiceAccountEmail, cloudSqlProxyCmdConfig.Reason)
+	accessToken, err := fetchAccessToken(&cloudSqlProxyCmdConfig)
 	if err != nil {
 		return err
 	}
 
 	util.Logger.Infof("Running: [cloud_sql_proxy %s]\n\n", strings.Join(cloudSqlProxyCmdArgs, " "))
-	cloudSqlProxyAuth := append(cloudSqlProxyCmdArgs, "-token", accessToken.GetAccessToken())
+	cloudSqlProxyAuth := append(cloudSqlProxyCmdArgs, "-token", accessToken)
 	c := exec.Command(viper.GetString("binarypaths.cloudSqlProxy"), cloudSqlProxyAuth...)
 	c.Stdout = os.Stdout
 	c.Stderr = os.Stderr
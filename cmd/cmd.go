@@ -1,10 +1,17 @@
 package cmd
 
 import (
+	"strings"
+
 	"github.com/lithammer/dedent"
 	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
 
 	eiam "github.com/jessesomerville/ephemeral-iam/internal"
+	"github.com/jessesomerville/ephemeral-iam/internal/appconfig"
+	util "github.com/jessesomerville/ephemeral-iam/internal/eiamutil"
+	errorsutil "github.com/jessesomerville/ephemeral-iam/internal/errors"
+	"github.com/jessesomerville/ephemeral-iam/internal/gcpclient"
 	"github.com/jessesomerville/ephemeral-iam/pkg/options"
 )
 
@@ -51,18 +58,41 @@ func NewEphemeralIamCommand() (*eiam.RootCommand, error) {
 		`),
 		SilenceErrors: true,
 		SilenceUsage:  true,
+		// Plugins' own persistent pre-run hooks are chained to this one when
+		// they are loaded, so it runs for every command
+		PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+			if err := appconfig.ConfigureSourceIdentity(options.AccountOption); err != nil {
+				return err
+			}
+			// Clean up after privileged sessions that were killed or crashed
+			if _, err := repairState(); err != nil {
+				util.Logger.Warn("Failed to clean up after a previous privileged session, please run `eiam repair`")
+			}
+			if err := removeExpiredGrants(grantStore()); err != nil {
+				util.Logger.Warn("Failed to remove expired grants, run `eiam grant list` to see them")
+			}
+			return nil
+		},
 	}}
 
 	cmds.ResetFlags()
 
+	cmds.AddCommand(newCmdAgent())
 	cmds.AddCommand(newCmdAssumePrivileges())
 	cmds.AddCommand(newCmdCloudSqlProxy())
 	cmds.AddCommand(newCmdConfig())
+	cmds.AddCommand(newCmdEnv())
 	cmds.AddCommand(newCmdGcloud())
+	cmds.AddCommand(newCmdGrant())
+	cmds.AddCommand(newCmdIDToken())
 	cmds.AddCommand(newCmdKubectl())
 	cmds.AddCommand(newCmdListServiceAccounts())
 	cmds.AddCommand(newCmdPlugins())
 	cmds.AddCommand(newCmdQueryPermissions())
+	cmds.AddCommand(newCmdRepair())
+	cmds.AddCommand(newCmdSession())
+	cmds.AddCommand(newCmdSignBlob())
+	cmds.AddCommand(newCmdSignJwt())
 	cmds.AddCommand(newCmdVersion())
 	if err := cmds.LoadPlugins(); err != nil {
 		return nil, err
@@ -73,3 +103,74 @@ func NewEphemeralIamCommand() (*eiam.RootCommand, error) {
 
 	return cmds, nil
 }
+
+// confirmFields returns the fields shown in the confirmation prompt of a
+// command that impersonates cfg.ServiceAccountEmail, with the command's own
+// fields added
+func confirmFields(cfg *options.CmdConfig, fields map[string]string) map[string]string {
+	fields["Project"] = cfg.Project
+	fields["Service Account"] = cfg.ServiceAccountEmail
+	fields["Reason"] = cfg.Reason
+	if len(cfg.Delegates) > 0 {
+		fields["Delegates"] = strings.Join(cfg.Delegates, " -> ")
+	}
+	if len(cfg.Scopes) > 0 {
+		fields["Scopes"] = strings.Join(cfg.Scopes, ", ")
+	}
+	if cfg.Subject != "" {
+		fields["Subject"] = cfg.Subject
+	}
+	return fields
+}
+
+// sourceAccount returns the account that eiam impersonates service accounts
+// as, which is the account selected with --account or the active account in
+// the gcloud config
+func sourceAccount() (string, error) {
+	if account := appconfig.Account(); account != "" {
+		return account, nil
+	}
+	return gcpclient.CheckActiveAccountSet()
+}
+
+// scopeProfile is an entry of session.scopeprofiles, which sets the default
+// OAuth scopes of a service account's access tokens
+type scopeProfile struct {
+	ServiceAccount string   `mapstructure:"serviceaccount"`
+	Scopes         []string `mapstructure:"scopes"`
+}
+
+// resolveScopes returns the full URLs of the OAuth scopes to generate the
+// service account's access tokens with. Scopes passed with --scopes take
+// precedence over the service account's scope profile, which takes precedence
+// over session.defaultscopes.
+func resolveScopes(scopes []string, serviceAccountEmail string) ([]string, error) {
+	if len(scopes) == 0 {
+		var profiles []scopeProfile
+		if err := viper.UnmarshalKey("session.scopeprofiles", &profiles); err != nil {
+			return nil, errorsutil.EiamError{
+				Log: util.Logger.WithError(err),
+				Msg: "Failed to parse session.scopeprofiles in the config",
+				Err: err,
+			}
+		}
+		for _, profile := range profiles {
+			if strings.EqualFold(profile.ServiceAccount, serviceAccountEmail) {
+				scopes = profile.Scopes
+				break
+			}
+		}
+	}
+	if len(scopes) == 0 {
+		scopes = viper.GetStringSlice("session.defaultscopes")
+	}
+	resolved, err := gcpclient.ResolveScopes(scopes)
+	if err != nil {
+		return nil, errorsutil.EiamError{
+			Log: util.Logger.WithError(err),
+			Msg: "Invalid scopes",
+			Err: err,
+		}
+	}
+	return resolved, nil
+}
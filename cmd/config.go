@@ -5,6 +5,8 @@ import (
 	"fmt"
 	"io/ioutil"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/lithammer/dedent"
 	"github.com/sirupsen/logrus"
@@ -13,15 +15,32 @@ import (
 
 	util "github.com/jessesomerville/ephemeral-iam/internal/eiamutil"
 	errorsutil "github.com/jessesomerville/ephemeral-iam/internal/errors"
+	"github.com/jessesomerville/ephemeral-iam/internal/federation"
+	"github.com/jessesomerville/ephemeral-iam/internal/gcpclient"
+	"github.com/jessesomerville/ephemeral-iam/internal/proxy/policy"
 )
 
 var (
 	LoggingLevels    = []string{"trace", "debug", "info", "warn", "error", "fatal", "panic"}
 	LoggingFormats   = []string{"text", "json", "debug"}
 	BoolConfigFields = []string{
+		"authproxy.readonly",
 		"authproxy.verbose",
 		"logging.disableleveltruncation",
 		"logging.padleveltext",
+		"session.credentialsfile",
+		"session.metadataserver",
+		"session.record",
+	}
+	ListConfigFields = []string{
+		"authproxy.allowedhosts",
+		"authproxy.allowedmethods",
+		"session.defaultscopes",
+	}
+	DurationConfigFields = []string{
+		"session.defaultduration",
+		"session.expirywarning",
+		"session.maxduration",
 	}
 )
 
@@ -29,6 +48,17 @@ var configInfo = dedent.Dedent(`
 		┏━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━┳━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━┓
 		┃ Key                            ┃ Description                                 ┃
 		┡━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━╇━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━┩
+		│ auth.account                   │ The gcloud account to impersonate service   │
+		│                                │ accounts as instead of the application      │
+		│                                │ default credentials. Can be overridden      │
+		│                                │ with --account                              │
+		├────────────────────────────────┼─────────────────────────────────────────────┤
+		│ authproxy.allowedhosts         │ Comma-separated glob patterns of the hosts  │
+		│                                │ that the auth proxy sends credentials to    │
+		├────────────────────────────────┼─────────────────────────────────────────────┤
+		│ authproxy.allowedmethods       │ Comma-separated HTTP methods that the auth  │
+		│                                │ proxy allows                                │
+		├────────────────────────────────┼─────────────────────────────────────────────┤
 		│ authproxy.certfile             │ The path to the auth proxy's TLS            │
 		│                                │ certificate                                 │
 		├────────────────────────────────┼─────────────────────────────────────────────┤
@@ -42,6 +72,9 @@ var configInfo = dedent.Dedent(`
 		├────────────────────────────────┼─────────────────────────────────────────────┤
 		│ authproxy.proxyport            │ The port that the auth proxy runs on        │
 		├────────────────────────────────┼─────────────────────────────────────────────┤
+		│ authproxy.readonly             │ When set to 'true', privileged sessions are │
+		│                                │ read-only unless --read-only=false is set   │
+		├────────────────────────────────┼─────────────────────────────────────────────┤
 		│ authproxy.verbose              │ When set to 'true', verbose output for      │
 		│                                │ proxy logs will be enabled                  │
 		├────────────────────────────────┼─────────────────────────────────────────────┤
@@ -51,6 +84,16 @@ var configInfo = dedent.Dedent(`
 		│ binarypaths.kubectl            │ The path to the kubectl binary on your      │
 		│                                │ filesystem                                  │
 		├────────────────────────────────┼─────────────────────────────────────────────┤
+		│ federation.provider            │ The workload identity provider that CI jobs │
+		│                                │ exchange their OIDC token through. Can also │
+		│                                │ be set with EIAM_WORKLOAD_IDENTITY_PROVIDER │
+		├────────────────────────────────┼─────────────────────────────────────────────┤
+		│ federation.tokenfile           │ The path to the CI job's OIDC token. Can    │
+		│                                │ also be set with EIAM_OIDC_TOKEN_FILE       │
+		├────────────────────────────────┼─────────────────────────────────────────────┤
+		│ federation.tokenurl            │ The token exchange endpoint of the Security │
+		│                                │ Token Service                               │
+		├────────────────────────────────┼─────────────────────────────────────────────┤
 		│ logging.format                 │ The format for which to write console logs  │
 		│                                │ Can be 'json', 'text', or 'debug'           │
 		├────────────────────────────────┼─────────────────────────────────────────────┤
@@ -63,6 +106,35 @@ var configInfo = dedent.Dedent(`
 		├────────────────────────────────┼─────────────────────────────────────────────┤
 		│ logging.padleveltext           │ When set to 'true', output logs will align  │
 		│                                │ evenly with their output level indicator    │
+		├────────────────────────────────┼─────────────────────────────────────────────┤
+		│ session.credentialsfile        │ When set to 'true', privileged sub-shells   │
+		│                                │ get an impersonated credentials file        │
+		├────────────────────────────────┼─────────────────────────────────────────────┤
+		│ session.defaultduration        │ How long a privileged session lasts when    │
+		│                                │ the --duration flag is not provided         │
+		├────────────────────────────────┼─────────────────────────────────────────────┤
+		│ session.defaultscopes          │ Comma-separated OAuth scopes of access      │
+		│                                │ tokens when --scopes is not set and the     │
+		│                                │ service account has no scope profile        │
+		├────────────────────────────────┼─────────────────────────────────────────────┤
+		│ session.expirywarning          │ How long before a privileged session        │
+		│                                │ expires to warn that it is about to end     │
+		├────────────────────────────────┼─────────────────────────────────────────────┤
+		│ session.maxduration            │ The longest duration that a privileged      │
+		│                                │ session can be started with                 │
+		├────────────────────────────────┼─────────────────────────────────────────────┤
+		│ session.metadataserver         │ When set to 'true', privileged sessions     │
+		│                                │ start a local GCE metadata server           │
+		├────────────────────────────────┼─────────────────────────────────────────────┤
+		│ session.record                 │ When set to 'true', privileged sub-shells   │
+		│                                │ are recorded unless --record=false is set   │
+		├────────────────────────────────┼─────────────────────────────────────────────┤
+		│ session.scopeprofiles          │ Default OAuth scopes per service account,   │
+		│                                │ as a list of 'serviceaccount' and 'scopes'  │
+		│                                │ entries. Edit the config file to change it  │
+		├────────────────────────────────┼─────────────────────────────────────────────┤
+		│ session.shell                  │ The shell to use for privileged sub-shells. │
+		│                                │ Defaults to $SHELL, or bash if it is unset  │
 		└────────────────────────────────┴─────────────────────────────────────────────┘
 `)
 
@@ -177,6 +249,52 @@ func newCmdConfigSet() *cobra.Command {
 						Err: err,
 					}
 				}
+			} else if args[0] == "federation.provider" && args[1] != "" {
+				if err := federation.ValidateProvider(args[1]); err != nil {
+					return errorsutil.EiamError{
+						Log: util.Logger.WithError(err),
+						Msg: "Invalid command arguments",
+						Err: err,
+					}
+				}
+			} else if args[0] == "session.scopeprofiles" {
+				err := fmt.Errorf("%s can only be changed by editing %s", args[0], viper.ConfigFileUsed())
+				return errorsutil.EiamError{
+					Log: util.Logger.WithError(err),
+					Msg: "Invalid command arguments",
+					Err: err,
+				}
+			} else if args[0] == "session.defaultscopes" {
+				if _, err := gcpclient.ResolveScopes(splitConfigList(args[1])); err != nil {
+					return errorsutil.EiamError{
+						Log: util.Logger.WithError(err),
+						Msg: "Invalid command arguments",
+						Err: err,
+					}
+				}
+			} else if util.Contains(ListConfigFields, args[0]) {
+				p := &policy.Policy{}
+				if args[0] == "authproxy.allowedhosts" {
+					p.AllowedHosts = splitConfigList(args[1])
+				} else {
+					p.AllowedMethods = splitConfigList(args[1])
+				}
+				if err := p.Validate(); err != nil {
+					return errorsutil.EiamError{
+						Log: util.Logger.WithError(err),
+						Msg: "Invalid command arguments",
+						Err: err,
+					}
+				}
+			} else if util.Contains(DurationConfigFields, args[0]) {
+				if _, err := time.ParseDuration(args[1]); err != nil {
+					err := fmt.Errorf("the %s value must be a duration such as 10m or 1h30m", args[0])
+					return errorsutil.EiamError{
+						Log: util.Logger.WithError(err),
+						Msg: "Invalid command arguments",
+						Err: err,
+					}
+				}
 			}
 			return nil
 		},
@@ -190,6 +308,8 @@ func newCmdConfigSet() *cobra.Command {
 			if util.Contains(BoolConfigFields, args[0]) {
 				newValue, _ := strconv.ParseBool(args[1])
 				viper.Set(args[0], newValue)
+			} else if util.Contains(ListConfigFields, args[0]) {
+				viper.Set(args[0], splitConfigList(args[1]))
 			} else {
 				viper.Set(args[0], args[1])
 			}
@@ -229,3 +349,14 @@ func newCmdConfigSet() *cobra.Command {
 	}
 	return cmd
 }
+
+// splitConfigList parses a comma-separated config value into a list
+func splitConfigList(value string) []string {
+	items := []string{}
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
@@ -4,8 +4,10 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
+	"reflect"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/andreyvit/diff"
 	"github.com/lithammer/dedent"
@@ -237,3 +239,54 @@ func TestConfigSetCommandSetLoggingFormat(t *testing.T) {
 		t.Errorf("unexpected error: %v", err)
 	}
 }
+
+func TestConfigSetCommandSetSessionDuration(t *testing.T) {
+	initialDuration := viper.GetString("session.defaultduration")
+
+	output, err := executeCommand(configSetCommand, "session.defaultduration", "ten minutes")
+	if err == nil {
+		t.Errorf("expected error caused by invalid duration value `ten minutes`\nOUTPUT:\n%s", output)
+	}
+	expectedOutput := "the session.defaultduration value must be a duration"
+	if !strings.Contains(output, expectedOutput) {
+		t.Errorf("unexpected output:\nEXPECTED TO FIND: %s\nACTUAL: %s", expectedOutput, output)
+	}
+
+	output, err = executeCommand(configSetCommand, "session.defaultduration", "15m")
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if duration := viper.GetDuration("session.defaultduration"); duration != 15*time.Minute {
+		t.Errorf("Unexpected failure: The `eiam config set session.defaultduration 15m` command did not properly update the config\nOUTPUT:\n%s", output)
+	}
+
+	if _, err := executeCommand(configSetCommand, "session.defaultduration", initialDuration); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestConfigSetCommandSetAllowedHosts(t *testing.T) {
+	initialHosts := strings.Join(viper.GetStringSlice("authproxy.allowedhosts"), ",")
+
+	output, err := executeCommand(configSetCommand, "authproxy.allowedhosts", "[.googleapis.com")
+	if err == nil {
+		t.Errorf("expected error caused by invalid host pattern `[.googleapis.com`\nOUTPUT:\n%s", output)
+	}
+	expectedOutput := "invalid host pattern"
+	if !strings.Contains(output, expectedOutput) {
+		t.Errorf("unexpected output:\nEXPECTED TO FIND: %s\nACTUAL: %s", expectedOutput, output)
+	}
+
+	output, err = executeCommand(configSetCommand, "authproxy.allowedhosts", "*.googleapis.com, dl.google.com")
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	expectedHosts := []string{"*.googleapis.com", "dl.google.com"}
+	if hosts := viper.GetStringSlice("authproxy.allowedhosts"); !reflect.DeepEqual(hosts, expectedHosts) {
+		t.Errorf("Unexpected failure: The `eiam config set authproxy.allowedhosts` command did not properly update the config\nOUTPUT:\n%s", output)
+	}
+
+	if _, err := executeCommand(configSetCommand, "authproxy.allowedhosts", initialHosts); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
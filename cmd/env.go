@@ -0,0 +1,94 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/lithammer/dedent"
+	"github.com/spf13/cobra"
+
+	"github.com/jessesomerville/ephemeral-iam/internal/metadata"
+	"github.com/jessesomerville/ephemeral-iam/internal/session"
+	"github.com/jessesomerville/ephemeral-iam/internal/shellrc"
+	"github.com/jessesomerville/ephemeral-iam/pkg/options"
+)
+
+var envCmdConfig options.CmdConfig
+
+func newCmdEnv() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "env",
+		Short: "Print the environment variables that route other tools through a privileged session",
+		Long: dedent.Dedent(`
+			The "env" command prints shell export statements that point other tools at the auth proxy of
+			a running privileged session. This lets tools other than gcloud, such as Terraform, curl,
+			gsutil and the Google Cloud client libraries, make API calls as the session's service
+			account.
+			
+			The following environment variables are set:
+			  HTTPS_PROXY            The address of the session's auth proxy
+			  REQUESTS_CA_BUNDLE     The auth proxy's CA certificate, for Python tools
+			  SSL_CERT_FILE          The auth proxy's CA certificate, for OpenSSL and Go tools
+			  CLOUDSDK_CONFIG        The session's gcloud configuration directory
+			  CLOUDSDK_CORE_PROJECT  The session's project
+			  KUBECONFIG             The session's kubeconfig
+			  EIAM_SESSION_ID        The ID of the session, used by the "session" commands
+			  GOOGLE_APPLICATION_CREDENTIALS
+			                         The session's impersonated credentials file, if it was written
+			  GCE_METADATA_HOST      The session's metadata server, if it was started with the
+			                         --metadata-server flag
+			  GCE_METADATA_IP        The same address, for client libraries that read it instead
+			
+			Requests to hosts that are not allowed by the authproxy.allowedhosts config value are
+			rejected by the auth proxy.`),
+		Example: dedent.Dedent(`
+				eval "$(eiam env)"
+				
+				eval "$(eiam env --session-id 0123456789abcdef)"`),
+		PreRunE: func(cmd *cobra.Command, args []string) error {
+			sessionID, err := session.ResolveID(envCmdConfig.SessionID)
+			if err != nil {
+				return err
+			}
+			envCmdConfig.SessionID = sessionID
+			return nil
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			info, err := session.Status(envCmdConfig.SessionID)
+			if err != nil {
+				return err
+			}
+			for _, env := range sessionEnvVars(info) {
+				fmt.Printf("export %s=%s\n", env[0], shellrc.Quote(env[1]))
+			}
+			return nil
+		},
+	}
+
+	options.AddSessionIDFlag(cmd.Flags(), &envCmdConfig.SessionID)
+
+	return cmd
+}
+
+// sessionEnvVars returns the names and values of the environment variables that
+// route tools through the session's auth proxy
+func sessionEnvVars(info *session.Info) [][2]string {
+	vars := [][2]string{
+		{"HTTPS_PROXY", fmt.Sprintf("http://%s", info.ProxyAddress)},
+		{"REQUESTS_CA_BUNDLE", info.CertFile},
+		{"SSL_CERT_FILE", info.CertFile},
+		{"CLOUDSDK_CONFIG", info.GcloudConfig},
+		{"CLOUDSDK_CORE_PROJECT", info.Project},
+		{"KUBECONFIG", info.KubeConfig},
+		{session.EnvSessionID, info.ID},
+	}
+	if info.CredentialsFile != "" {
+		vars = append(vars, [2]string{"GOOGLE_APPLICATION_CREDENTIALS", info.CredentialsFile})
+	}
+	if info.MetadataAddress != "" {
+		vars = append(vars,
+			[2]string{metadata.EnvHost, info.MetadataAddress},
+			[2]string{metadata.EnvIP, info.MetadataAddress},
+		)
+	}
+	return vars
+}
@@ -2,6 +2,7 @@ package cmd
 
 import (
 	"fmt"
+	"io/ioutil"
 	"os"
 	"os/exec"
 	"strings"
@@ -10,6 +11,8 @@ import (
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 
+	"github.com/jessesomerville/ephemeral-iam/internal/agent"
+	"github.com/jessesomerville/ephemeral-iam/internal/appconfig"
 	util "github.com/jessesomerville/ephemeral-iam/internal/eiamutil"
 	errorsutil "github.com/jessesomerville/ephemeral-iam/internal/errors"
 	"github.com/jessesomerville/ephemeral-iam/internal/gcpclient"
@@ -27,7 +30,12 @@ func newCmdGcloud() *cobra.Command {
 		Short: "Run a gcloud command with the permissions of the specified service account",
 		Long: dedent.Dedent(`
 			The "gcloud" command runs the provided gcloud command with the permissions of the specified
-			service account. Output from the gcloud command is able to be piped into other commands.`),
+			service account. Output from the gcloud command is able to be piped into other commands.
+			
+			The scopes flag sets the OAuth scopes of the access token that gcloud uses. It defaults to the
+			service account's scope profile, or the session.defaultscopes config value. When the scopes
+			are not the default cloud-platform and userinfo.email scopes, gcloud is given an access token
+			generated by eiam instead of impersonating the service account itself.`),
 		Example: dedent.Dedent(`
 			eiam gcloud compute instances list --format=json \
 			--service-account-email example@my-project.iam.gserviceaccount.com \
@@ -42,17 +50,20 @@ func newCmdGcloud() *cobra.Command {
 			cmd.Flags().VisitAll(options.CheckRequired)
 
 			gcloudCmdArgs = util.ExtractUnknownArgs(cmd.Flags(), os.Args)
+			gcloudCmdConfig.Reason = util.ReasonWithSubject(gcloudCmdConfig.Subject, gcloudCmdConfig.Reason)
 			if err := util.FormatReason(&gcloudCmdConfig.Reason); err != nil {
 				return err
 			}
+			scopes, err := resolveScopes(gcloudCmdConfig.Scopes, gcloudCmdConfig.ServiceAccountEmail)
+			if err != nil {
+				return err
+			}
+			gcloudCmdConfig.Scopes = scopes
 
 			if !options.YesOption {
-				util.Confirm(map[string]string{
-					"Project":         gcloudCmdConfig.Project,
-					"Service Account": gcloudCmdConfig.ServiceAccountEmail,
-					"Reason":          gcloudCmdConfig.Reason,
-					"Command":         fmt.Sprintf("gcloud %s", strings.Join(gcloudCmdArgs, " ")),
-				})
+				util.Confirm(confirmFields(&gcloudCmdConfig, map[string]string{
+					"Command": fmt.Sprintf("gcloud %s", strings.Join(gcloudCmdArgs, " ")),
+				}))
 			}
 			return nil
 		},
@@ -64,33 +75,60 @@ func newCmdGcloud() *cobra.Command {
 	options.AddServiceAccountEmailFlag(cmd.Flags(), &gcloudCmdConfig.ServiceAccountEmail, true)
 	options.AddReasonFlag(cmd.Flags(), &gcloudCmdConfig.Reason, true)
 	options.AddProjectFlag(cmd.Flags(), &gcloudCmdConfig.Project)
+	options.AddDelegateFlag(cmd.Flags(), &gcloudCmdConfig.Delegates)
+	options.AddScopesFlag(cmd.Flags(), &gcloudCmdConfig.Scopes)
+	options.AddSubjectFlag(cmd.Flags(), &gcloudCmdConfig.Subject)
 
 	return cmd
 }
 
 func runGcloudCommand() error {
-	hasAccess, err := gcpclient.CanImpersonate(
-		gcloudCmdConfig.Project,
-		gcloudCmdConfig.ServiceAccountEmail,
-		gcloudCmdConfig.Reason,
-	)
-	if err != nil {
-		return err
-	} else if !hasAccess {
-		util.Logger.Fatalln("You do not have access to impersonate this service account")
-	}
-
 	// gcloud reads the CLOUDSDK_CORE_REQUEST_REASON environment variable
 	// and sets the X-Goog-Request-Reason header in API requests to its value
-	reasonHeader := fmt.Sprintf("CLOUDSDK_CORE_REQUEST_REASON=%s", gcloudCmdConfig.Reason)
+	env := append(os.Environ(), fmt.Sprintf("CLOUDSDK_CORE_REQUEST_REASON=%s", gcloudCmdConfig.Reason))
+	var authArgs []string
+
+	if os.Getenv(agent.EnvSocket) != "" || appconfig.Federated() || gcloudCmdConfig.Subject != "" ||
+		!sameScopes(gcloudCmdConfig.Scopes, gcpclient.AccessTokenScopes) {
+		// gcloud uses an access token from eiam instead of impersonating the
+		// service account itself, either because the agent has one cached,
+		// because gcloud isn't logged in as eiam's external account, or because
+		// gcloud can't use domain-wide delegation or choose the token's scopes
+		tokenFile, err := writeAccessTokenFile()
+		if err != nil {
+			return err
+		}
+		defer os.Remove(tokenFile)
+		env = append(env, fmt.Sprintf("CLOUDSDK_AUTH_ACCESS_TOKEN_FILE=%s", tokenFile))
+	} else {
+		hasAccess, err := gcpclient.CanImpersonate(
+			gcloudCmdConfig.Project,
+			gcloudCmdConfig.ServiceAccountEmail,
+			gcloudCmdConfig.Reason,
+			gcloudCmdConfig.Delegates...,
+		)
+		if err != nil {
+			return err
+		} else if !hasAccess {
+			util.Logger.Fatalln("You do not have access to impersonate this service account")
+		}
+
+		// gcloud accepts a delegation chain as a comma separated list that ends
+		// with the service account to impersonate
+		impersonationChain := append(append([]string{}, gcloudCmdConfig.Delegates...), gcloudCmdConfig.ServiceAccountEmail)
+		authArgs = []string{"--impersonate-service-account", strings.Join(impersonationChain, ",")}
+		if account := appconfig.Account(); account != "" {
+			authArgs = append(authArgs, "--account", account)
+		}
+	}
 
 	// There has to be a better way to do this...
 	util.Logger.Infof("Running: [gcloud %s]\n\n", strings.Join(gcloudCmdArgs, " "))
-	gcloudCmdArgs = append(gcloudCmdArgs, "--impersonate-service-account", gcloudCmdConfig.ServiceAccountEmail, "--verbosity=error")
+	gcloudCmdArgs = append(append(gcloudCmdArgs, authArgs...), "--verbosity=error")
 	c := exec.Command(viper.GetString("binarypaths.gcloud"), gcloudCmdArgs...)
 	c.Stdout = os.Stdout
 	c.Stderr = os.Stderr
-	c.Env = append(os.Environ(), reasonHeader)
+	c.Env = env
 
 	if err := c.Run(); err != nil {
 		fullCmd := fmt.Sprintf("gcloud %s", strings.Join(gcloudCmdArgs, " "))
@@ -102,3 +140,45 @@ func runGcloudCommand() error {
 	}
 	return nil
 }
+
+// sameScopes checks if two lists of scope URLs contain the same scopes
+func sameScopes(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for _, scope := range a {
+		if !util.Contains(b, scope) {
+			return false
+		}
+	}
+	return true
+}
+
+// writeAccessTokenFile writes an access token for the service account to a
+// temporary file that only the current user can read, for gcloud's
+// CLOUDSDK_AUTH_ACCESS_TOKEN_FILE
+func writeAccessTokenFile() (string, error) {
+	accessToken, err := fetchAccessToken(&gcloudCmdConfig)
+	if err != nil {
+		return "", err
+	}
+
+	f, err := ioutil.TempFile("", "eiam-token-")
+	if err != nil {
+		return "", errorsutil.EiamError{
+			Log: util.Logger.WithError(err),
+			Msg: "Failed to create access token file",
+			Err: err,
+		}
+	}
+	defer f.Close()
+	if _, err := f.WriteString(accessToken); err != nil {
+		os.Remove(f.Name())
+		return "", errorsutil.EiamError{
+			Log: util.Logger.WithError(err),
+			Msg: "Failed to write access token file",
+			Err: err,
+		}
+	}
+	return f.Name(), nil
+}
@@ -0,0 +1,296 @@
+package cmd
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/lithammer/dedent"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	crm "google.golang.org/api/cloudresourcemanager/v1"
+	"google.golang.org/api/googleapi"
+
+	"github.com/jessesomerville/ephemeral-iam/internal/appconfig"
+	util "github.com/jessesomerville/ephemeral-iam/internal/eiamutil"
+	errorsutil "github.com/jessesomerville/ephemeral-iam/internal/errors"
+	"github.com/jessesomerville/ephemeral-iam/internal/gcpclient"
+	"github.com/jessesomerville/ephemeral-iam/internal/grant"
+	"github.com/jessesomerville/ephemeral-iam/pkg/options"
+)
+
+var (
+	grantCmdConfig options.CmdConfig
+	grantRole      string
+	grantResource  string
+	pendingGrant   *grant.Grant
+
+	// updateIamPolicy is replaced in tests
+	updateIamPolicy = gcpclient.UpdateIamPolicy
+)
+
+func newCmdGrant() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "grant",
+		Short: "Grant yourself an IAM role on a project or organization for a limited time",
+		Long: dedent.Dedent(`
+			The "grant" command adds an IAM binding of the role to your own account on a project or
+			organization. The binding has a condition that stops it from matching once the duration has
+			passed, so the role can be used with your own identity instead of a service account's, and
+			audit logs show who made each request.
+			
+			Grants are recorded locally. The binding is removed with "eiam grant revoke", or automatically
+			the next time eiam runs after the grant has expired. Use "eiam grant list" to see your grants.`),
+		Example: dedent.Dedent(`
+			eiam grant \
+			  --role roles/cloudsql.admin \
+			  --resource projects/my-project \
+			  --duration 1h \
+			  --reason "Restore database backup (JIRA-1234)"
+			
+			eiam grant revoke 5f3a9c1e`),
+		Args: cobra.NoArgs,
+		PreRunE: func(cmd *cobra.Command, args []string) error {
+			cmd.Flags().VisitAll(options.CheckRequired)
+
+			if err := checkSessionDuration(grantCmdConfig.Duration); err != nil {
+				return err
+			}
+			member, err := grantMember()
+			if err != nil {
+				return err
+			}
+			if err := util.FormatReason(&grantCmdConfig.Reason); err != nil {
+				return err
+			}
+			g, err := grant.New(grantRole, grantResource, member, grantCmdConfig.Reason, grantCmdConfig.Duration)
+			if err != nil {
+				return errorsutil.EiamError{
+					Log: util.Logger.WithError(err),
+					Msg: "Invalid grant",
+					Err: err,
+				}
+			}
+			pendingGrant = g
+
+			if !options.YesOption {
+				util.Confirm(map[string]string{
+					"Role":     g.Role,
+					"Resource": g.Resource,
+					"Member":   g.Member,
+					"Reason":   g.Reason,
+					"Duration": grantCmdConfig.Duration.String(),
+					"Expires":  g.Expiry.Local().Format(time.RFC1123),
+				})
+			}
+			return nil
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runGrant(pendingGrant)
+		},
+	}
+
+	cmd.Flags().StringVar(&grantRole, "role", "", "The role to grant, e.g. roles/cloudsql.admin")
+	cmd.Flags().StringVar(&grantResource, "resource", "", "The resource to grant the role on, either projects/PROJECT_ID or organizations/ORGANIZATION_ID")
+	for _, name := range []string{"role", "resource"} {
+		if err := cmd.Flags().SetAnnotation(name, options.RequiredAnnotation, []string{"true"}); err != nil {
+			util.Logger.Fatalf("failed to set required annotation on flag: %v", err)
+		}
+	}
+	cmd.Flags().DurationVarP(&grantCmdConfig.Duration, options.DurationFlag.Name, options.DurationFlag.Shorthand,
+		viper.GetDuration("session.defaultduration"), "How long the role is granted for. Cannot exceed the session.maxduration config value")
+	options.AddReasonFlag(cmd.Flags(), &grantCmdConfig.Reason, true)
+
+	cmd.AddCommand(newCmdGrantList())
+	cmd.AddCommand(newCmdGrantRevoke())
+
+	return cmd
+}
+
+func newCmdGrantList() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "list",
+		Short: "List the roles that you granted yourself",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			grants, err := grantStore().List()
+			if err != nil {
+				return errorsutil.EiamError{
+					Log: util.Logger.WithError(err),
+					Msg: "Failed to read recorded grants",
+					Err: err,
+				}
+			}
+			if len(grants) == 0 {
+				util.Logger.Info("You have no active grants")
+				return nil
+			}
+
+			var buf bytes.Buffer
+			w := tabwriter.NewWriter(&buf, 0, 4, 4, ' ', 0)
+			fmt.Fprintln(w, "ID\tROLE\tRESOURCE\tMEMBER\tREMAINING")
+			for _, g := range grants {
+				remaining := "expired"
+				if !g.Expired(time.Now()) {
+					remaining = time.Until(g.Expiry).Round(time.Second).String()
+				}
+				fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", g.ID, g.Role, g.Resource, g.Member, remaining)
+			}
+			w.Flush()
+			fmt.Print(buf.String())
+			return nil
+		},
+	}
+	return cmd
+}
+
+func newCmdGrantRevoke() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "revoke GRANT_ID...",
+		Short: "Remove the IAM bindings of grants before they expire",
+		Args:  cobra.MinimumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			store := grantStore()
+			for _, id := range args {
+				g, err := store.Get(id)
+				if err != nil {
+					return errorsutil.EiamError{
+						Log: util.Logger.WithError(err),
+						Msg: "Failed to find grant",
+						Err: err,
+					}
+				}
+				if err := revokeGrant(store, g); err != nil {
+					return err
+				}
+				util.Logger.Infof("Revoked %s on %s from %s", g.Role, g.Resource, g.Member)
+			}
+			return nil
+		},
+	}
+	return cmd
+}
+
+func runGrant(g *grant.Grant) error {
+	util.Logger.Infof("Granting %s on %s to %s", g.Role, g.Resource, g.Member)
+	err := updateIamPolicy(g.Resource, g.Reason, func(policy *crm.Policy) bool {
+		grant.AddBinding(policy, g)
+		return true
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := grantStore().Add(g); err != nil {
+		return errorsutil.EiamError{
+			Log: util.Logger.WithError(err),
+			Msg: fmt.Sprintf("Failed to record grant %s, its binding stops matching at %s but has to be removed manually", g.ID, g.Expiry.Local().Format(time.RFC1123)),
+			Err: err,
+		}
+	}
+	util.Logger.Infof("Granted until %s. Run `eiam grant revoke %s` when you are done", g.Expiry.Local().Format(time.RFC1123), g.ID)
+	return nil
+}
+
+// revokeGrant removes the grant's binding and its record. The record is removed
+// even if the binding was already removed by someone else.
+func revokeGrant(store *grant.Store, g *grant.Grant) error {
+	err := updateIamPolicy(g.Resource, g.Reason, func(policy *crm.Policy) bool {
+		if !grant.RemoveBinding(policy, g) {
+			util.Logger.Debugf("The binding of grant %s was already removed from %s", g.ID, g.Resource)
+			return false
+		}
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	if err := store.Remove(g.ID); err != nil {
+		return errorsutil.EiamError{
+			Log: util.Logger.WithError(err),
+			Msg: fmt.Sprintf("Failed to remove the record of grant %s", g.ID),
+			Err: err,
+		}
+	}
+	return nil
+}
+
+// removeExpiredGrants removes the bindings of grants that have expired. Their
+// conditions no longer match, but the bindings would otherwise be left in the
+// policies. A grant that fails to be removed doesn't stop the others from being
+// removed, and grants whose policy can no longer be read or changed are
+// forgotten, since their bindings don't match anymore.
+func removeExpiredGrants(store *grant.Store) error {
+	grants, err := store.List()
+	if err != nil {
+		return err
+	}
+	var failed []string
+	for _, g := range grants {
+		if !g.Expired(time.Now()) {
+			continue
+		}
+		err := revokeGrant(store, g)
+		if err == nil {
+			util.Logger.Infof("Removed expired grant of %s on %s", g.Role, g.Resource)
+			continue
+		}
+		if !isPolicyUnavailable(err) {
+			util.Logger.WithError(err).Debugf("Failed to remove expired grant %s", g.ID)
+			failed = append(failed, g.ID)
+			continue
+		}
+		util.Logger.Warnf("The expired binding of %s on %s can't be removed, the resource no longer exists or you can no longer change its IAM policy", g.Role, g.Resource)
+		if err := store.Remove(g.ID); err != nil {
+			util.Logger.WithError(err).Debugf("Failed to remove the record of grant %s", g.ID)
+			failed = append(failed, g.ID)
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("failed to remove expired grants %s", strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// isPolicyUnavailable checks if an IAM policy update failed because the
+// resource doesn't exist or the caller isn't allowed to update its policy
+func isPolicyUnavailable(err error) bool {
+	eiamErr, ok := err.(errorsutil.EiamError)
+	if !ok {
+		return false
+	}
+	apiErr, ok := eiamErr.Err.(*googleapi.Error)
+	return ok && (apiErr.Code == http.StatusForbidden || apiErr.Code == http.StatusNotFound)
+}
+
+// grantMember returns the IAM member of the account that eiam's API calls are
+// authenticated as, which is the account of the application default
+// credentials. Federated identities are not granted roles, since eiam grant is
+// meant for people rather than CI jobs.
+func grantMember() (string, error) {
+	if appconfig.Federated() {
+		err := errors.New("roles can't be granted when eiam authenticates with workload identity federation")
+		return "", errorsutil.EiamError{
+			Log: util.Logger.WithError(err),
+			Msg: "Invalid grant",
+			Err: err,
+		}
+	}
+	email, err := gcpclient.ADCEmail()
+	if err != nil {
+		return "", err
+	}
+	if strings.HasSuffix(email, ".gserviceaccount.com") {
+		return "serviceAccount:" + email, nil
+	}
+	return "user:" + email, nil
+}
+
+func grantStore() *grant.Store {
+	return grant.NewStore(filepath.Join(appconfig.GetConfigDir(), "grants.json"))
+}
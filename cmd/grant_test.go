@@ -0,0 +1,109 @@
+package cmd
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	crm "google.golang.org/api/cloudresourcemanager/v1"
+	"google.golang.org/api/googleapi"
+
+	util "github.com/jessesomerville/ephemeral-iam/internal/eiamutil"
+	errorsutil "github.com/jessesomerville/ephemeral-iam/internal/errors"
+	"github.com/jessesomerville/ephemeral-iam/internal/grant"
+)
+
+func TestRemoveExpiredGrants(t *testing.T) {
+	dir, err := ioutil.TempDir("", "eiam-grants")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store := grant.NewStore(filepath.Join(dir, "grants.json"))
+
+	newGrant := func(resource string, duration time.Duration) *grant.Grant {
+		g, err := grant.New("roles/viewer", resource, "user:alice@example.com", "r", duration)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := store.Add(g); err != nil {
+			t.Fatal(err)
+		}
+		return g
+	}
+	deleted := newGrant("projects/deleted", -time.Minute)
+	failing := newGrant("projects/failing", -time.Minute)
+	expired := newGrant("projects/ok", -time.Minute)
+	active := newGrant("projects/ok", time.Hour)
+
+	policy := &crm.Policy{}
+	grant.AddBinding(policy, expired)
+	grant.AddBinding(policy, active)
+
+	defer func(update func(string, string, func(*crm.Policy) bool) error) { updateIamPolicy = update }(updateIamPolicy)
+	updateIamPolicy = func(resource, reason string, update func(*crm.Policy) bool) error {
+		apiErr := func(code int) error {
+			err := &googleapi.Error{Code: code}
+			return errorsutil.EiamError{Log: util.Logger.WithError(err), Msg: "Failed to get the IAM policy", Err: err}
+		}
+		switch resource {
+		case "projects/deleted":
+			return apiErr(http.StatusNotFound)
+		case "projects/failing":
+			return apiErr(http.StatusInternalServerError)
+		}
+		update(policy)
+		return nil
+	}
+
+	err = removeExpiredGrants(store)
+	if err == nil || !strings.Contains(err.Error(), failing.ID) {
+		t.Errorf("removeExpiredGrants() = %v, want an error for grant %s", err, failing.ID)
+	}
+
+	// The grant that failed is kept to be retried, the grant whose resource was
+	// deleted is forgotten, and the other expired grant is removed
+	grants, err := store.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []string
+	for _, g := range grants {
+		ids = append(ids, g.ID)
+	}
+	if want := []string{failing.ID, active.ID}; strings.Join(ids, ",") != strings.Join(want, ",") {
+		t.Errorf("recorded grants = %v, want %v (deleted %s, expired %s)", ids, want, deleted.ID, expired.ID)
+	}
+	if len(policy.Bindings) != 1 || policy.Bindings[0].Condition.Title != "eiam-grant-"+active.ID {
+		t.Errorf("only the active grant's binding should be left in the policy: %+v", policy.Bindings)
+	}
+}
+
+func TestIsPolicyUnavailable(t *testing.T) {
+	wrap := func(err error) error {
+		return errorsutil.EiamError{Log: util.Logger.WithError(err), Msg: "Failed", Err: err}
+	}
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"not found", wrap(&googleapi.Error{Code: http.StatusNotFound}), true},
+		{"forbidden", wrap(&googleapi.Error{Code: http.StatusForbidden}), true},
+		{"server error", wrap(&googleapi.Error{Code: http.StatusInternalServerError}), false},
+		{"other error", wrap(errors.New("connection refused")), false},
+		{"unwrapped", &googleapi.Error{Code: http.StatusNotFound}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isPolicyUnavailable(tt.err); got != tt.want {
+				t.Errorf("isPolicyUnavailable(%v) = %t, want %t", tt.err, got, tt.want)
+			}
+		})
+	}
+}
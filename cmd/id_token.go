@@ -0,0 +1,233 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/lithammer/dedent"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+
+	util "github.com/jessesomerville/ephemeral-iam/internal/eiamutil"
+	errorsutil "github.com/jessesomerville/ephemeral-iam/internal/errors"
+	"github.com/jessesomerville/ephemeral-iam/internal/gcpclient"
+	"github.com/jessesomerville/ephemeral-iam/internal/idtoken"
+	"github.com/jessesomerville/ephemeral-iam/internal/lifecycle"
+	"github.com/jessesomerville/ephemeral-iam/pkg/options"
+)
+
+var (
+	idTokenCmdConfig    options.CmdConfig
+	idTokenAudience     string
+	idTokenIncludeEmail bool
+	idTokenProxyTarget  string
+	idTokenProxyPort    int
+)
+
+func newCmdIDToken() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "id-token",
+		Short: "Generate an ID token for the provided service account",
+		Long: dedent.Dedent(`
+			The "id-token" command generates an OpenID Connect ID token for the provided service account
+			and prints it to stdout. ID tokens are used to call services that are protected by
+			Identity-Aware Proxy, authenticated Cloud Run services and Cloud Functions.
+			
+			The audience flag sets the token's audience. For Cloud Run and Cloud Functions this is the
+			URL of the service, and for Identity-Aware Proxy it is the client ID of the OAuth client that
+			IAP uses.
+			
+			The proxy flag starts a local reverse proxy to the provided URL instead of printing the token.
+			Every request sent to the local proxy is forwarded with an ID token for the audience in its
+			Authorization header, and the token is regenerated before it expires. The audience defaults to
+			the proxied URL. The proxy runs until the duration has elapsed or it is interrupted.
+			
+			The reason flag is attached to the request that generates the token, so it is shown in the
+			service account's audit logs.`),
+		Example: dedent.Dedent(`
+			curl -H "Authorization: Bearer $(eiam id-token -y \
+			  --service-account-email invoker@my-project.iam.gserviceaccount.com \
+			  --reason "Debugging checkout service (JIRA-1234)" \
+			  --audience https://checkout-abc123-uc.a.run.app)" \
+			  https://checkout-abc123-uc.a.run.app/healthz
+			
+			eiam id-token \
+			  --service-account-email invoker@my-project.iam.gserviceaccount.com \
+			  --reason "Debugging internal dashboard (JIRA-1234)" \
+			  --audience 123456789-abcdef.apps.googleusercontent.com \
+			  --proxy https://dashboard.example.com --port 8085`),
+		PreRunE: func(cmd *cobra.Command, args []string) error {
+			cmd.Flags().VisitAll(options.CheckRequired)
+
+			if idTokenProxyTarget != "" {
+				if _, err := parseProxyTarget(idTokenProxyTarget); err != nil {
+					return err
+				}
+				if idTokenAudience == "" {
+					idTokenAudience = idTokenProxyTarget
+				}
+				if err := checkSessionDuration(idTokenCmdConfig.Duration); err != nil {
+					return err
+				}
+			}
+			if idTokenAudience == "" {
+				err := errors.New("an audience is required when --proxy is not set")
+				return errorsutil.EiamError{
+					Log: util.Logger.WithError(err),
+					Msg: "Missing required flag: audience",
+					Err: err,
+				}
+			}
+
+			if err := util.FormatReason(&idTokenCmdConfig.Reason); err != nil {
+				return err
+			}
+
+			if !options.YesOption {
+				fields := map[string]string{
+					"Audience":      idTokenAudience,
+					"Include Email": strconv.FormatBool(idTokenIncludeEmail),
+				}
+				if idTokenProxyTarget != "" {
+					fields["Proxy To"] = idTokenProxyTarget
+					fields["Duration"] = idTokenCmdConfig.Duration.String()
+				}
+				// The token is written to stdout, so the prompt goes to stderr
+				util.ConfirmTo(os.Stderr, confirmFields(&idTokenCmdConfig, fields))
+			}
+			return nil
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runIDToken()
+		},
+	}
+
+	options.AddServiceAccountEmailFlag(cmd.Flags(), &idTokenCmdConfig.ServiceAccountEmail, true)
+	options.AddReasonFlag(cmd.Flags(), &idTokenCmdConfig.Reason, true)
+	options.AddProjectFlag(cmd.Flags(), &idTokenCmdConfig.Project)
+	options.AddDelegateFlag(cmd.Flags(), &idTokenCmdConfig.Delegates)
+	options.AddDurationFlag(cmd.Flags(), &idTokenCmdConfig.Duration)
+	cmd.Flags().StringVar(&idTokenAudience, "audience", "", "The audience of the ID token, e.g. the URL of a Cloud Run service or the client ID of an IAP-protected app")
+	cmd.Flags().BoolVar(&idTokenIncludeEmail, "include-email", false, "Include the service account's email in the token's claims")
+	cmd.Flags().StringVar(&idTokenProxyTarget, "proxy", "", "Start a local reverse proxy to this URL that adds an ID token to every request")
+	cmd.Flags().IntVar(&idTokenProxyPort, "port", 0, "The port that the reverse proxy listens on. Defaults to a free port")
+
+	return cmd
+}
+
+func runIDToken() error {
+	hasAccess, err := gcpclient.CanGenerateIDToken(
+		idTokenCmdConfig.Project,
+		idTokenCmdConfig.ServiceAccountEmail,
+		idTokenCmdConfig.Reason,
+		idTokenCmdConfig.Delegates...,
+	)
+	if err != nil {
+		return err
+	} else if !hasAccess {
+		util.Logger.Fatalln("You do not have access to generate ID tokens for this service account")
+	}
+
+	source := idtoken.NewSource(func() (string, error) {
+		util.Logger.Debugf("Generating ID token for %s with audience %s", idTokenCmdConfig.ServiceAccountEmail, idTokenAudience)
+		resp, err := gcpclient.GenerateIDToken(
+			idTokenCmdConfig.ServiceAccountEmail,
+			idTokenAudience,
+			idTokenCmdConfig.Reason,
+			idTokenIncludeEmail,
+			idTokenCmdConfig.Delegates...,
+		)
+		if err != nil {
+			return "", err
+		}
+		return resp.GetToken(), nil
+	})
+
+	if idTokenProxyTarget == "" {
+		token, err := source.Token()
+		if err != nil {
+			return errorsutil.EiamError{
+				Log: util.Logger.WithError(err),
+				Msg: "Failed to generate ID token",
+				Err: err,
+			}
+		}
+		fmt.Println(token)
+		return nil
+	}
+	return serveIDTokenProxy(source)
+}
+
+// serveIDTokenProxy runs a reverse proxy to the proxy target that adds ID
+// tokens to requests until the duration has elapsed or eiam is interrupted
+func serveIDTokenProxy(source *idtoken.Source) error {
+	// Generate the first token up front so that a missing permission fails
+	// before the proxy starts
+	if _, err := source.Token(); err != nil {
+		return errorsutil.EiamError{
+			Log: util.Logger.WithError(err),
+			Msg: "Failed to generate ID token",
+			Err: err,
+		}
+	}
+
+	target, _ := parseProxyTarget(idTokenProxyTarget)
+	address := net.JoinHostPort(viper.GetString("authproxy.proxyaddress"), strconv.Itoa(idTokenProxyPort))
+	l, err := net.Listen("tcp", address)
+	if err != nil {
+		return errorsutil.EiamError{
+			Log: util.Logger.WithError(err),
+			Msg: fmt.Sprintf("Failed to start the ID token proxy on %s", address),
+			Err: err,
+		}
+	}
+
+	lc := lifecycle.New()
+	lc.Start()
+	defer lc.Stop()
+	defer lc.Cleanup()
+
+	srv := &http.Server{Handler: idtoken.NewProxy(target, source)}
+	lc.OnCleanup("stop ID token proxy", func() error {
+		return srv.Shutdown(context.Background())
+	})
+	go func() {
+		if err := srv.Serve(l); err != http.ErrServerClosed {
+			util.Logger.WithError(err).Error("ID token proxy stopped unexpectedly")
+		}
+	}()
+
+	util.Logger.Infof("Proxying http://%s to %s as %s until %s", l.Addr(), target, idTokenCmdConfig.ServiceAccountEmail,
+		time.Now().Add(idTokenCmdConfig.Duration).Format(time.RFC1123))
+	select {
+	case <-lc.Done():
+		util.Logger.Infof("Received %s, stopping the ID token proxy", lc.Signal())
+	case <-time.After(idTokenCmdConfig.Duration):
+		util.Logger.Info("ID token proxy expired")
+	}
+	return nil
+}
+
+// parseProxyTarget ensures that the ID token proxy forwards requests to an
+// absolute HTTPS URL, so that tokens are never sent in plaintext
+func parseProxyTarget(target string) (*url.URL, error) {
+	u, err := url.Parse(target)
+	if err == nil && (u.Scheme != "https" || u.Host == "") {
+		err = fmt.Errorf("%q is not an https:// URL", target)
+	}
+	if err != nil {
+		return nil, errorsutil.EiamError{
+			Log: util.Logger.WithError(err),
+			Msg: "Invalid proxy URL",
+			Err: err,
+		}
+	}
+	return u, nil
+}
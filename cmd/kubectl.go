@@ -12,7 +12,6 @@ import (
 
 	util "github.com/jessesomerville/ephemeral-iam/internal/eiamutil"
 	errorsutil "github.com/jessesomerville/ephemeral-iam/internal/errors"
-	"github.com/jessesomerville/ephemeral-iam/internal/gcpclient"
 	"github.com/jessesomerville/ephemeral-iam/pkg/options"
 )
 
@@ -42,17 +41,20 @@ func newCmdKubectl() *cobra.Command {
 			cmd.Flags().VisitAll(options.CheckRequired)
 
 			kubectlCmdArgs = util.ExtractUnknownArgs(cmd.Flags(), os.Args)
+			kubectlCmdConfig.Reason = util.ReasonWithSubject(kubectlCmdConfig.Subject, kubectlCmdConfig.Reason)
 			if err := util.FormatReason(&kubectlCmdConfig.Reason); err != nil {
 				return err
 			}
+			scopes, err := resolveScopes(kubectlCmdConfig.Scopes, kubectlCmdConfig.ServiceAccountEmail)
+			if err != nil {
+				return err
+			}
+			kubectlCmdConfig.Scopes = scopes
 
 			if !options.YesOption {
-				util.Confirm(map[string]string{
-					"Project":         kubectlCmdConfig.Project,
-					"Service Account": kubectlCmdConfig.ServiceAccountEmail,
-					"Reason":          kubectlCmdConfig.Reason,
-					"Command":         fmt.Sprintf("kubectl %s", strings.Join(kubectlCmdArgs, " ")),
-				})
+				util.Confirm(confirmFields(&kubectlCmdConfig, map[string]string{
+					"Command": fmt.Sprintf("kubectl %s", strings.Join(kubectlCmdArgs, " ")),
+				}))
 			}
 			return nil
 		},
@@ -64,30 +66,21 @@ func newCmdKubectl() *cobra.Command {
 	options.AddServiceAccountEmailFlag(cmd.Flags(), &kubectlCmdConfig.ServiceAccountEmail, true)
 	options.AddReasonFlag(cmd.Flags(), &kubectlCmdConfig.Reason, true)
 	options.AddProjectFlag(cmd.Flags(), &kubectlCmdConfig.Project)
+	options.AddDelegateFlag(cmd.Flags(), &kubectlCmdConfig.Delegates)
+	options.AddScopesFlag(cmd.Flags(), &kubectlCmdConfig.Scopes)
+	options.AddSubjectFlag(cmd.Flags(), &kubectlCmdConfig.Subject)
 
 	return cmd
 }
 
 func runKubectlCommand() error {
-	hasAccess, err := gcpclient.CanImpersonate(
-		kubectlCmdConfig.Project,
-		kubectlCmdConfig.ServiceAccountEmail,
-		kubectlCmdConfig.Reason,
-	)
-	if err != nil {
-		return err
-	} else if !hasAccess {
-		util.Logger.Fatalln("You do not have access to impersonate this service account")
-	}
-
-	util.Logger.Infof("Fetching access token for %s", kubectlCmdConfig.ServiceAccountEmail)
-	accessToken, err := gcpclient.GenerateTemporaryAccessToken(kubectlCmdConfig.ServiceAccountEmail, kubectlCmdConfig.Reason)
+	accessToken, err := fetchAccessToken(&kubectlCmdConfig)
 	if err != nil {
 		return err
 	}
 
 	util.Logger.Infof("Running: [kubectl %s]\n\n", strings.Join(kubectlCmdArgs, " "))
-	kubectlAuth := append(kubectlCmdArgs, "--token", accessToken.GetAccessToken())
+	kubectlAuth := append(kubectlCmdArgs, "--token", accessToken)
 	c := exec.Command(viper.GetString("binarypaths.kubectl"), kubectlAuth...)
 	c.Stdout = os.Stdout
 	c.Stderr = os.Stderr
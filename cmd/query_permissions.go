@@ -15,7 +15,6 @@ import (
 	"github.com/jessesomerville/ephemeral-iam/internal/appconfig"
 	util "github.com/jessesomerville/ephemeral-iam/internal/eiamutil"
 	errorsutil "github.com/jessesomerville/ephemeral-iam/internal/errors"
-	"github.com/jessesomerville/ephemeral-iam/internal/gcpclient"
 	queryiam "github.com/jessesomerville/ephemeral-iam/internal/gcpclient/query_iam"
 	"github.com/jessesomerville/ephemeral-iam/pkg/options"
 )
@@ -145,7 +144,7 @@ func newCmdQueryComputeInstancePermissions() *cobra.Command {
 			if svcAcct := queryPermsCmdConfig.ServiceAccountEmail; svcAcct != "" {
 				return printPermissions(util.Uniq(testablePerms), userPerms, svcAcct)
 			} else {
-				userAcct, err := gcpclient.CheckActiveAccountSet()
+				userAcct, err := sourceAccount()
 				if err != nil {
 					return err
 				}
@@ -190,7 +189,7 @@ func newCmdQueryProjectPermissions() *cobra.Command {
 			if svcAcct := queryPermsCmdConfig.ServiceAccountEmail; svcAcct != "" {
 				return printPermissions(util.Uniq(testablePerms), userPerms, svcAcct)
 			} else {
-				userAcct, err := gcpclient.CheckActiveAccountSet()
+				userAcct, err := sourceAccount()
 				if err != nil {
 					return err
 				}
@@ -240,7 +239,7 @@ func newCmdQueryPubSubPermissions() *cobra.Command {
 			if svcAcct := queryPermsCmdConfig.ServiceAccountEmail; svcAcct != "" {
 				return printPermissions(util.Uniq(testablePerms), userPerms, svcAcct)
 			} else {
-				userAcct, err := gcpclient.CheckActiveAccountSet()
+				userAcct, err := sourceAccount()
 				if err != nil {
 					return err
 				}
@@ -287,7 +286,7 @@ func newCmdQueryServiceAccountPermissions() *cobra.Command {
 			if svcAcct := queryPermsCmdConfig.ServiceAccountEmail; svcAcct != "" {
 				return printPermissions(util.Uniq(testablePerms), userPerms, svcAcct)
 			} else {
-				userAcct, err := gcpclient.CheckActiveAccountSet()
+				userAcct, err := sourceAccount()
 				if err != nil {
 					return err
 				}
@@ -335,7 +334,7 @@ func newCmdQueryStorageBucketPermissions() *cobra.Command {
 			if svcAcct := queryPermsCmdConfig.ServiceAccountEmail; svcAcct != "" {
 				return printPermissions(util.Uniq(testablePerms), userPerms, svcAcct)
 			} else {
-				userAcct, err := gcpclient.CheckActiveAccountSet()
+				userAcct, err := sourceAccount()
 				if err != nil {
 					return err
 				}
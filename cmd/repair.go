@@ -0,0 +1,74 @@
+package cmd
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/lithammer/dedent"
+	"github.com/spf13/cobra"
+
+	"github.com/jessesomerville/ephemeral-iam/internal/appconfig"
+	util "github.com/jessesomerville/ephemeral-iam/internal/eiamutil"
+	errorsutil "github.com/jessesomerville/ephemeral-iam/internal/errors"
+	"github.com/jessesomerville/ephemeral-iam/internal/gcpclient"
+	"github.com/jessesomerville/ephemeral-iam/internal/session"
+)
+
+func newCmdRepair() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "repair",
+		Short: "Clean up after privileged sessions that were not shut down properly",
+		Long: dedent.Dedent(`
+			The "repair" command cleans up the state left behind by privileged sessions that were
+			killed or crashed before they could shut down. This includes each session's copy of the
+			gcloud config and its temporary kubeconfig, which both contain credentials.
+			
+			It also removes auth proxy settings that older versions of eiam wrote to your active
+			gcloud config. A backup of the gcloud config is written to the 'gcloud_config_backups'
+			directory of your eiam configuration folder before it is changed.
+			
+			This runs automatically every time eiam is started, so it only needs to be run manually
+			to see what was cleaned up.`),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			repaired, err := repairState()
+			if err != nil {
+				return err
+			}
+			if !repaired {
+				util.Logger.Info("Nothing to repair")
+			}
+			return nil
+		},
+	}
+	return cmd
+}
+
+// repairState removes the state of privileged sessions that are no longer
+// running and reverts the auth proxy settings that they left in the gcloud
+// config. It reports whether anything was repaired.
+func repairState() (bool, error) {
+	removed, err := session.RemoveStale()
+	for _, id := range removed {
+		util.Logger.Warnf("Cleaned up privileged session %s which was not shut down properly", id)
+	}
+	if err != nil {
+		return len(removed) > 0, err
+	}
+
+	// The gcloud config of a privileged sub-shell is the running session's,
+	// not one left behind by a session that crashed
+	if os.Getenv(session.EnvSessionID) != "" {
+		return len(removed) > 0, nil
+	}
+
+	backupDir := filepath.Join(appconfig.GetConfigDir(), "gcloud_config_backups")
+	reverted, err := gcpclient.RevertStaleGcloudProxy(backupDir, session.Dir())
+	if err != nil {
+		errorsutil.CheckRevertGcloudConfigError(err)
+		return len(removed) > 0, err
+	}
+	if reverted {
+		util.Logger.Warn("Removed auth proxy settings left in your gcloud config by a privileged session that was not shut down properly")
+	}
+	return len(removed) > 0 || reverted, nil
+}
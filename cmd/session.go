@@ -0,0 +1,316 @@
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/lithammer/dedent"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+
+	util "github.com/jessesomerville/ephemeral-iam/internal/eiamutil"
+	errorsutil "github.com/jessesomerville/ephemeral-iam/internal/errors"
+	"github.com/jessesomerville/ephemeral-iam/internal/recording"
+	"github.com/jessesomerville/ephemeral-iam/internal/session"
+	"github.com/jessesomerville/ephemeral-iam/pkg/options"
+)
+
+var sessionCmdConfig options.CmdConfig
+
+func newCmdSession() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "session",
+		Short: "Manage running privileged sessions",
+		Long: dedent.Dedent(`
+			The "session" command interacts with privileged sessions started by the "assume-privileges"
+			command. Each running session listens on a control socket in the 'sessions' directory of
+			your eiam configuration folder.
+			
+			When run inside of a privileged sub-shell, the commands act on the session that the sub-shell
+			belongs to. Otherwise, the session to use is set with the --session-id flag, which can be
+			omitted if only one session is running.`),
+	}
+
+	cmd.AddCommand(newCmdSessionExtend())
+	cmd.AddCommand(newCmdSessionList())
+	cmd.AddCommand(newCmdSessionReplay())
+	cmd.AddCommand(newCmdSessionStatus())
+	cmd.AddCommand(newCmdSessionStop())
+	cmd.AddCommand(newCmdSessionWhoami())
+
+	return cmd
+}
+
+func newCmdSessionExtend() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "extend",
+		Short: "Extend the length of a running privileged session",
+		Long: dedent.Dedent(`
+			The "session extend" command pushes back the expiration of a running privileged session.
+			Before the session is extended, eiam checks that you are still able to impersonate the
+			service account. The provided reason replaces the session's previous reason for the
+			remainder of the session.`),
+		Example: dedent.Dedent(`
+				eiam session extend --reason "Still patching (JIRA-1234)"
+				
+				eiam session extend --session-id 0123456789abcdef \
+				  --reason "Still patching (JIRA-1234)" \
+				  --duration 30m`),
+		PreRunE: func(cmd *cobra.Command, args []string) error {
+			cmd.Flags().VisitAll(options.CheckRequired)
+
+			if err := checkSessionDuration(sessionCmdConfig.Duration); err != nil {
+				return err
+			}
+
+			sessionID, err := session.ResolveID(sessionCmdConfig.SessionID)
+			if err != nil {
+				return err
+			}
+			sessionCmdConfig.SessionID = sessionID
+
+			if !options.YesOption {
+				util.Confirm(map[string]string{
+					"Session":  sessionCmdConfig.SessionID,
+					"Reason":   sessionCmdConfig.Reason,
+					"Duration": sessionCmdConfig.Duration.String(),
+				})
+			}
+			return nil
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			end, err := session.Extend(sessionCmdConfig.SessionID, sessionCmdConfig.Reason, sessionCmdConfig.Duration)
+			if err != nil {
+				return err
+			}
+			util.Logger.Infof("Privileged session %s extended until %s", sessionCmdConfig.SessionID, end.Format(time.RFC1123))
+			return nil
+		},
+	}
+
+	options.AddSessionIDFlag(cmd.Flags(), &sessionCmdConfig.SessionID)
+	options.AddReasonFlag(cmd.Flags(), &sessionCmdConfig.Reason, true)
+	cmd.Flags().DurationVarP(
+		&sessionCmdConfig.Duration,
+		options.DurationFlag.Name,
+		options.DurationFlag.Shorthand,
+		viper.GetDuration("session.defaultduration"),
+		"How long to extend the privileged session by",
+	)
+
+	return cmd
+}
+
+func newCmdSessionList() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:     "list",
+		Aliases: []string{"ls"},
+		Short:   "List running privileged sessions",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			sessions, err := session.List()
+			if err != nil {
+				return err
+			}
+			if len(sessions) == 0 {
+				util.Logger.Warn("No privileged sessions are currently running")
+				return nil
+			}
+
+			var buf bytes.Buffer
+			w := tabwriter.NewWriter(&buf, 0, 4, 4, ' ', 0)
+			fmt.Fprintln(w, "\nID\tSERVICE ACCOUNT\tPROJECT\tREMAINING\tREQUESTS")
+			for _, s := range sessions {
+				fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\n", s.ID, s.ServiceAccount, s.Project, s.Remaining().Round(time.Second), s.Requests)
+			}
+			fmt.Fprintln(w)
+			w.Flush()
+
+			fmt.Println(buf.String())
+			return nil
+		},
+	}
+	return cmd
+}
+
+func newCmdSessionReplay() *cobra.Command {
+	var (
+		speed     float64
+		idleLimit time.Duration
+	)
+
+	cmd := &cobra.Command{
+		Use:   "replay SESSION_ID",
+		Short: "Play back the recording of a privileged session",
+		Long: dedent.Dedent(`
+			The "session replay" command plays back the recording of a privileged sub-shell that was
+			started with the --record flag. Recordings are stored in the auth proxy's log directory as
+			asciicast v2 files, so they can also be played with asciinema.`),
+		Example: dedent.Dedent(`
+				eiam session replay 0123456789abcdef
+				
+				eiam session replay 0123456789abcdef --speed 2 --idle-limit 1s`),
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			recordingPath, err := session.FindRecording(args[0])
+			if err != nil {
+				return err
+			}
+			f, err := os.Open(recordingPath)
+			if err != nil {
+				return errorsutil.EiamError{
+					Log: util.Logger.WithError(err),
+					Msg: "Failed to open session recording",
+					Err: err,
+				}
+			}
+			defer f.Close()
+
+			util.Logger.Infof("Replaying %s", recordingPath)
+			if err := recording.Replay(f, os.Stdout, speed, idleLimit); err != nil {
+				return errorsutil.EiamError{
+					Log: util.Logger.WithError(err),
+					Msg: "Failed to replay session recording",
+					Err: err,
+				}
+			}
+			fmt.Println()
+			return nil
+		},
+	}
+
+	cmd.Flags().Float64Var(&speed, "speed", 1, "The playback speed, e.g. 2 plays the recording twice as fast")
+	cmd.Flags().DurationVar(&idleLimit, "idle-limit", 2*time.Second, "The longest pause between outputs. Set to 0 to keep the original pauses")
+
+	return cmd
+}
+
+func newCmdSessionStatus() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "status",
+		Short: "Show the details of a running privileged session",
+		PreRunE: func(cmd *cobra.Command, args []string) error {
+			sessionID, err := session.ResolveID(sessionCmdConfig.SessionID)
+			if err != nil {
+				return err
+			}
+			sessionCmdConfig.SessionID = sessionID
+			return nil
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			info, err := session.Status(sessionCmdConfig.SessionID)
+			if err != nil {
+				return err
+			}
+
+			var buf bytes.Buffer
+			w := tabwriter.NewWriter(&buf, 0, 4, 4, ' ', 0)
+			fmt.Fprintln(w)
+			fmt.Fprintf(w, "ID\t%s\n", info.ID)
+			fmt.Fprintf(w, "Service Account\t%s\n", info.ServiceAccount)
+			if len(info.Delegates) > 0 {
+				fmt.Fprintf(w, "Delegates\t%s\n", strings.Join(info.Delegates, " -> "))
+			}
+			if len(info.Scopes) > 0 {
+				fmt.Fprintf(w, "Scopes\t%s\n", strings.Join(info.Scopes, ", "))
+			}
+			if info.Subject != "" {
+				fmt.Fprintf(w, "Subject\t%s\n", info.Subject)
+			}
+			fmt.Fprintf(w, "Project\t%s\n", info.Project)
+			fmt.Fprintf(w, "Reason\t%s\n", info.Reason)
+			fmt.Fprintf(w, "Started\t%s\n", info.Start.Format(time.RFC1123))
+			fmt.Fprintf(w, "Expires\t%s\n", info.End.Format(time.RFC1123))
+			fmt.Fprintf(w, "Remaining\t%s\n", info.Remaining().Round(time.Second))
+			fmt.Fprintf(w, "Requests\t%d\n", info.Requests)
+			fmt.Fprintf(w, "PID\t%d\n", info.PID)
+			fmt.Fprintf(w, "Read-Only\t%t\n", info.ReadOnly)
+			fmt.Fprintf(w, "Proxy Address\t%s\n", info.ProxyAddress)
+			fmt.Fprintf(w, "Gcloud Config\t%s\n", info.GcloudConfig)
+			fmt.Fprintf(w, "Kubeconfig\t%s\n", info.KubeConfig)
+			if info.MetadataAddress != "" {
+				fmt.Fprintf(w, "Metadata Server\t%s\n", info.MetadataAddress)
+			}
+			if info.CredentialsFile != "" {
+				fmt.Fprintf(w, "Credentials File\t%s\n", info.CredentialsFile)
+			}
+			if info.Recording != "" {
+				fmt.Fprintf(w, "Recording\t%s\n", info.Recording)
+			}
+			w.Flush()
+
+			fmt.Println(buf.String())
+			return nil
+		},
+	}
+
+	options.AddSessionIDFlag(cmd.Flags(), &sessionCmdConfig.SessionID)
+
+	return cmd
+}
+
+func newCmdSessionStop() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "stop",
+		Short: "Stop a running privileged session",
+		Long: dedent.Dedent(`
+			The "session stop" command ends a running privileged session before it expires. The auth
+			proxy is shut down, the session's copy of the gcloud config is removed, and the privileged
+			sub-shell is closed.`),
+		PreRunE: func(cmd *cobra.Command, args []string) error {
+			sessionID, err := session.ResolveID(sessionCmdConfig.SessionID)
+			if err != nil {
+				return err
+			}
+			sessionCmdConfig.SessionID = sessionID
+
+			if !options.YesOption {
+				util.Confirm(map[string]string{
+					"Session": sessionCmdConfig.SessionID,
+				})
+			}
+			return nil
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := session.Stop(sessionCmdConfig.SessionID); err != nil {
+				return err
+			}
+			util.Logger.Infof("Stopped privileged session %s", sessionCmdConfig.SessionID)
+			return nil
+		},
+	}
+
+	options.AddSessionIDFlag(cmd.Flags(), &sessionCmdConfig.SessionID)
+
+	return cmd
+}
+
+func newCmdSessionWhoami() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "whoami",
+		Short: "Print the service account that a privileged session is impersonating",
+		PreRunE: func(cmd *cobra.Command, args []string) error {
+			sessionID, err := session.ResolveID(sessionCmdConfig.SessionID)
+			if err != nil {
+				return err
+			}
+			sessionCmdConfig.SessionID = sessionID
+			return nil
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			info, err := session.Status(sessionCmdConfig.SessionID)
+			if err != nil {
+				return err
+			}
+			fmt.Println(info.ServiceAccount)
+			return nil
+		},
+	}
+
+	options.AddSessionIDFlag(cmd.Flags(), &sessionCmdConfig.SessionID)
+
+	return cmd
+}
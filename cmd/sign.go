@@ -0,0 +1,246 @@
+package cmd
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/lithammer/dedent"
+	"github.com/spf13/cobra"
+	"golang.org/x/term"
+
+	util "github.com/jessesomerville/ephemeral-iam/internal/eiamutil"
+	errorsutil "github.com/jessesomerville/ephemeral-iam/internal/errors"
+	"github.com/jessesomerville/ephemeral-iam/internal/gcpclient"
+	"github.com/jessesomerville/ephemeral-iam/pkg/options"
+)
+
+var (
+	signJwtCmdConfig  options.CmdConfig
+	signBlobCmdConfig options.CmdConfig
+	signInput         []byte
+	signBlobEncoding  string
+)
+
+// signBlobEncodings are the formats that a blob's signature can be written in
+var signBlobEncodings = []string{"base64", "hex", "raw"}
+
+func newCmdSignJwt() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "sign-jwt [FILE]",
+		Short: "Sign a JWT with the provided service account's key",
+		Long: dedent.Dedent(`
+			The "sign-jwt" command signs a JWT using a Google-managed key of the provided service account,
+			without downloading a key. The JWT's claims are read as a JSON object from the provided file,
+			or from stdin if no file or "-" is provided, and the signed JWT is written to stdout.
+			
+			The claims must include an "exp" claim that is at most 12 hours in the future. When the claims
+			are read from stdin, the --yes flag is required since stdin cannot also be used to confirm the
+			command.`),
+		Example: dedent.Dedent(`
+			echo '{"iss": "example@my-project.iam.gserviceaccount.com", "aud": "https://example.com", "exp": 1700000000}' \
+			  | eiam sign-jwt -y \
+			      --service-account-email example@my-project.iam.gserviceaccount.com \
+			      --reason "Testing service-to-service auth (JIRA-1234)"
+			
+			eiam sign-jwt claims.json \
+			  -s example@my-project.iam.gserviceaccount.com -R "JIRA-1234" > token.jwt`),
+		Args: cobra.MaximumNArgs(1),
+		PreRunE: func(cmd *cobra.Command, args []string) error {
+			if err := prepareSign(cmd, args, &signJwtCmdConfig); err != nil {
+				return err
+			}
+			var claims map[string]interface{}
+			if err := json.Unmarshal(signInput, &claims); err != nil {
+				err := fmt.Errorf("the JWT claims must be a JSON object: %v", err)
+				return errorsutil.EiamError{
+					Log: util.Logger.WithError(err),
+					Msg: "Invalid JWT claims",
+					Err: err,
+				}
+			}
+			return nil
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			hasAccess, err := gcpclient.CanSignJwt(
+				signJwtCmdConfig.Project,
+				signJwtCmdConfig.ServiceAccountEmail,
+				signJwtCmdConfig.Reason,
+				signJwtCmdConfig.Delegates...,
+			)
+			if err != nil {
+				return err
+			} else if !hasAccess {
+				util.Logger.Fatalln("You do not have access to sign JWTs with this service account")
+			}
+
+			resp, err := gcpclient.SignJwt(signJwtCmdConfig.ServiceAccountEmail, string(signInput), signJwtCmdConfig.Reason, signJwtCmdConfig.Delegates...)
+			if err != nil {
+				return errorsutil.EiamError{
+					Log: util.Logger.WithError(err),
+					Msg: "Failed to sign JWT",
+					Err: err,
+				}
+			}
+			util.Logger.Infof("Signed JWT with key %s", resp.GetKeyId())
+			fmt.Println(resp.GetSignedJwt())
+			return nil
+		},
+	}
+
+	addSignFlags(cmd, &signJwtCmdConfig)
+
+	return cmd
+}
+
+func newCmdSignBlob() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "sign-blob [FILE]",
+		Short: "Sign a blob with the provided service account's key",
+		Long: dedent.Dedent(`
+			The "sign-blob" command signs the contents of the provided file, or stdin if no file or "-" is
+			provided, using a Google-managed key of the provided service account, without downloading a
+			key. The signature is written to stdout. This can be used to generate signed URLs for Cloud
+			Storage.
+			
+			The encoding flag sets the format of the signature: base64 (the default), hex, or raw bytes.
+			When the blob is read from stdin, the --yes flag is required since stdin cannot also be used
+			to confirm the command.`),
+		Example: dedent.Dedent(`
+			printf '%s' "$STRING_TO_SIGN" | eiam sign-blob -y --encoding hex \
+			  --service-account-email signer@my-project.iam.gserviceaccount.com \
+			  --reason "Share build artifact (JIRA-1234)"
+			
+			eiam sign-blob manifest.json --encoding raw \
+			  -s signer@my-project.iam.gserviceaccount.com -R "JIRA-1234" > manifest.sig`),
+		Args: cobra.MaximumNArgs(1),
+		PreRunE: func(cmd *cobra.Command, args []string) error {
+			if !util.Contains(signBlobEncodings, signBlobEncoding) {
+				err := fmt.Errorf("the encoding must be one of %v", signBlobEncodings)
+				return errorsutil.EiamError{
+					Log: util.Logger.WithError(err),
+					Msg: "Invalid command arguments",
+					Err: err,
+				}
+			}
+			return prepareSign(cmd, args, &signBlobCmdConfig)
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			hasAccess, err := gcpclient.CanSignBlob(
+				signBlobCmdConfig.Project,
+				signBlobCmdConfig.ServiceAccountEmail,
+				signBlobCmdConfig.Reason,
+				signBlobCmdConfig.Delegates...,
+			)
+			if err != nil {
+				return err
+			} else if !hasAccess {
+				util.Logger.Fatalln("You do not have access to sign blobs with this service account")
+			}
+
+			resp, err := gcpclient.SignBlob(signBlobCmdConfig.ServiceAccountEmail, signInput, signBlobCmdConfig.Reason, signBlobCmdConfig.Delegates...)
+			if err != nil {
+				return errorsutil.EiamError{
+					Log: util.Logger.WithError(err),
+					Msg: "Failed to sign blob",
+					Err: err,
+				}
+			}
+			util.Logger.Infof("Signed blob with key %s", resp.GetKeyId())
+
+			os.Stdout.Write(encodeSignature(resp.GetSignedBlob(), signBlobEncoding))
+			return nil
+		},
+	}
+
+	addSignFlags(cmd, &signBlobCmdConfig)
+	cmd.Flags().StringVar(&signBlobEncoding, "encoding", "base64", "The format to write the signature in. Can be 'base64', 'hex', or 'raw'")
+
+	return cmd
+}
+
+// addSignFlags adds the flags that are shared by the sign commands
+func addSignFlags(cmd *cobra.Command, cfg *options.CmdConfig) {
+	options.AddServiceAccountEmailFlag(cmd.Flags(), &cfg.ServiceAccountEmail, true)
+	options.AddReasonFlag(cmd.Flags(), &cfg.Reason, true)
+	options.AddProjectFlag(cmd.Flags(), &cfg.Project)
+	options.AddDelegateFlag(cmd.Flags(), &cfg.Delegates)
+}
+
+// prepareSign reads the input of a sign command and confirms the command with
+// the user. The confirmation is written to stderr, since the signature is
+// written to stdout.
+func prepareSign(cmd *cobra.Command, args []string, cfg *options.CmdConfig) error {
+	cmd.Flags().VisitAll(options.CheckRequired)
+
+	input, data, err := readSignInput(args, os.Stdin, term.IsTerminal(int(os.Stdin.Fd())))
+	if err != nil {
+		return err
+	}
+	signInput = data
+
+	if err := util.FormatReason(&cfg.Reason); err != nil {
+		return err
+	}
+
+	if !options.YesOption {
+		util.ConfirmTo(os.Stderr, confirmFields(cfg, map[string]string{
+			"Input": fmt.Sprintf("%s (%d bytes)", input, len(signInput)),
+		}))
+	}
+	return nil
+}
+
+// readSignInput reads the input of a sign command from the file in args, or
+// from stdin if no file or "-" is provided. It returns the name of the input
+// along with its contents.
+func readSignInput(args []string, stdin io.Reader, stdinIsTerminal bool) (string, []byte, error) {
+	input := "stdin"
+	if len(args) == 1 && args[0] != "-" {
+		input = args[0]
+	}
+
+	var data []byte
+	var err error
+	if input == "stdin" {
+		// The confirmation prompt reads from stdin, so it can't be used when
+		// the input is piped in
+		if !options.YesOption && !stdinIsTerminal {
+			err := errors.New("the --yes flag is required when the input is read from stdin")
+			return "", nil, errorsutil.EiamError{
+				Log: util.Logger.WithError(err),
+				Msg: "Invalid command arguments",
+				Err: err,
+			}
+		}
+		data, err = ioutil.ReadAll(stdin)
+	} else {
+		data, err = ioutil.ReadFile(input)
+	}
+	if err != nil {
+		return "", nil, errorsutil.EiamError{
+			Log: util.Logger.WithError(err),
+			Msg: fmt.Sprintf("Failed to read input from %s", input),
+			Err: err,
+		}
+	}
+	return input, data, nil
+}
+
+// encodeSignature returns a blob's signature in the given encoding, followed
+// by a newline unless it is written as raw bytes
+func encodeSignature(signature []byte, encoding string) []byte {
+	switch encoding {
+	case "hex":
+		return []byte(hex.EncodeToString(signature) + "\n")
+	case "raw":
+		return signature
+	default:
+		return []byte(base64.StdEncoding.EncodeToString(signature) + "\n")
+	}
+}
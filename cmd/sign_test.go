@@ -0,0 +1,79 @@
+package cmd
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/jessesomerville/ephemeral-iam/pkg/options"
+)
+
+func TestReadSignInput(t *testing.T) {
+	dir, err := ioutil.TempDir("", "eiam-sign")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	claimsFile := filepath.Join(dir, "claims.json")
+	if err := ioutil.WriteFile(claimsFile, []byte(`{"from": "file"}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	defer func(yes bool) { options.YesOption = yes }(options.YesOption)
+
+	tests := []struct {
+		name       string
+		args       []string
+		yes        bool
+		isTerminal bool
+		wantInput  string
+		wantData   string
+		wantErr    bool
+	}{
+		{"file", []string{claimsFile}, false, false, claimsFile, `{"from": "file"}`, false},
+		{"missing file", []string{filepath.Join(dir, "missing.json")}, true, true, "", "", true},
+		{"piped stdin with yes", nil, true, false, "stdin", `{"from": "stdin"}`, false},
+		{"dash with yes", []string{"-"}, true, false, "stdin", `{"from": "stdin"}`, false},
+		{"piped stdin without yes", nil, false, false, "", "", true},
+		{"dash without yes", []string{"-"}, false, false, "", "", true},
+		{"terminal stdin without yes", nil, false, true, "stdin", `{"from": "stdin"}`, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			options.YesOption = tt.yes
+			input, data, err := readSignInput(tt.args, strings.NewReader(`{"from": "stdin"}`), tt.isTerminal)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("readSignInput(%v) read %q from %s, want an error", tt.args, data, input)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("readSignInput(%v) = %v", tt.args, err)
+			}
+			if input != tt.wantInput || string(data) != tt.wantData {
+				t.Errorf("readSignInput(%v) = %s, %q, want %s, %q", tt.args, input, data, tt.wantInput, tt.wantData)
+			}
+		})
+	}
+}
+
+func TestEncodeSignature(t *testing.T) {
+	signature := []byte{0xde, 0xad, 0xbe, 0xef, 0x00, 0x0a}
+	tests := []struct {
+		encoding string
+		want     string
+	}{
+		{"base64", "3q2+7wAK\n"},
+		{"hex", "deadbeef000a\n"},
+		{"raw", "\xde\xad\xbe\xef\x00\x0a"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.encoding, func(t *testing.T) {
+			if got := string(encodeSignature(signature, tt.encoding)); got != tt.want {
+				t.Errorf("encodeSignature(%s) = %q, want %q", tt.encoding, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,326 @@
+// Package agent implements a long-running token broker, similar to ssh-agent,
+// that caches service account access tokens and serves them to other eiam
+// commands over a Unix socket. Only the user that started the agent is able to
+// connect to the socket.
+package agent
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// EnvSocket is the environment variable that holds the path to the agent's
+// socket. Wrapper commands get their access tokens from the agent if it is set.
+const EnvSocket = "EIAM_AGENT_SOCK"
+
+var (
+	// refreshMargin is how long before a cached token expires that a new one
+	// is generated
+	refreshMargin = time.Minute
+	// refreshInterval is how often cached tokens are checked for expiry
+	refreshInterval = 10 * time.Second
+)
+
+// TokenRequest asks the agent for an access token
+type TokenRequest struct {
+	ServiceAccount string   `json:"serviceAccount"`
+	Project        string   `json:"project"`
+	Delegates      []string `json:"delegates,omitempty"`
+	Scopes         []string `json:"scopes,omitempty"`
+	Subject        string   `json:"subject,omitempty"`
+	Reason         string   `json:"reason"`
+}
+
+// key identifies the cached token that satisfies the request
+func (r TokenRequest) key() string {
+	scopes := append([]string{}, r.Scopes...)
+	sort.Strings(scopes)
+	return strings.Join([]string{
+		strings.ToLower(r.ServiceAccount),
+		strings.Join(r.Delegates, ","),
+		strings.Join(scopes, " "),
+		strings.ToLower(r.Subject),
+	}, "|")
+}
+
+// TokenResponse is the agent's response to a TokenRequest
+type TokenResponse struct {
+	AccessToken string    `json:"accessToken"`
+	Expiry      time.Time `json:"expiry"`
+}
+
+// TokenInfo describes a cached token without revealing it
+type TokenInfo struct {
+	ServiceAccount string    `json:"serviceAccount"`
+	Delegates      []string  `json:"delegates,omitempty"`
+	Scopes         []string  `json:"scopes,omitempty"`
+	Subject        string    `json:"subject,omitempty"`
+	Expiry         time.Time `json:"expiry"`
+	LastUsed       time.Time `json:"lastUsed"`
+	Requests       int       `json:"requests"`
+}
+
+// ErrorResponse is returned by the agent when a request fails
+type ErrorResponse struct {
+	Error string `json:"error"`
+}
+
+// GenerateFunc generates a new access token for the request
+type GenerateFunc func(req TokenRequest) (string, time.Time, error)
+
+// CheckFunc checks if the user is allowed to impersonate the service account
+// in the request
+type CheckFunc func(req TokenRequest) (bool, error)
+
+// Server caches access tokens and refreshes them before they expire. Tokens
+// that have not been requested for IdleTimeout are dropped.
+type Server struct {
+	Generate       GenerateFunc
+	CanImpersonate CheckFunc
+	IdleTimeout    time.Duration
+	Log            logrus.FieldLogger
+
+	mu      sync.Mutex
+	entries map[string]*entry
+}
+
+// entry is a cached access token
+type entry struct {
+	mu sync.Mutex
+	// req is the most recent request for the token. Its reason is attached to
+	// the requests that refresh the token.
+	req      TokenRequest
+	token    string
+	expiry   time.Time
+	lastUsed time.Time
+	requests int
+}
+
+// Token returns a cached access token for the request, generating one if there
+// is no valid token in the cache. Access to the service account is checked the
+// first time that a token is requested for it.
+func (s *Server) Token(req TokenRequest) (*TokenResponse, error) {
+	if req.ServiceAccount == "" {
+		return nil, errors.New("a service account is required")
+	}
+	if req.Reason == "" {
+		return nil, errors.New("a reason is required")
+	}
+
+	key := req.key()
+	s.mu.Lock()
+	if s.entries == nil {
+		s.entries = make(map[string]*entry)
+	}
+	e, ok := s.entries[key]
+	if !ok {
+		e = &entry{}
+		s.entries[key] = e
+	}
+	s.mu.Unlock()
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.token == "" {
+		hasAccess, err := s.CanImpersonate(req)
+		if err != nil {
+			s.remove(key, e)
+			return nil, fmt.Errorf("failed to check access to %s: %v", req.ServiceAccount, err)
+		} else if !hasAccess {
+			s.remove(key, e)
+			return nil, fmt.Errorf("you do not have access to impersonate %s", req.ServiceAccount)
+		}
+	}
+
+	e.req = req
+	e.lastUsed = time.Now()
+	e.requests++
+	if e.token == "" || time.Now().Add(refreshMargin).After(e.expiry) {
+		if err := s.generate(e); err != nil {
+			if e.token == "" {
+				s.remove(key, e)
+			}
+			return nil, err
+		}
+	}
+	s.Log.WithField("reason", req.Reason).Infof("Served access token for %s", req.ServiceAccount)
+	return &TokenResponse{AccessToken: e.token, Expiry: e.expiry}, nil
+}
+
+// generate replaces the entry's token. The entry must be locked.
+func (s *Server) generate(e *entry) error {
+	token, expiry, err := s.Generate(e.req)
+	if err != nil {
+		return fmt.Errorf("failed to generate access token for %s: %v", e.req.ServiceAccount, err)
+	}
+	e.token, e.expiry = token, expiry
+	return nil
+}
+
+// remove deletes an entry from the cache if it has not been replaced
+func (s *Server) remove(key string, e *entry) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.entries[key] == e {
+		delete(s.entries, key)
+	}
+}
+
+// Tokens describes the cached tokens
+func (s *Server) Tokens() []TokenInfo {
+	s.mu.Lock()
+	entries := make([]*entry, 0, len(s.entries))
+	for _, e := range s.entries {
+		entries = append(entries, e)
+	}
+	s.mu.Unlock()
+
+	infos := []TokenInfo{}
+	for _, e := range entries {
+		e.mu.Lock()
+		if e.token != "" {
+			infos = append(infos, TokenInfo{
+				ServiceAccount: e.req.ServiceAccount,
+				Delegates:      e.req.Delegates,
+				Scopes:         e.req.Scopes,
+				Subject:        e.req.Subject,
+				Expiry:         e.expiry,
+				LastUsed:       e.lastUsed,
+				Requests:       e.requests,
+			})
+		}
+		e.mu.Unlock()
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].ServiceAccount < infos[j].ServiceAccount
+	})
+	return infos
+}
+
+// Refresh drops the tokens that have been idle for longer than IdleTimeout and
+// generates new tokens for the ones that are about to expire
+func (s *Server) Refresh() {
+	s.mu.Lock()
+	entries := make(map[string]*entry, len(s.entries))
+	for key, e := range s.entries {
+		entries[key] = e
+	}
+	s.mu.Unlock()
+
+	for key, e := range entries {
+		e.mu.Lock()
+		switch {
+		case e.token == "":
+			// The first token is still being generated
+		case time.Since(e.lastUsed) > s.IdleTimeout:
+			s.Log.Infof("Dropping idle access token for %s", e.req.ServiceAccount)
+			s.remove(key, e)
+		case time.Now().Add(refreshMargin).After(e.expiry):
+			s.Log.Debugf("Refreshing access token for %s", e.req.ServiceAccount)
+			if err := s.generate(e); err != nil {
+				s.Log.WithError(err).Error("failed to refresh access token")
+			}
+		}
+		e.mu.Unlock()
+	}
+}
+
+// Serve answers requests on the listener and refreshes cached tokens until the
+// listener is closed
+func (s *Server) Serve(l net.Listener) error {
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		ticker := time.NewTicker(refreshInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				s.Refresh()
+			}
+		}
+	}()
+
+	srv := &http.Server{Handler: s.handler()}
+	return srv.Serve(l)
+}
+
+func (s *Server) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s is not allowed", r.Method))
+			return
+		}
+		var req TokenRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("failed to decode request: %v", err))
+			return
+		}
+		resp, err := s.Token(req)
+		if err != nil {
+			writeError(w, http.StatusForbidden, err)
+			return
+		}
+		writeResponse(w, resp)
+	})
+	mux.HandleFunc("/tokens", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s is not allowed", r.Method))
+			return
+		}
+		writeResponse(w, s.Tokens())
+	})
+	return mux
+}
+
+// Listen creates the agent's socket. Only the current user is able to connect
+// to it. A socket that was left behind by an agent that is no longer running is
+// replaced.
+func Listen(socketPath string) (net.Listener, error) {
+	if conn, err := net.Dial("unix", socketPath); err == nil {
+		conn.Close()
+		return nil, fmt.Errorf("an agent is already listening on %s", socketPath)
+	}
+	if err := os.Remove(socketPath); err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to remove stale socket %s: %v", socketPath, err)
+	}
+
+	// Create the socket without group or other permissions so that there is
+	// no window in which another user can connect to it
+	oldMask := syscall.Umask(0o177)
+	l, err := net.Listen("unix", socketPath)
+	syscall.Umask(oldMask)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create socket %s: %v", socketPath, err)
+	}
+	if err := os.Chmod(socketPath, 0o600); err != nil {
+		l.Close()
+		return nil, fmt.Errorf("failed to update the file permissions for %s: %v", socketPath, err)
+	}
+	return l, nil
+}
+
+func writeResponse(w http.ResponseWriter, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(body)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(ErrorResponse{Error: err.Error()})
+}
@@ -0,0 +1,196 @@
+package agent
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const testServiceAccount = "example@my-project.iam.gserviceaccount.com"
+
+// fakeIAM counts the access checks and tokens generated for the test server
+type fakeIAM struct {
+	mu        sync.Mutex
+	checks    int
+	generated int
+	allowed   bool
+	lifetime  time.Duration
+	reasons   []string
+}
+
+func (f *fakeIAM) server() *Server {
+	log := logrus.New()
+	log.Out = ioutil.Discard
+	return &Server{
+		Generate: func(req TokenRequest) (string, time.Time, error) {
+			f.mu.Lock()
+			defer f.mu.Unlock()
+			f.generated++
+			f.reasons = append(f.reasons, req.Reason)
+			return fmt.Sprintf("token-%d", f.generated), time.Now().Add(f.lifetime), nil
+		},
+		CanImpersonate: func(req TokenRequest) (bool, error) {
+			f.mu.Lock()
+			defer f.mu.Unlock()
+			f.checks++
+			return f.allowed, nil
+		},
+		IdleTimeout: time.Hour,
+		Log:         log,
+	}
+}
+
+func TestTokenIsCached(t *testing.T) {
+	iam := &fakeIAM{allowed: true, lifetime: 10 * time.Minute}
+	s := iam.server()
+
+	req := TokenRequest{ServiceAccount: testServiceAccount, Scopes: []string{"b", "a"}, Reason: "first"}
+	for i := 0; i < 3; i++ {
+		resp, err := s.Token(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.AccessToken != "token-1" {
+			t.Errorf("got %s, want the cached token-1", resp.AccessToken)
+		}
+	}
+	// The order of the scopes doesn't matter
+	if _, err := s.Token(TokenRequest{ServiceAccount: testServiceAccount, Scopes: []string{"a", "b"}, Reason: "second"}); err != nil {
+		t.Fatal(err)
+	}
+	if iam.checks != 1 || iam.generated != 1 {
+		t.Errorf("checked access %d times and generated %d tokens, want 1 and 1", iam.checks, iam.generated)
+	}
+
+	// Different scopes, delegates and subjects get their own tokens
+	for _, other := range []TokenRequest{
+		{ServiceAccount: testServiceAccount, Scopes: []string{"a"}, Reason: "r"},
+		{ServiceAccount: testServiceAccount, Scopes: []string{"a", "b"}, Delegates: []string{"d@x.iam.gserviceaccount.com"}, Reason: "r"},
+		{ServiceAccount: testServiceAccount, Scopes: []string{"a", "b"}, Subject: "user@example.com", Reason: "r"},
+	} {
+		resp, err := s.Token(other)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.AccessToken == "token-1" {
+			t.Errorf("request %+v was served the token of a different request", other)
+		}
+	}
+	if n := len(s.Tokens()); n != 4 {
+		t.Errorf("agent has %d cached tokens, want 4", n)
+	}
+}
+
+func TestTokenAccessDenied(t *testing.T) {
+	iam := &fakeIAM{allowed: false, lifetime: 10 * time.Minute}
+	s := iam.server()
+
+	req := TokenRequest{ServiceAccount: testServiceAccount, Reason: "r"}
+	if _, err := s.Token(req); err == nil {
+		t.Fatal("expected an error when access is denied")
+	}
+	if iam.generated != 0 || len(s.Tokens()) != 0 {
+		t.Errorf("a token was generated without access")
+	}
+
+	// Access is checked again on the next request
+	iam.allowed = true
+	if _, err := s.Token(req); err != nil {
+		t.Fatal(err)
+	}
+	if iam.checks != 2 {
+		t.Errorf("checked access %d times, want 2", iam.checks)
+	}
+
+	if _, err := s.Token(TokenRequest{ServiceAccount: testServiceAccount}); err == nil {
+		t.Error("expected an error for a request without a reason")
+	}
+}
+
+func TestRefresh(t *testing.T) {
+	iam := &fakeIAM{allowed: true, lifetime: refreshMargin / 2}
+	s := iam.server()
+
+	if _, err := s.Token(TokenRequest{ServiceAccount: testServiceAccount, Reason: "first"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Token(TokenRequest{ServiceAccount: testServiceAccount, Reason: "second"}); err != nil {
+		t.Fatal(err)
+	}
+	// The token expires within the refresh margin, so it is replaced on every
+	// request and on every refresh, with the most recent reason
+	s.Refresh()
+	if iam.generated != 3 {
+		t.Errorf("generated %d tokens, want 3", iam.generated)
+	}
+	if got := iam.reasons[2]; got != "second" {
+		t.Errorf("token was refreshed with reason %q, want the most recent reason", got)
+	}
+
+	// Idle tokens are dropped
+	s.IdleTimeout = 0
+	time.Sleep(time.Millisecond)
+	s.Refresh()
+	if n := len(s.Tokens()); n != 0 {
+		t.Errorf("agent has %d cached tokens after they went idle, want 0", n)
+	}
+}
+
+func TestSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "eiam-agent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	socketPath := filepath.Join(dir, "agent.sock")
+
+	l, err := Listen(socketPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	fi, err := os.Stat(socketPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := fi.Mode().Perm(); perm != 0o600 {
+		t.Errorf("socket permissions = %o, want 600", perm)
+	}
+	if _, err := Listen(socketPath); err == nil {
+		t.Error("expected an error when an agent is already listening on the socket")
+	}
+
+	iam := &fakeIAM{allowed: true, lifetime: 10 * time.Minute}
+	go iam.server().Serve(l)
+
+	resp, err := RequestToken(socketPath, TokenRequest{ServiceAccount: testServiceAccount, Reason: "r"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.AccessToken != "token-1" || time.Until(resp.Expiry) <= 0 {
+		t.Errorf("unexpected token response %+v", resp)
+	}
+	infos, err := ListTokens(socketPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(infos) != 1 || infos[0].ServiceAccount != testServiceAccount || infos[0].Requests != 1 {
+		t.Errorf("unexpected cached tokens %+v", infos)
+	}
+
+	iam.mu.Lock()
+	iam.allowed = false
+	iam.mu.Unlock()
+	_, err = RequestToken(socketPath, TokenRequest{ServiceAccount: "other@my-project.iam.gserviceaccount.com", Reason: "r"})
+	if err == nil || !strings.Contains(err.Error(), "do not have access") {
+		t.Errorf("expected the agent to reject the request, got %v", err)
+	}
+}
@@ -0,0 +1,76 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"time"
+)
+
+// RequestToken asks the agent listening on the socket for an access token
+func RequestToken(socketPath string, req TokenRequest) (*TokenResponse, error) {
+	var resp TokenResponse
+	if err := call(socketPath, http.MethodPost, "/token", req, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// ListTokens returns the tokens cached by the agent listening on the socket
+func ListTokens(socketPath string) ([]TokenInfo, error) {
+	var infos []TokenInfo
+	if err := call(socketPath, http.MethodGet, "/tokens", nil, &infos); err != nil {
+		return nil, err
+	}
+	return infos, nil
+}
+
+// call sends a request to the agent and decodes the response into out
+func call(socketPath, method, path string, in, out interface{}) error {
+	client := &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", socketPath)
+			},
+		},
+		Timeout: time.Minute,
+	}
+
+	var body bytes.Buffer
+	if in != nil {
+		if err := json.NewEncoder(&body).Encode(in); err != nil {
+			return fmt.Errorf("failed to encode agent request: %v", err)
+		}
+	}
+	req, err := http.NewRequest(method, "http://eiam-agent"+path, &body)
+	if err != nil {
+		return fmt.Errorf("failed to create agent request: %v", err)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to connect to the agent on %s: %v", socketPath, err)
+	}
+	defer resp.Body.Close()
+
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("failed to read agent response: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		var errResp ErrorResponse
+		if err := json.Unmarshal(respBody, &errResp); err != nil || errResp.Error == "" {
+			errResp.Error = resp.Status
+		}
+		return fmt.Errorf("the agent rejected the request: %s", errResp.Error)
+	}
+	if err := json.Unmarshal(respBody, out); err != nil {
+		return fmt.Errorf("failed to decode agent response: %v", err)
+	}
+	return nil
+}
@@ -11,6 +11,8 @@ import (
 
 	"github.com/kirsle/configdir"
 	"github.com/spf13/viper"
+
+	"github.com/jessesomerville/ephemeral-iam/internal/federation"
 )
 
 var (
@@ -50,18 +52,46 @@ func getConfigDir() string {
 	return configPath
 }
 
-func initConfig() {
+// setDefaults sets the default value of each configuration key. This is done
+// every time eiam runs so that keys added in newer versions have a value even
+// if they are missing from an existing configuration file
+func setDefaults() {
+	viper.SetDefault("auth.account", "")
 	viper.SetDefault("authproxy.proxyaddress", "127.0.0.1")
 	viper.SetDefault("authproxy.proxyport", "8084")
 	viper.SetDefault("authproxy.verbose", false)
+	viper.SetDefault("authproxy.allowedhosts", []string{"*.googleapis.com", "accounts.google.com"})
+	viper.SetDefault("authproxy.allowedmethods", []string{"GET", "HEAD", "OPTIONS", "POST", "PUT", "PATCH", "DELETE"})
+	viper.SetDefault("authproxy.readonly", false)
 	viper.SetDefault("authproxy.logdir", filepath.Join(GetConfigDir(), "log"))
 	viper.SetDefault("authproxy.certfile", filepath.Join(GetConfigDir(), "server.pem"))
 	viper.SetDefault("authproxy.keyfile", filepath.Join(GetConfigDir(), "server.key"))
+	viper.SetDefault("federation.provider", "")
+	viper.SetDefault("federation.tokenfile", "")
+	viper.SetDefault("federation.tokenurl", federation.DefaultTokenURL)
 	viper.SetDefault("logging.format", "text")
 	viper.SetDefault("logging.level", "info")
 	viper.SetDefault("logging.disableleveltruncation", true)
 	viper.SetDefault("logging.padleveltext", true)
+	viper.SetDefault("session.credentialsfile", false)
+	viper.SetDefault("session.defaultduration", "10m")
+	viper.SetDefault("session.defaultscopes", []string{"cloud-platform", "userinfo.email"})
+	viper.SetDefault("session.expirywarning", "2m")
+	viper.SetDefault("session.maxduration", "1h")
+	viper.SetDefault("session.metadataserver", false)
+	viper.SetDefault("session.record", false)
+	viper.SetDefault("session.scopeprofiles", []map[string]interface{}{})
+	viper.SetDefault("session.shell", "")
+}
 
+// bindEnv lets CI jobs configure workload identity federation with
+// environment variables instead of a configuration file
+func bindEnv() {
+	viper.BindEnv("federation.provider", "EIAM_WORKLOAD_IDENTITY_PROVIDER")
+	viper.BindEnv("federation.tokenfile", "EIAM_OIDC_TOKEN_FILE")
+}
+
+func initConfig() {
 	if err := viper.SafeWriteConfig(); err != nil {
 		if _, ok := err.(viper.ConfigFileAlreadyExistsError); !ok {
 			log.Fatalf("failed to write config file %s/config.yml: %v", GetConfigDir(), err)
@@ -3,25 +3,50 @@ package appconfig
 import (
 	"context"
 	"fmt"
+	"io/ioutil"
 	"os"
 	"os/exec"
-	"path"
+	"path/filepath"
 	"strings"
 
 	"github.com/manifoldco/promptui"
 	"github.com/spf13/viper"
+	"golang.org/x/term"
 	"google.golang.org/api/oauth2/v1"
 
 	util "github.com/jessesomerville/ephemeral-iam/internal/eiamutil"
 	errorsutil "github.com/jessesomerville/ephemeral-iam/internal/errors"
+	"github.com/jessesomerville/ephemeral-iam/internal/federation"
 	"github.com/jessesomerville/ephemeral-iam/internal/gcpclient"
 )
 
+var (
+	// federated is true when eiam's source identity is an external account,
+	// e.g. a CI job's OIDC token exchanged through Workload Identity Federation
+	federated bool
+	// account is the gcloud account selected with --account or auth.account
+	account string
+)
+
+// Federated returns true when eiam authenticates with an external account
+// instead of a gcloud user's application default credentials
+func Federated() bool {
+	return federated
+}
+
+// Account returns the gcloud account that was selected as eiam's source
+// identity, or an empty string if eiam uses application default credentials
+func Account() string {
+	return account
+}
+
 func init() {
 	viper.SetConfigName("config")
 	viper.AddConfigPath(GetConfigDir())
 	viper.AutomaticEnv()
 	viper.SetConfigType("yml")
+	setDefaults()
+	bindEnv()
 
 	if err := viper.ReadInConfig(); err != nil {
 		if _, ok := err.(viper.ConfigFileNotFoundError); ok {
@@ -39,16 +64,9 @@ func init() {
 		errorsutil.CheckError(checkDependencies())
 	}
 
-	if err := checkValidADCExists(); err != nil {
-		util.Logger.WithError(err).Fatal("Setup error")
-	}
-
 	if err := createLogDir(); err != nil {
 		util.Logger.WithError(err).Fatal("Setup error")
 	}
-	if err := createTempKubeConfigDir(); err != nil {
-		util.Logger.WithError(err).Fatal("Setup error")
-	}
 }
 
 // checkDependencies checks if gcloud and kubectl are installed
@@ -89,6 +107,74 @@ func CheckCommandExists(command string) (string, error) {
 	return path, nil
 }
 
+// ConfigureSourceIdentity sets up the credentials that eiam uses to
+// impersonate service accounts. If an account is given, the credentials that
+// gcloud stores for it are used without changing the application default
+// credentials or the gcloud config. Otherwise CI jobs use an OIDC token that is
+// exchanged through Workload Identity Federation, and everyone else uses their
+// application default credentials.
+func ConfigureSourceIdentity(selectedAccount string) error {
+	if selectedAccount != "" {
+		credsFile, err := gcpclient.AccountCredentialsFile(selectedAccount)
+		if err != nil {
+			return err
+		}
+		util.Logger.Debugf("Using the stored credentials of %s", selectedAccount)
+		gcpclient.SetCredentialsFile(credsFile)
+		account = selectedAccount
+		return nil
+	}
+	if viper.GetString("federation.provider") != "" {
+		return configureFederation()
+	}
+	if credsFile := os.Getenv("GOOGLE_APPLICATION_CREDENTIALS"); credsFile != "" {
+		if ok, err := federation.IsExternalAccount(credsFile); err == nil && ok {
+			util.Logger.Debugf("Using external account credentials from %s", credsFile)
+			federated = true
+			return nil
+		}
+	}
+	return checkValidADCExists()
+}
+
+// configureFederation writes the external account credentials for the
+// configured workload identity provider and authenticates eiam's clients with them
+func configureFederation() error {
+	cfg := federation.Config{
+		Provider:  viper.GetString("federation.provider"),
+		TokenFile: viper.GetString("federation.tokenfile"),
+		TokenURL:  viper.GetString("federation.tokenurl"),
+	}
+	credsJSON, err := cfg.CredentialsJSON()
+	if err != nil {
+		return errorsutil.EiamError{
+			Log: util.Logger.WithError(err),
+			Msg: "Invalid workload identity federation configuration",
+			Err: err,
+		}
+	}
+	if _, err := os.Stat(cfg.TokenFile); err != nil {
+		return errorsutil.EiamError{
+			Log: util.Logger.WithError(err),
+			Msg: fmt.Sprintf("Failed to read OIDC token file %s", cfg.TokenFile),
+			Err: err,
+		}
+	}
+
+	credsFile := filepath.Join(GetConfigDir(), "federation.json")
+	if err := ioutil.WriteFile(credsFile, credsJSON, 0o600); err != nil {
+		return errorsutil.EiamError{
+			Log: util.Logger.WithError(err),
+			Msg: "Failed to write external account credentials",
+			Err: err,
+		}
+	}
+	util.Logger.Debugf("Using workload identity provider %s", cfg.Provider)
+	gcpclient.SetCredentialsFile(credsFile)
+	federated = true
+	return nil
+}
+
 // checkValidADCExists checks that application default credentials exist, that
 // they are valid, and that they are for the correct user
 func checkValidADCExists() error {
@@ -96,6 +182,14 @@ func checkValidADCExists() error {
 	oauth2Service, err := oauth2.NewService(ctx)
 	if err != nil {
 		if strings.Contains(err.Error(), "could not find default credentials") {
+			if !term.IsTerminal(int(os.Stdin.Fd())) {
+				err := fmt.Errorf("no application default credentials were found, configure federation.provider to authenticate without a gcloud user")
+				return errorsutil.EiamError{
+					Log: util.Logger.WithError(err),
+					Msg: "Failed to find application default credentials",
+					Err: err,
+				}
+			}
 			util.Logger.Warn("No Application Default Credentials were found, attempting to generate them\n")
 
 			cmd := exec.Command(viper.GetString("binarypaths.gcloud"), "auth", "application-default", "login", "--no-launch-browser")
@@ -137,14 +231,15 @@ func checkValidADCExists() error {
 // checkADCIdentity checks the active account set in the users gcloud config
 // against the identity associated with the application default credentials
 func checkADCIdentity(tokenEmail string) error {
-	account, err := gcpclient.CheckActiveAccountSet()
+	activeAccount, err := gcpclient.CheckActiveAccountSet()
 	if err != nil {
 		return err
 	}
 
 	util.Logger.Debugf("OAuth 2.0 Token Email: %s", tokenEmail)
-	if account != tokenEmail {
-		util.Logger.Warnf("API calls made by eiam will not be authenticated as your default account:\n\tAccount Set:     %s\n\tDefault Account: %s\n\n", tokenEmail, account)
+	if activeAccount != tokenEmail {
+		util.Logger.Warnf("API calls made by eiam will not be authenticated as your default account:\n\tAccount Set:     %s\n\tDefault Account: %s\n\n"+
+			"Use --account or set auth.account to choose the account explicitly\n\n", tokenEmail, activeAccount)
 
 		prompt := promptui.Prompt{
 			Label:     fmt.Sprintf("Authenticate as %s", tokenEmail),
@@ -159,7 +254,7 @@ func checkADCIdentity(tokenEmail string) error {
 				if err := checkValidADCExists(); err != nil {
 					util.Logger.Fatal(err)
 				}
-				util.Logger.Infof("Success. You should now be authenticated as %s", account)
+				util.Logger.Infof("Success. You should now be authenticated as %s", activeAccount)
 			}
 		} else {
 			util.Logger.Error("prompt to select authenticated user failed")
@@ -189,26 +284,3 @@ func createLogDir() error {
 	}
 	return nil
 }
-
-// createTempKubeConfigDir creates the directory to hold the temporary kubeconfigs
-// used in the assume-privileges command
-func createTempKubeConfigDir() error {
-	configDir := GetConfigDir()
-	kubeConfigDir := path.Join(configDir, "tmp_kube_config")
-	_, err := os.Stat(kubeConfigDir)
-	if os.IsNotExist(err) {
-		if err := os.MkdirAll(kubeConfigDir, 0o755); err != nil {
-			return fmt.Errorf("failed to create temp kubeconfig directory: %v", err)
-		}
-	} else if err != nil {
-		return fmt.Errorf("failed to find temp kubeconfig dir %s: %v", kubeConfigDir, err)
-	}
-	// Clear any leftover kubeconfigs from improper shutdowns
-	if err := os.RemoveAll(kubeConfigDir); err != nil {
-		return fmt.Errorf("failed to clear old kubeconfigs: %v", err)
-	}
-	if err := os.MkdirAll(kubeConfigDir, 0o755); err != nil {
-		return fmt.Errorf("failed to recreate temp kubeconfig directory: %v", err)
-	}
-	return nil
-}
@@ -5,7 +5,9 @@ import (
 	"crypto/rand"
 	"encoding/hex"
 	"fmt"
+	"io"
 	"os"
+	"regexp"
 	"sort"
 	"strings"
 	"text/tabwriter"
@@ -14,6 +16,21 @@ import (
 	"github.com/spf13/pflag"
 )
 
+var reasonPattern = regexp.MustCompile(`^ephemeral-iam ([0-9a-f]+): `)
+
+// ReadOnlyReasonPrefix is added to the reason of read-only privileged sessions
+// so that audit logs show that the session could not modify resources
+const ReadOnlyReasonPrefix = "[read-only] "
+
+// ReasonWithSubject adds the Google Workspace user that a token acts as to the
+// reason, so that audit logs show who the service account was acting for
+func ReasonWithSubject(subject, reason string) string {
+	if subject == "" {
+		return reason
+	}
+	return fmt.Sprintf("[subject: %s] %s", subject, reason)
+}
+
 // FormatReason formats the reason field for logging visibility
 func FormatReason(reason *string) error {
 	randomID, err := sessionID()
@@ -21,10 +38,24 @@ func FormatReason(reason *string) error {
 		return err
 	}
 
-	*reason = fmt.Sprintf("ephemeral-iam %s: %s", randomID, *reason)
+	*reason = FormatReasonWithSessionID(randomID, *reason)
 	return nil
 }
 
+// FormatReasonWithSessionID formats the reason field using an existing session ID
+func FormatReasonWithSessionID(id, reason string) string {
+	return fmt.Sprintf("ephemeral-iam %s: %s", id, reason)
+}
+
+// SessionIDFromReason returns the session ID from a reason formatted by
+// FormatReason, or an empty string if the reason was not formatted
+func SessionIDFromReason(reason string) string {
+	if match := reasonPattern.FindStringSubmatch(reason); match != nil {
+		return match[1]
+	}
+	return ""
+}
+
 func sessionID() (string, error) {
 	bytes := make([]byte, 8)
 	if _, err := rand.Read(bytes); err != nil {
@@ -36,6 +67,13 @@ func sessionID() (string, error) {
 
 // Confirm asks the user for confirmation before running a command
 func Confirm(vals map[string]string) {
+	ConfirmTo(os.Stdout, vals)
+}
+
+// ConfirmTo asks the user for confirmation before running a command, printing
+// the values and the prompt to out. Commands that write their result to stdout
+// confirm on stderr so that the prompt doesn't end up in redirected output.
+func ConfirmTo(out io.WriteCloser, vals map[string]string) {
 	var buf bytes.Buffer
 	w := tabwriter.NewWriter(&buf, 0, 4, 4, '-', 0)
 
@@ -49,12 +87,13 @@ func Confirm(vals map[string]string) {
 	cmdInfo := strings.Split(buf.String(), "\n")
 
 	for _, line := range cmdInfo {
-		fmt.Println(line)
+		fmt.Fprintln(out, line)
 	}
 
 	prompt := promptui.Prompt{
 		Label:     "Continue",
 		IsConfirm: true,
+		Stdout:    out,
 	}
 
 	if _, err := prompt.Run(); err != nil {
@@ -96,7 +135,7 @@ func ExtractUnknownArgs(flags *pflag.FlagSet, args []string) []string {
 		// If the current flag is known and it accepts an argument, skip the next loop
 		if currFlag != nil {
 			if currFlag.NoOptDefVal == "" {
-				if i+1 < len(trimmed) && currFlag.Value.String() == trimmed[i+1] {
+				if i+1 < len(trimmed) && flagHasValue(currFlag, trimmed[i+1]) {
 					i++
 				}
 			}
@@ -107,6 +146,21 @@ func ExtractUnknownArgs(flags *pflag.FlagSet, args []string) []string {
 	return unknownArgs
 }
 
+// flagHasValue reports whether val was parsed as a value of the flag. The
+// values of slice flags can be passed as a comma separated list.
+func flagHasValue(flag *pflag.Flag, val string) bool {
+	sliceValue, ok := flag.Value.(pflag.SliceValue)
+	if !ok {
+		return flag.Value.String() == val
+	}
+	for _, v := range strings.Split(val, ",") {
+		if !Contains(sliceValue.GetSlice(), v) {
+			return false
+		}
+	}
+	return true
+}
+
 func Contains(values []string, val string) bool {
 	for _, i := range values {
 		if i == val {
@@ -0,0 +1,60 @@
+package eiamutil
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/spf13/pflag"
+)
+
+func TestExtractUnknownArgs(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+		want []string
+	}{
+		{
+			"known flags",
+			[]string{"eiam", "gcloud", "compute", "instances", "list", "-s", "sa@p.iam.gserviceaccount.com", "--format=json"},
+			[]string{"compute", "instances", "list", "--format=json"},
+		},
+		{
+			"repeated slice flag",
+			[]string{"eiam", "gcloud", "projects", "list", "--delegate", "a@p.iam.gserviceaccount.com", "--delegate", "b@p.iam.gserviceaccount.com"},
+			[]string{"projects", "list"},
+		},
+		{
+			"comma separated slice flag",
+			[]string{"eiam", "gcloud", "projects", "list", "--delegate", "a@p.iam.gserviceaccount.com,b@p.iam.gserviceaccount.com"},
+			[]string{"projects", "list"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fs := pflag.NewFlagSet(tt.args[1], pflag.ContinueOnError)
+			fs.ParseErrorsWhitelist.UnknownFlags = true
+			fs.StringP("service-account-email", "s", "", "")
+			fs.StringSlice("delegate", []string{}, "")
+			if err := fs.Parse(tt.args[2:]); err != nil {
+				t.Fatalf("failed to parse flags: %v", err)
+			}
+
+			if got := ExtractUnknownArgs(fs, tt.args); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ExtractUnknownArgs() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReasonWithSubject(t *testing.T) {
+	if got := ReasonWithSubject("", "JIRA-1234"); got != "JIRA-1234" {
+		t.Errorf("ReasonWithSubject() = %q without a subject, want the reason unchanged", got)
+	}
+	got := FormatReasonWithSessionID("abc123", ReasonWithSubject("user@example.com", "JIRA-1234"))
+	if want := "ephemeral-iam abc123: [subject: user@example.com] JIRA-1234"; got != want {
+		t.Errorf("got reason %q, want %q", got, want)
+	}
+	if id := SessionIDFromReason(got); id != "abc123" {
+		t.Errorf("SessionIDFromReason() = %q, want abc123", id)
+	}
+}
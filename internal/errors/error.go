@@ -23,9 +23,23 @@ func (e EiamError) Error() string {
 	}
 }
 
+// ExitCodeError ends eiam with the exit code of a command that it ran on the
+// user's behalf. Nothing is logged since the command reports its own errors.
+type ExitCodeError struct {
+	Code int
+}
+
+func (e ExitCodeError) Error() string {
+	return fmt.Sprintf("command exited with status %d", e.Code)
+}
+
 // CheckError is the top-level error handler
 func CheckError(err error) {
 	if err != nil {
+		if exitErr, ok := err.(ExitCodeError); ok {
+			util.Logger.Exit(exitErr.Code)
+		}
+
 		if strings.Contains(err.Error(), "could not find default credentials") {
 			util.Logger.Fatal("No Application Default Credentials were found. Please run the following command to remediate this issue:\n\n  $ gcloud auth application-default login\n\n")
 		}
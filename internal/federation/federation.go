@@ -0,0 +1,114 @@
+// Package federation uses an OpenID Connect token from a CI system, such as
+// GitHub Actions or GitLab CI, as eiam's source identity through Workload
+// Identity Federation. The token is exchanged for a federated access token by
+// the Security Token Service, which is then used to impersonate service
+// accounts like the credentials of a human user.
+//
+// See https://cloud.google.com/iam/docs/workload-identity-federation
+package federation
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+)
+
+const (
+	// DefaultTokenURL is the token exchange endpoint of the Security Token
+	// Service
+	DefaultTokenURL = "https://sts.googleapis.com/v1/token"
+	// JWTTokenType is the type of an OpenID Connect subject token
+	JWTTokenType = "urn:ietf:params:oauth:token-type:jwt"
+	// ExternalAccountType is the type of an application default credentials
+	// file that uses Workload Identity Federation
+	ExternalAccountType = "external_account"
+)
+
+var providerPattern = regexp.MustCompile(`^//iam\.googleapis\.com/projects/[^/]+/locations/global/workloadIdentityPools/[^/]+/providers/[^/]+$`)
+
+// Config describes where the OIDC token comes from and which workload identity
+// provider it is exchanged through
+type Config struct {
+	// Provider is the full resource name of the workload identity provider,
+	// e.g. //iam.googleapis.com/projects/123/locations/global/workloadIdentityPools/ci/providers/github
+	Provider string
+	// TokenFile is the path to the file that holds the OIDC token. The file is
+	// read every time a new federated token is needed, so the CI system can
+	// replace the token while eiam is running.
+	TokenFile string
+	// TokenURL is the token exchange endpoint. It defaults to DefaultTokenURL.
+	TokenURL string
+}
+
+// credentialSource is the credential_source of an external account
+type credentialSource struct {
+	File string `json:"file"`
+}
+
+// externalAccount is an application default credentials file that uses
+// Workload Identity Federation
+type externalAccount struct {
+	Type             string           `json:"type"`
+	Audience         string           `json:"audience"`
+	SubjectTokenType string           `json:"subject_token_type"`
+	TokenURL         string           `json:"token_url"`
+	CredentialSource credentialSource `json:"credential_source"`
+}
+
+// Validate checks that the provider is a workload identity provider's resource
+// name and that a token file is set
+func (c Config) Validate() error {
+	if err := ValidateProvider(c.Provider); err != nil {
+		return err
+	}
+	if c.TokenFile == "" {
+		return fmt.Errorf("an OIDC token file is required to use workload identity provider %s", c.Provider)
+	}
+	return nil
+}
+
+// ValidateProvider checks that the provider is the full resource name of a
+// workload identity provider
+func ValidateProvider(provider string) error {
+	if !providerPattern.MatchString(provider) {
+		return fmt.Errorf("%q is not a workload identity provider, it must have the form "+
+			"//iam.googleapis.com/projects/PROJECT_NUMBER/locations/global/workloadIdentityPools/POOL/providers/PROVIDER", provider)
+	}
+	return nil
+}
+
+// CredentialsJSON returns an application default credentials file that
+// exchanges the OIDC token for a federated access token
+func (c Config) CredentialsJSON() ([]byte, error) {
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	tokenURL := c.TokenURL
+	if tokenURL == "" {
+		tokenURL = DefaultTokenURL
+	}
+	return json.MarshalIndent(externalAccount{
+		Type:             ExternalAccountType,
+		Audience:         c.Provider,
+		SubjectTokenType: JWTTokenType,
+		TokenURL:         tokenURL,
+		CredentialSource: credentialSource{File: c.TokenFile},
+	}, "", "  ")
+}
+
+// IsExternalAccount checks if the credentials file at the given path uses
+// Workload Identity Federation
+func IsExternalAccount(path string) (bool, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return false, err
+	}
+	var creds struct {
+		Type string `json:"type"`
+	}
+	if err := json.Unmarshal(data, &creds); err != nil {
+		return false, fmt.Errorf("failed to parse credentials file %s: %v", path, err)
+	}
+	return creds.Type == ExternalAccountType, nil
+}
@@ -0,0 +1,111 @@
+package federation
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/oauth2/google"
+
+	"github.com/jessesomerville/ephemeral-iam/internal/federation/ststest"
+)
+
+const testProvider = "//iam.googleapis.com/projects/123456789/locations/global/workloadIdentityPools/ci/providers/github"
+
+func TestExchange(t *testing.T) {
+	dir, err := ioutil.TempDir("", "eiam-federation")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	tokenFile := filepath.Join(dir, "oidc-token")
+	if err := ioutil.WriteFile(tokenFile, []byte("ci-oidc-token\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	sts := ststest.NewServer(testProvider, map[string]string{"ci-oidc-token": "federated-access-token"})
+	defer sts.Close()
+
+	credsJSON, err := Config{Provider: testProvider, TokenFile: tokenFile, TokenURL: sts.TokenURL()}.CredentialsJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+	creds, err := google.CredentialsFromJSON(context.Background(), credsJSON, "https://www.googleapis.com/auth/cloud-platform")
+	if err != nil {
+		t.Fatalf("client libraries can't load the credentials: %v", err)
+	}
+	token, err := creds.TokenSource.Token()
+	if err != nil {
+		t.Fatalf("failed to exchange the OIDC token: %v", err)
+	}
+	if token.AccessToken != "federated-access-token" {
+		t.Errorf("got access token %q, want federated-access-token", token.AccessToken)
+	}
+
+	exchanges := sts.Exchanges()
+	if len(exchanges) != 1 {
+		t.Fatalf("STS received %d exchanges, want 1", len(exchanges))
+	}
+	if got := exchanges[0]; got.SubjectTokenType != JWTTokenType || len(got.Scopes) != 1 {
+		t.Errorf("unexpected token exchange %+v", got)
+	}
+
+	// A token that the provider doesn't accept is rejected
+	if err := ioutil.WriteFile(tokenFile, []byte("forged-token"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	creds, _ = google.CredentialsFromJSON(context.Background(), credsJSON, "https://www.googleapis.com/auth/cloud-platform")
+	if _, err := creds.TokenSource.Token(); err == nil {
+		t.Error("expected the exchange of an invalid OIDC token to fail")
+	}
+}
+
+func TestCredentialsFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "eiam-federation")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	credsJSON, err := Config{Provider: testProvider, TokenFile: "/tmp/token"}.CredentialsJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+	credsFile := filepath.Join(dir, "creds.json")
+	if err := ioutil.WriteFile(credsFile, credsJSON, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := IsExternalAccount(credsFile); err != nil || !ok {
+		t.Errorf("IsExternalAccount() = %t, %v, want true", ok, err)
+	}
+
+	userFile := filepath.Join(dir, "user.json")
+	if err := ioutil.WriteFile(userFile, []byte(`{"type": "authorized_user"}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := IsExternalAccount(userFile); err != nil || ok {
+		t.Errorf("IsExternalAccount() = %t, %v for user credentials, want false", ok, err)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  Config
+		wantErr bool
+	}{
+		{"valid", Config{Provider: testProvider, TokenFile: "/tmp/token"}, false},
+		{"missing token file", Config{Provider: testProvider}, true},
+		{"pool instead of provider", Config{Provider: "//iam.googleapis.com/projects/123456789/locations/global/workloadIdentityPools/ci", TokenFile: "/tmp/token"}, true},
+		{"not a resource name", Config{Provider: "github", TokenFile: "/tmp/token"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.config.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("Validate() error = %v, wantErr %t", err, tt.wantErr)
+			}
+		})
+	}
+}
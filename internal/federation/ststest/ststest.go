@@ -0,0 +1,121 @@
+// Package ststest provides a local stand-in for the Security Token Service so
+// that Workload Identity Federation can be tested without a workload identity
+// pool.
+package ststest
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+)
+
+const (
+	tokenExchangeGrantType = "urn:ietf:params:oauth:grant-type:token-exchange"
+	accessTokenType        = "urn:ietf:params:oauth:token-type:access_token"
+)
+
+// Exchange is a token exchange request that the server accepted
+type Exchange struct {
+	Audience         string
+	SubjectToken     string
+	SubjectTokenType string
+	Scopes           []string
+}
+
+// Server exchanges subject tokens for access tokens. Only subject tokens that
+// are in SubjectTokens, for the server's audience, are accepted.
+type Server struct {
+	*httptest.Server
+
+	// Audience is the workload identity provider that subject tokens must be
+	// exchanged through
+	Audience string
+	// SubjectTokens maps each accepted subject token to the access token that
+	// it is exchanged for
+	SubjectTokens map[string]string
+
+	mu        sync.Mutex
+	exchanges []Exchange
+}
+
+// NewServer starts a Security Token Service stand-in. Its token exchange
+// endpoint is at URL + "/v1/token". The caller must call Close when done.
+func NewServer(audience string, subjectTokens map[string]string) *Server {
+	s := &Server{Audience: audience, SubjectTokens: subjectTokens}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.handleToken))
+	return s
+}
+
+// TokenURL returns the URL of the server's token exchange endpoint
+func (s *Server) TokenURL() string {
+	return s.URL + "/v1/token"
+}
+
+// Exchanges returns the token exchanges that the server accepted
+func (s *Server) Exchanges() []Exchange {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Exchange{}, s.exchanges...)
+}
+
+func (s *Server) handleToken(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/v1/token" {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "invalid_request", "method not allowed")
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_request", err.Error())
+		return
+	}
+
+	switch {
+	case r.PostForm.Get("grant_type") != tokenExchangeGrantType:
+		writeError(w, http.StatusBadRequest, "unsupported_grant_type", fmt.Sprintf("unsupported grant_type %q", r.PostForm.Get("grant_type")))
+		return
+	case r.PostForm.Get("requested_token_type") != accessTokenType:
+		writeError(w, http.StatusBadRequest, "invalid_request", "requested_token_type must be an access token")
+		return
+	case r.PostForm.Get("audience") != s.Audience:
+		writeError(w, http.StatusBadRequest, "invalid_target", fmt.Sprintf("unknown audience %q", r.PostForm.Get("audience")))
+		return
+	}
+	subjectToken := r.PostForm.Get("subject_token")
+	accessToken, ok := s.SubjectTokens[subjectToken]
+	if !ok {
+		writeError(w, http.StatusBadRequest, "invalid_grant", "the subject token is invalid")
+		return
+	}
+
+	s.mu.Lock()
+	s.exchanges = append(s.exchanges, Exchange{
+		Audience:         r.PostForm.Get("audience"),
+		SubjectToken:     subjectToken,
+		SubjectTokenType: r.PostForm.Get("subject_token_type"),
+		Scopes:           strings.Fields(r.PostForm.Get("scope")),
+	})
+	s.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"access_token":      accessToken,
+		"issued_token_type": accessTokenType,
+		"token_type":        "Bearer",
+		"expires_in":        3600,
+	})
+}
+
+func writeError(w http.ResponseWriter, status int, code, description string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{
+		"error":             code,
+		"error_description": description,
+	})
+}
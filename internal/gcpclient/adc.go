@@ -0,0 +1,141 @@
+package gcpclient
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	"golang.org/x/oauth2/google"
+	"google.golang.org/api/oauth2/v1"
+
+	util "github.com/jessesomerville/ephemeral-iam/internal/eiamutil"
+	errorsutil "github.com/jessesomerville/ephemeral-iam/internal/errors"
+)
+
+// maxImpersonatedLifetime is the longest lifetime of the access tokens that
+// impersonated credentials generate
+const maxImpersonatedLifetime = time.Hour
+
+// impersonatedCredentials is an application default credentials file that
+// uses the source credentials to generate access tokens for a service account
+type impersonatedCredentials struct {
+	Type                           string          `json:"type"`
+	ServiceAccountImpersonationURL string          `json:"service_account_impersonation_url"`
+	Delegates                      []string        `json:"delegates"`
+	Lifetime                       string          `json:"lifetime"`
+	SourceCredentials              json.RawMessage `json:"source_credentials"`
+}
+
+// ADCEmail returns the email of the account that the application default
+// credentials belong to, which is the identity that eiam's own API calls are
+// made as
+func ADCEmail() (string, error) {
+	oauth2Service, err := oauth2.NewService(ctx, clientOptions()...)
+	if err != nil {
+		return "", &errorsutil.SDKClientCreateError{Err: err, ResourceType: "OAuth 2.0"}
+	}
+	tokenInfo, err := oauth2Service.Tokeninfo().Do()
+	if err != nil {
+		return "", errorsutil.EiamError{
+			Log: util.Logger.WithError(err),
+			Msg: "Failed to parse OAuth token",
+			Err: err,
+		}
+	}
+	if tokenInfo.Email == "" {
+		err := fmt.Errorf("the application default credentials' token has no email, it needs the userinfo.email scope")
+		return "", errorsutil.EiamError{
+			Log: util.Logger.WithError(err),
+			Msg: "Failed to find the account of the application default credentials",
+			Err: err,
+		}
+	}
+	return tokenInfo.Email, nil
+}
+
+// ImpersonatedCredentialsFile returns the contents of an application default
+// credentials file that impersonates the given service account using the
+// user's own application default credentials. Client libraries generate access
+// tokens for the service account with it directly, without going through the
+// auth proxy. The delegates are the service accounts in the delegation chain,
+// starting with the one that the user impersonates. The generated access
+// tokens last for the lifetime, up to an hour.
+func ImpersonatedCredentialsFile(serviceAccountEmail string, delegates []string, lifetime time.Duration) ([]byte, error) {
+	source, err := sourceCredentials()
+	if err != nil {
+		return nil, errorsutil.EiamError{
+			Log: util.Logger.WithError(err),
+			Msg: "Failed to find application default credentials",
+			Err: err,
+		}
+	}
+
+	// Only the user's own credentials are used as the source, so that service
+	// account keys and external accounts, such as federated CI identities, are
+	// never copied into the session
+	var sourceType struct {
+		Type string `json:"type"`
+	}
+	if source.JSON != nil {
+		if err := json.Unmarshal(source.JSON, &sourceType); err != nil {
+			return nil, errorsutil.EiamError{
+				Log: util.Logger.WithError(err),
+				Msg: "Failed to parse application default credentials",
+				Err: err,
+			}
+		}
+	}
+	if sourceType.Type != "authorized_user" {
+		err := fmt.Errorf("application default credentials of type %q can't be used to impersonate a service account", sourceType.Type)
+		return nil, errorsutil.EiamError{
+			Log: util.Logger.WithError(err),
+			Msg: "Unsupported application default credentials",
+			Err: err,
+		}
+	}
+
+	creds, err := json.MarshalIndent(impersonatedCredentials{
+		Type: "impersonated_service_account",
+		ServiceAccountImpersonationURL: fmt.Sprintf(
+			"https://iamcredentials.googleapis.com/v1/projects/-/serviceAccounts/%s:generateAccessToken",
+			serviceAccountEmail,
+		),
+		Delegates:         delegateNames(delegates),
+		Lifetime:          fmt.Sprintf("%ds", int64(impersonatedLifetime(lifetime).Seconds())),
+		SourceCredentials: source.JSON,
+	}, "", "  ")
+	if err != nil {
+		return nil, errorsutil.EiamError{
+			Log: util.Logger.WithError(err),
+			Msg: "Failed to serialize impersonated credentials",
+			Err: err,
+		}
+	}
+	return creds, nil
+}
+
+// sourceCredentials returns the credentials that eiam's API calls are
+// authenticated with
+func sourceCredentials() (*google.Credentials, error) {
+	if credentialsFile == "" {
+		return google.FindDefaultCredentials(ctx, AccessTokenScopes...)
+	}
+	data, err := ioutil.ReadFile(credentialsFile)
+	if err != nil {
+		return nil, err
+	}
+	return google.CredentialsFromJSON(ctx, data, AccessTokenScopes...)
+}
+
+// impersonatedLifetime limits the lifetime of impersonated access tokens to
+// between a second and maxImpersonatedLifetime
+func impersonatedLifetime(lifetime time.Duration) time.Duration {
+	if lifetime > maxImpersonatedLifetime {
+		return maxImpersonatedLifetime
+	}
+	if lifetime < time.Second {
+		return time.Second
+	}
+	return lifetime
+}
@@ -4,14 +4,38 @@ import (
 	"context"
 
 	credentials "cloud.google.com/go/iam/credentials/apiv1"
-	errorsutil "github.com/jessesomerville/ephemeral-iam/internal/errors"
 	"google.golang.org/api/option"
+
+	errorsutil "github.com/jessesomerville/ephemeral-iam/internal/errors"
+	queryiam "github.com/jessesomerville/ephemeral-iam/internal/gcpclient/query_iam"
 )
 
+// credentialsFile is the credentials file that eiam's API calls are
+// authenticated with, or empty to use the application default credentials
+var credentialsFile string
+
+// SetCredentialsFile authenticates eiam's API calls with the given credentials
+// file instead of the application default credentials. The file is passed to
+// the clients directly rather than through GOOGLE_APPLICATION_CREDENTIALS, so
+// that it is not inherited by the processes that eiam starts.
+func SetCredentialsFile(path string) {
+	credentialsFile = path
+	queryiam.SetCredentialsFile(path)
+}
+
+// clientOptions returns the options that authenticate a client as eiam's
+// source identity followed by opts
+func clientOptions(opts ...option.ClientOption) []option.ClientOption {
+	if credentialsFile == "" {
+		return opts
+	}
+	return append([]option.ClientOption{option.WithCredentialsFile(credentialsFile)}, opts...)
+}
+
 // ClientWithReason creates a client SDK with the provided reason field
 func ClientWithReason(reason string) (*credentials.IamCredentialsClient, error) {
 	ctx := context.Background()
-	gcpClientWithReason, err := credentials.NewIamCredentialsClient(ctx, option.WithRequestReason(reason))
+	gcpClientWithReason, err := credentials.NewIamCredentialsClient(ctx, clientOptions(option.WithRequestReason(reason))...)
 	if err != nil {
 		return nil, &errorsutil.SDKClientCreateError{Err: err, ResourceType: "Credentials"}
 	}
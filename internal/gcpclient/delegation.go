@@ -0,0 +1,128 @@
+package gcpclient
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	credentialspb "google.golang.org/genproto/googleapis/iam/credentials/v1"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	util "github.com/jessesomerville/ephemeral-iam/internal/eiamutil"
+)
+
+// jwtBearerGrantType is the OAuth grant type that exchanges a signed JWT for
+// an access token
+const jwtBearerGrantType = "urn:ietf:params:oauth:grant-type:jwt-bearer"
+
+// delegationTokenURL is the endpoint that delegated JWTs are exchanged at. It
+// is the audience of the JWTs.
+var delegationTokenURL = "https://oauth2.googleapis.com/token"
+
+// delegationTimeout bounds how long a delegated JWT exchange can take
+const delegationTimeout = 30 * time.Second
+
+// delegationClient is the HTTP client that delegated JWTs are exchanged with
+var delegationClient = &http.Client{Timeout: delegationTimeout}
+
+// delegatedClaims are the claims of a JWT that a service account with
+// domain-wide delegation signs to act as a Google Workspace user
+type delegatedClaims struct {
+	Issuer   string `json:"iss"`
+	Subject  string `json:"sub"`
+	Scope    string `json:"scope"`
+	Audience string `json:"aud"`
+	IssuedAt int64  `json:"iat"`
+	Expiry   int64  `json:"exp"`
+}
+
+// newDelegatedClaims returns the JSON claims of a JWT that requests an access
+// token for the subject with the given scopes
+func newDelegatedClaims(serviceAccountEmail, subject string, scopes []string, now time.Time) (string, error) {
+	claims, err := json.Marshal(delegatedClaims{
+		Issuer:   serviceAccountEmail,
+		Subject:  subject,
+		Scope:    strings.Join(scopes, " "),
+		Audience: delegationTokenURL,
+		IssuedAt: now.Unix(),
+		Expiry:   now.Add(time.Duration(sessionDuration) * time.Second).Unix(),
+	})
+	if err != nil {
+		return "", err
+	}
+	return string(claims), nil
+}
+
+// exchangeDelegatedJWT exchanges a signed JWT for an access token
+func exchangeDelegatedJWT(signedJwt string) (*credentialspb.GenerateAccessTokenResponse, error) {
+	reqCtx, cancel := context.WithTimeout(ctx, delegationTimeout)
+	defer cancel()
+
+	form := url.Values{
+		"grant_type": {jwtBearerGrantType},
+		"assertion":  {signedJwt},
+	}
+	req, err := http.NewRequestWithContext(reqCtx, http.MethodPost, delegationTokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := delegationClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	var token struct {
+		AccessToken      string `json:"access_token"`
+		ExpiresIn        int64  `json:"expires_in"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err := json.Unmarshal(body, &token); err != nil {
+		return nil, fmt.Errorf("failed to parse token response (%s): %v", resp.Status, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		// unauthorized_client means that the service account has not been
+		// granted domain-wide delegation for the scopes
+		return nil, fmt.Errorf("token exchange failed (%s): %s %s", resp.Status, token.Error, token.ErrorDescription)
+	}
+	if token.AccessToken == "" {
+		return nil, fmt.Errorf("token response has no access token")
+	}
+	return &credentialspb.GenerateAccessTokenResponse{
+		AccessToken: token.AccessToken,
+		ExpireTime:  timestamppb.New(time.Now().Add(time.Duration(token.ExpiresIn) * time.Second)),
+	}, nil
+}
+
+// generateDelegatedAccessToken generates an access token that acts as the
+// subject, a Google Workspace user, through the service account's domain-wide
+// delegation. The service account signs a JWT for the subject, which is then
+// exchanged for an access token.
+func generateDelegatedAccessToken(serviceAccountEmail, subject, reason string, scopes []string, delegates ...string) (*credentialspb.GenerateAccessTokenResponse, error) {
+	claims, err := newDelegatedClaims(serviceAccountEmail, subject, scopes, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	signed, err := SignJwt(serviceAccountEmail, claims, reason, delegates...)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := exchangeDelegatedJWT(signed.GetSignedJwt())
+	if err != nil {
+		util.Logger.Errorf("Failed to generate access token for %s as %s", subject, serviceAccountEmail)
+		return nil, err
+	}
+	return resp, nil
+}
@@ -0,0 +1,86 @@
+package gcpclient
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestNewDelegatedClaims(t *testing.T) {
+	now := time.Unix(1600000000, 0)
+	claims, err := newDelegatedClaims("admin@my-project.iam.gserviceaccount.com", "user@example.com",
+		[]string{"https://www.googleapis.com/auth/admin.directory.user", "https://www.googleapis.com/auth/drive"}, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got map[string]interface{}
+	if err := json.Unmarshal([]byte(claims), &got); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]interface{}{
+		"iss":   "admin@my-project.iam.gserviceaccount.com",
+		"sub":   "user@example.com",
+		"scope": "https://www.googleapis.com/auth/admin.directory.user https://www.googleapis.com/auth/drive",
+		"aud":   delegationTokenURL,
+		"iat":   float64(1600000000),
+		"exp":   float64(1600000000 + sessionDuration),
+	}
+	for k, v := range want {
+		if got[k] != v {
+			t.Errorf("claim %s = %v, want %v", k, got[k], v)
+		}
+	}
+}
+
+func TestExchangeDelegatedJWT(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		w.Header().Set("Content-Type", "application/json")
+		if r.PostForm.Get("grant_type") != jwtBearerGrantType || r.PostForm.Get("assertion") != "signed-jwt" {
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(`{"error": "unauthorized_client", "error_description": "Client is unauthorized to retrieve access tokens using this method."}`))
+			return
+		}
+		w.Write([]byte(`{"access_token": "delegated-token", "expires_in": 3599, "token_type": "Bearer"}`))
+	}))
+	defer srv.Close()
+
+	defer func(tokenURL string) { delegationTokenURL = tokenURL }(delegationTokenURL)
+	delegationTokenURL = srv.URL
+
+	resp, err := exchangeDelegatedJWT("signed-jwt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.GetAccessToken() != "delegated-token" {
+		t.Errorf("got access token %q, want delegated-token", resp.GetAccessToken())
+	}
+	if ttl := time.Until(resp.GetExpireTime().AsTime()); ttl < 59*time.Minute || ttl > time.Hour {
+		t.Errorf("token expires in %s, want about an hour", ttl)
+	}
+
+	if _, err := exchangeDelegatedJWT("not-delegated"); err == nil {
+		t.Error("expected an error when the exchange is rejected")
+	}
+}
+
+func TestExchangeDelegatedJWTTimeout(t *testing.T) {
+	unblock := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-unblock
+	}))
+	defer srv.Close()
+	defer close(unblock)
+
+	defer func(tokenURL string) { delegationTokenURL = tokenURL }(delegationTokenURL)
+	delegationTokenURL = srv.URL
+	defer func(client *http.Client) { delegationClient = client }(delegationClient)
+	delegationClient = &http.Client{Timeout: 50 * time.Millisecond}
+
+	if _, err := exchangeDelegatedJWT("signed-jwt"); err == nil {
+		t.Error("expected an error when the token endpoint doesn't respond")
+	}
+}
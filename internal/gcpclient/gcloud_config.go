@@ -2,12 +2,15 @@ package gcpclient
 
 import (
 	"fmt"
+	"io/fs"
 	"io/ioutil"
 	"os"
 	"os/user"
 	"path"
+	"path/filepath"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/lithammer/dedent"
 	"github.com/manifoldco/promptui"
@@ -19,22 +22,32 @@ import (
 )
 
 var (
-	gcloudConfig   *ini.File
-	pathToConfig   string
-	initialProjVal string
-	once           sync.Once
+	gcloudConfig *ini.File
+	pathToConfig string
+	once         sync.Once
 )
 
-func readGcloudConfigFromFile() error {
+// GcloudConfigDir returns the directory that gcloud reads its configuration from
+func GcloudConfigDir() (string, error) {
+	if configDir := os.Getenv("CLOUDSDK_CONFIG"); configDir != "" {
+		return configDir, nil
+	}
 	usr, err := user.Current()
 	if err != nil {
-		return errorsutil.EiamError{
+		return "", errorsutil.EiamError{
 			Log: util.Logger.WithError(err),
 			Msg: "Failed to get current system user",
 			Err: err,
 		}
 	}
-	configDir := path.Join(usr.HomeDir, ".config", "gcloud")
+	return path.Join(usr.HomeDir, ".config", "gcloud"), nil
+}
+
+func readGcloudConfigFromFile() error {
+	configDir, err := GcloudConfigDir()
+	if err != nil {
+		return err
+	}
 
 	activeConfig, err := getActiveConfig(configDir)
 	if err != nil {
@@ -52,7 +65,6 @@ func readGcloudConfigFromFile() error {
 			Err: err,
 		}
 	}
-	initialProjVal = gcloudConfig.Section("core").Key("project").String()
 	return nil
 }
 
@@ -178,21 +190,46 @@ func getGcloudConfig() (configErr error) {
 	return configErr
 }
 
-// ConfigureGcloudProxy configures the current gcloud configuration to use the auth proxy
-func ConfigureGcloudProxy(project string) error {
-	if err := getGcloudConfig(); err != nil {
+// ConfigureGcloudProxy copies the user's gcloud configuration directory to
+// sessionConfigDir and configures the active configuration of the copy to use
+// the auth proxy. The user's own gcloud configuration is left untouched, so
+// only commands run with CLOUDSDK_CONFIG set to sessionConfigDir are proxied.
+func ConfigureGcloudProxy(sessionConfigDir, project, proxyAddress, proxyPort string) error {
+	configDir, err := GcloudConfigDir()
+	if err != nil {
 		return err
 	}
+	if err := copyGcloudConfigDir(configDir, sessionConfigDir); err != nil {
+		return errorsutil.EiamError{
+			Log: util.Logger.WithError(err),
+			Msg: "Failed to copy gcloud config for privileged session",
+			Err: err,
+		}
+	}
+
+	activeConfig, err := getActiveConfig(sessionConfigDir)
+	if err != nil {
+		return err
+	}
+	sessionConfigPath := path.Join(sessionConfigDir, "configurations", fmt.Sprintf("config_%s", activeConfig))
+	sessionConfig, err := ini.LooseLoad(sessionConfigPath)
+	if err != nil {
+		return errorsutil.EiamError{
+			Log: util.Logger.WithError(err),
+			Msg: "Failed to parse gcloud config",
+			Err: err,
+		}
+	}
 
-	gcloudConfig.Section("proxy").Key("address").SetValue(viper.GetString("authproxy.proxyaddress"))
-	gcloudConfig.Section("proxy").Key("port").SetValue(viper.GetString("authproxy.proxyport"))
-	gcloudConfig.Section("proxy").Key("type").SetValue("http")
-	gcloudConfig.Section("core").Key("custom_ca_certs_file").SetValue(viper.GetString("authproxy.certfile"))
+	sessionConfig.Section("proxy").Key("address").SetValue(proxyAddress)
+	sessionConfig.Section("proxy").Key("port").SetValue(proxyPort)
+	sessionConfig.Section("proxy").Key("type").SetValue("http")
+	sessionConfig.Section("core").Key("custom_ca_certs_file").SetValue(viper.GetString("authproxy.certfile"))
 	// If the user specified a project flag, set it in the gcloud config
 	if project != "" {
-		gcloudConfig.Section("core").Key("project").SetValue(project)
+		sessionConfig.Section("core").Key("project").SetValue(project)
 	}
-	if err := gcloudConfig.SaveTo(pathToConfig); err != nil {
+	if err := sessionConfig.SaveTo(sessionConfigPath); err != nil {
 		return errorsutil.EiamError{
 			Log: util.Logger.WithError(err),
 			Msg: "Failed to save gcloud config to file",
@@ -202,25 +239,133 @@ func ConfigureGcloudProxy(project string) error {
 	return nil
 }
 
-// UnsetGcloudProxy restores the auth proxy changes made to the gcloud config
-func UnsetGcloudProxy() error {
-	if err := getGcloudConfig(); err != nil {
-		return err
+// copyGcloudConfigDir copies the regular files in a gcloud configuration
+// directory to dst. The logs directory is skipped since it is not needed by
+// gcloud and can grow quite large.
+func copyGcloudConfigDir(src, dst string) error {
+	return filepath.WalkDir(src, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, p)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+
+		switch {
+		case d.IsDir() && rel == "logs":
+			return filepath.SkipDir
+		case d.IsDir():
+			return os.MkdirAll(target, 0o700)
+		case !d.Type().IsRegular():
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		contents, err := ioutil.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		return ioutil.WriteFile(target, contents, info.Mode().Perm())
+	})
+}
+
+// RevertStaleGcloudProxy removes auth proxy settings from the user's active
+// gcloud configuration. Older versions of eiam wrote these settings directly to
+// the user's configuration, so a session that did not shut down properly could
+// leave gcloud pointed at a proxy that is no longer running. A backup of the
+// configuration is written to backupDir before it is changed. It reports
+// whether any settings were removed.
+//
+// Only the user's own configuration is reverted. Inside a privileged sub-shell,
+// CLOUDSDK_CONFIG points to the session's copy of the configuration under
+// sessionsDir, whose proxy settings belong to the running session.
+func RevertStaleGcloudProxy(backupDir, sessionsDir string) (bool, error) {
+	configDir, err := GcloudConfigDir()
+	if err != nil {
+		return false, err
+	}
+	if isWithinDir(configDir, sessionsDir) {
+		return false, nil
+	}
+	// Don't prompt the user to pick an active configuration just to check it
+	activeConfig, err := ioutil.ReadFile(path.Join(configDir, "active_config"))
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, errorsutil.EiamError{
+			Log: util.Logger.WithError(err),
+			Msg: "Failed to get active gcloud config",
+			Err: err,
+		}
 	}
 
-	gcloudConfig.Section("proxy").DeleteKey("address")
-	gcloudConfig.Section("proxy").DeleteKey("port")
-	gcloudConfig.Section("proxy").DeleteKey("type")
-	gcloudConfig.Section("core").DeleteKey("custom_ca_certs_file")
-	gcloudConfig.Section("core").Key("project").SetValue(initialProjVal)
-	if err := gcloudConfig.SaveTo(pathToConfig); err != nil {
-		return errorsutil.EiamError{
+	configName := fmt.Sprintf("config_%s", strings.TrimSpace(string(activeConfig)))
+	configPath := path.Join(configDir, "configurations", configName)
+	config, err := ini.LooseLoad(configPath)
+	if err != nil {
+		return false, errorsutil.EiamError{
+			Log: util.Logger.WithError(err),
+			Msg: "Failed to parse gcloud config",
+			Err: err,
+		}
+	}
+
+	proxySection := config.Section("proxy")
+	coreSection := config.Section("core")
+	if coreSection.Key("custom_ca_certs_file").String() != viper.GetString("authproxy.certfile") ||
+		proxySection.Key("address").String() != viper.GetString("authproxy.proxyaddress") {
+		return false, nil
+	}
+
+	backupPath := path.Join(backupDir, fmt.Sprintf("%s_%s", configName, time.Now().Format("20060102150405")))
+	if err := os.MkdirAll(backupDir, 0o700); err != nil {
+		return false, errorsutil.EiamError{
+			Log: util.Logger.WithError(err),
+			Msg: "Failed to create gcloud config backup directory",
+			Err: err,
+		}
+	}
+	if err := config.SaveTo(backupPath); err != nil {
+		return false, errorsutil.EiamError{
+			Log: util.Logger.WithError(err),
+			Msg: "Failed to back up gcloud config",
+			Err: err,
+		}
+	}
+	util.Logger.Debugf("Backed up gcloud config %s to %s", configPath, backupPath)
+
+	proxySection.DeleteKey("address")
+	proxySection.DeleteKey("port")
+	proxySection.DeleteKey("type")
+	coreSection.DeleteKey("custom_ca_certs_file")
+	if err := config.SaveTo(configPath); err != nil {
+		return false, errorsutil.EiamError{
 			Log: util.Logger.WithError(err),
 			Msg: "Failed to save gcloud config to file",
 			Err: err,
 		}
 	}
-	return nil
+	return true, nil
+}
+
+// isWithinDir checks if path is dir or one of its descendants
+func isWithinDir(path, dir string) bool {
+	if resolved, err := filepath.EvalSymlinks(path); err == nil {
+		path = resolved
+	}
+	if resolved, err := filepath.EvalSymlinks(dir); err == nil {
+		dir = resolved
+	}
+	rel, err := filepath.Rel(dir, path)
+	if err != nil {
+		return false
+	}
+	return rel == "." || (rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)))
 }
 
 // CheckActiveAccountSet ensures that the current gcloud config has an active account value
@@ -249,6 +394,27 @@ func CheckActiveAccountSet() (string, error) {
 	}
 }
 
+// AccountCredentialsFile returns the path to the application default
+// credentials file that gcloud stores for each account it is logged in as
+func AccountCredentialsFile(account string) (string, error) {
+	configDir, err := GcloudConfigDir()
+	if err != nil {
+		return "", err
+	}
+	credsFile := path.Join(configDir, "legacy_credentials", account, "adc.json")
+	if _, err := os.Stat(credsFile); err != nil {
+		if os.IsNotExist(err) {
+			err = fmt.Errorf("gcloud has no stored credentials for %s, run `gcloud auth login %s` first", account, account)
+		}
+		return "", errorsutil.EiamError{
+			Log: util.Logger.WithError(err),
+			Msg: fmt.Sprintf("Failed to find credentials for account %s", account),
+			Err: err,
+		}
+	}
+	return credsFile, nil
+}
+
 // GetCurrentProject get the active project from the gcloud config
 func GetCurrentProject() (string, error) {
 	if err := getGcloudConfig(); err != nil {
@@ -0,0 +1,88 @@
+package gcpclient
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+
+	util "github.com/jessesomerville/ephemeral-iam/internal/eiamutil"
+)
+
+const proxiedGcloudConfig = `[core]
+custom_ca_certs_file = /home/user/.config/ephemeral-iam/server.pem
+
+[proxy]
+address = 127.0.0.1
+port = 8084
+type = http
+`
+
+// writeGcloudConfig writes a gcloud configuration directory whose active
+// configuration points at the auth proxy
+func writeGcloudConfig(t *testing.T, configDir string) string {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Join(configDir, "configurations"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(configDir, "active_config"), []byte("default"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	configPath := filepath.Join(configDir, "configurations", "config_default")
+	if err := ioutil.WriteFile(configPath, []byte(proxiedGcloudConfig), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return configPath
+}
+
+func TestRevertStaleGcloudProxy(t *testing.T) {
+	dir, err := ioutil.TempDir("", "eiam-gcloud-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	log := logrus.New()
+	log.Out = ioutil.Discard
+	util.Logger = log
+	defer func() { util.Logger = nil }()
+	viper.Set("authproxy.certfile", "/home/user/.config/ephemeral-iam/server.pem")
+	viper.Set("authproxy.proxyaddress", "127.0.0.1")
+	defer viper.Reset()
+	defer os.Setenv("CLOUDSDK_CONFIG", os.Getenv("CLOUDSDK_CONFIG"))
+
+	sessionsDir := filepath.Join(dir, "ephemeral-iam", "sessions")
+	backupDir := filepath.Join(dir, "backups")
+
+	// The gcloud config of a running session's sub-shell is left alone
+	sessionConfig := writeGcloudConfig(t, filepath.Join(sessionsDir, "5a1f9c2e", "gcloud"))
+	os.Setenv("CLOUDSDK_CONFIG", filepath.Dir(filepath.Dir(sessionConfig)))
+	reverted, err := RevertStaleGcloudProxy(backupDir, sessionsDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reverted {
+		t.Error("reverted the proxy settings of a running session")
+	}
+	if data, _ := ioutil.ReadFile(sessionConfig); string(data) != proxiedGcloudConfig {
+		t.Errorf("the session's gcloud config was changed:\n%s", data)
+	}
+
+	// The user's own gcloud config is reverted
+	userConfig := writeGcloudConfig(t, filepath.Join(dir, "gcloud"))
+	os.Setenv("CLOUDSDK_CONFIG", filepath.Dir(filepath.Dir(userConfig)))
+	reverted, err = RevertStaleGcloudProxy(backupDir, sessionsDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reverted {
+		t.Error("the stale proxy settings in the user's gcloud config were not reverted")
+	}
+	if data, _ := ioutil.ReadFile(userConfig); strings.Contains(string(data), "127.0.0.1") {
+		t.Errorf("the proxy settings are still in the user's gcloud config:\n%s", data)
+	}
+}
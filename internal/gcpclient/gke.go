@@ -12,7 +12,7 @@ import (
 )
 
 func GetClusters(project, reason string) ([]map[string]string, error) {
-	gkeClient, err := container.NewClusterManagerClient(context.Background(), option.WithRequestReason(reason))
+	gkeClient, err := container.NewClusterManagerClient(context.Background(), clientOptions(option.WithRequestReason(reason))...)
 	if err != nil {
 		return []map[string]string{}, &errorsutil.SDKClientCreateError{Err: err, ResourceType: "Container"}
 	}
@@ -19,8 +19,25 @@ var (
 	ctx                   = context.Background()
 )
 
-// GenerateTemporaryAccessToken generates short-lived credentials for the given service account
-func GenerateTemporaryAccessToken(serviceAccountEmail, reason string) (*credentialspb.GenerateAccessTokenResponse, error) {
+// AccessTokenScopes are the default OAuth scopes of the access tokens generated
+// for service accounts
+var AccessTokenScopes = []string{
+	iam.CloudPlatformScope,
+	"https://www.googleapis.com/auth/userinfo.email",
+}
+
+// GenerateTemporaryAccessToken generates short-lived credentials for the given service account.
+// If scopes is empty, the token is generated with AccessTokenScopes. If delegates are provided,
+// the service account is impersonated through them in order. If a subject is provided, the
+// token acts as that Google Workspace user through the service account's domain-wide delegation.
+func GenerateTemporaryAccessToken(serviceAccountEmail, subject, reason string, scopes []string, delegates ...string) (*credentialspb.GenerateAccessTokenResponse, error) {
+	if len(scopes) == 0 {
+		scopes = AccessTokenScopes
+	}
+	if subject != "" {
+		return generateDelegatedAccessToken(serviceAccountEmail, subject, reason, scopes, delegates...)
+	}
+
 	client, err := ClientWithReason(reason)
 	if err != nil {
 		return nil, err
@@ -31,12 +48,10 @@ func GenerateTemporaryAccessToken(serviceAccountEmail, reason string) (*credenti
 	}
 
 	req := credentialspb.GenerateAccessTokenRequest{
-		Name:     fmt.Sprintf("projects/-/serviceAccounts/%s", serviceAccountEmail),
-		Lifetime: sessionDuration,
-		Scope: []string{
-			iam.CloudPlatformScope,
-			"https://www.googleapis.com/auth/userinfo.email",
-		},
+		Name:      fmt.Sprintf("projects/-/serviceAccounts/%s", serviceAccountEmail),
+		Delegates: delegateNames(delegates),
+		Lifetime:  sessionDuration,
+		Scope:     scopes,
 	}
 
 	resp, err := client.GenerateAccessToken(ctx, &req)
@@ -47,6 +62,74 @@ func GenerateTemporaryAccessToken(serviceAccountEmail, reason string) (*credenti
 	return resp, nil
 }
 
+// GenerateIDToken generates an OpenID Connect ID token for the given service
+// account with the provided audience. If includeEmail is true, the token has
+// the email and email_verified claims.
+func GenerateIDToken(serviceAccountEmail, audience, reason string, includeEmail bool, delegates ...string) (*credentialspb.GenerateIdTokenResponse, error) {
+	client, err := ClientWithReason(reason)
+	if err != nil {
+		return nil, err
+	}
+
+	req := credentialspb.GenerateIdTokenRequest{
+		Name:         fmt.Sprintf("projects/-/serviceAccounts/%s", serviceAccountEmail),
+		Delegates:    delegateNames(delegates),
+		Audience:     audience,
+		IncludeEmail: includeEmail,
+	}
+
+	resp, err := client.GenerateIdToken(ctx, &req)
+	if err != nil {
+		util.Logger.Errorf("Failed to generate ID token for service account %s", serviceAccountEmail)
+		return nil, err
+	}
+	return resp, nil
+}
+
+// SignJwt signs a JWT with the given claims using a system-managed key of the
+// given service account. The claims must be a JSON object.
+func SignJwt(serviceAccountEmail, claims, reason string, delegates ...string) (*credentialspb.SignJwtResponse, error) {
+	client, err := ClientWithReason(reason)
+	if err != nil {
+		return nil, err
+	}
+
+	req := credentialspb.SignJwtRequest{
+		Name:      fmt.Sprintf("projects/-/serviceAccounts/%s", serviceAccountEmail),
+		Delegates: delegateNames(delegates),
+		Payload:   claims,
+	}
+
+	resp, err := client.SignJwt(ctx, &req)
+	if err != nil {
+		util.Logger.Errorf("Failed to sign JWT with service account %s", serviceAccountEmail)
+		return nil, err
+	}
+	return resp, nil
+}
+
+// SignBlob signs the given bytes using a system-managed key of the given
+// service account
+func SignBlob(serviceAccountEmail string, payload []byte, reason string, delegates ...string) (*credentialspb.SignBlobResponse, error) {
+	client, err := ClientWithReason(reason)
+	if err != nil {
+		return nil, err
+	}
+
+	req := credentialspb.SignBlobRequest{
+		Name:      fmt.Sprintf("projects/-/serviceAccounts/%s", serviceAccountEmail),
+		Delegates: delegateNames(delegates),
+		Payload:   payload,
+	}
+
+	resp, err := client.SignBlob(ctx, &req)
+	if err != nil {
+		util.Logger.Errorf("Failed to sign blob with service account %s", serviceAccountEmail)
+		return nil, err
+	}
+	return resp, nil
+}
+
 // GetServiceAccounts fetches each of the service accounts that the authenticated
 // user can impersonate in the active project.
 func GetServiceAccounts(project, reason string) ([]*iam.ServiceAccount, error) {
@@ -70,31 +153,101 @@ func GetServiceAccounts(project, reason string) ([]*iam.ServiceAccount, error) {
 	return serviceAccounts, nil
 }
 
+// delegateNames returns the resource names of the service accounts in a
+// delegation chain
+func delegateNames(delegates []string) []string {
+	names := make([]string, len(delegates))
+	for i, delegate := range delegates {
+		names[i] = fmt.Sprintf("projects/-/serviceAccounts/%s", delegate)
+	}
+	return names
+}
+
 // CanImpersonate checks if a given service account can be impersonated by the
-// authenticated user.
-func CanImpersonate(project, serviceAccountEmail, reason string) (bool, error) {
+// authenticated user. If delegates are provided, each hop of the delegation
+// chain is checked: the user must be able to impersonate the first delegate,
+// and each delegate must be able to impersonate the next service account in
+// the chain.
+func CanImpersonate(project, serviceAccountEmail, reason string, delegates ...string) (bool, error) {
+	return canImpersonate(project, serviceAccountEmail, reason, "iam.serviceAccounts.getAccessToken", delegates)
+}
+
+// CanGenerateAccessToken checks if the authenticated user can generate access
+// tokens for a given service account. If a subject is provided, the token is
+// generated through domain-wide delegation, which requires signing a JWT with
+// the service account's key instead.
+func CanGenerateAccessToken(project, serviceAccountEmail, subject, reason string, delegates ...string) (bool, error) {
+	if subject != "" {
+		return CanSignJwt(project, serviceAccountEmail, reason, delegates...)
+	}
+	return CanImpersonate(project, serviceAccountEmail, reason, delegates...)
+}
+
+// CanGenerateIDToken checks if the authenticated user can generate ID tokens
+// for a given service account, through the delegates if any are provided
+func CanGenerateIDToken(project, serviceAccountEmail, reason string, delegates ...string) (bool, error) {
+	return canImpersonate(project, serviceAccountEmail, reason, "iam.serviceAccounts.getOpenIdToken", delegates)
+}
+
+// CanSignJwt checks if the authenticated user can sign JWTs with a given
+// service account's key, through the delegates if any are provided
+func CanSignJwt(project, serviceAccountEmail, reason string, delegates ...string) (bool, error) {
+	return canImpersonate(project, serviceAccountEmail, reason, "iam.serviceAccounts.signJwt", delegates)
+}
+
+// CanSignBlob checks if the authenticated user can sign blobs with a given
+// service account's key, through the delegates if any are provided
+func CanSignBlob(project, serviceAccountEmail, reason string, delegates ...string) (bool, error) {
+	return canImpersonate(project, serviceAccountEmail, reason, "iam.serviceAccounts.signBlob", delegates)
+}
+
+// canImpersonate checks that each hop of the delegation chain can impersonate
+// the next one, and that the last hop has the given permission on the service
+// account
+func canImpersonate(project, serviceAccountEmail, reason, permission string, delegates []string) (bool, error) {
 	resource := fmt.Sprintf("//iam.googleapis.com/projects/%s/serviceAccounts/%s", project, serviceAccountEmail)
 	testablePerms, err := queryiam.QueryTestablePermissionsOnResource(resource)
 	if err != nil {
 		return false, err
 	}
 
-	perms, err := queryiam.QueryServiceAccountPermissions(testablePerms, project, serviceAccountEmail)
-	if err != nil {
-		return false, err
-	}
+	chain := append(append([]string{}, delegates...), serviceAccountEmail)
+	for i, email := range chain {
+		// Delegates can be in a different project than the service account
+		hopProject := "-"
+		if i == len(chain)-1 {
+			hopProject = project
+		}
+		// After the first hop, the permissions of the previous service account
+		// in the chain are tested by impersonating it through the delegates
+		// before it
+		var opts []option.ClientOption
+		caller := "You"
+		if i > 0 {
+			caller = chain[i-1]
+			opts = append(opts, option.ImpersonateCredentials(chain[i-1], chain[:i-1]...), option.WithRequestReason(reason))
+		}
 
-	// util.Logger.Debugf("Permissions on %s: \n%s\n", serviceAccountEmail, strings.Join(perms, ", "))
-	for _, permission := range perms {
-		if permission == "iam.serviceAccounts.getAccessToken" {
-			return true, nil
+		perms, err := queryiam.QueryServiceAccountPermissions(testablePerms, hopProject, email, opts...)
+		if err != nil {
+			return false, err
+		}
+		required := "iam.serviceAccounts.getAccessToken"
+		if i == len(chain)-1 {
+			required = permission
+		}
+		if !util.Contains(perms, required) {
+			if len(delegates) > 0 {
+				util.Logger.Warnf("%s cannot impersonate %s", caller, email)
+			}
+			return false, nil
 		}
 	}
-	return false, nil
+	return true, nil
 }
 
 func newServiceAccountClient(reason string) (*iam.ProjectsServiceAccountsService, error) {
-	iamService, err := iam.NewService(context.Background(), option.WithRequestReason(reason))
+	iamService, err := iam.NewService(context.Background(), clientOptions(option.WithRequestReason(reason))...)
 	if err != nil {
 		return nil, &errorsutil.SDKClientCreateError{Err: err, ResourceType: "Cloud IAM"}
 	}
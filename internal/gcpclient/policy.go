@@ -0,0 +1,78 @@
+package gcpclient
+
+import (
+	"fmt"
+	"net/http"
+
+	crm "google.golang.org/api/cloudresourcemanager/v1"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/option"
+
+	util "github.com/jessesomerville/ephemeral-iam/internal/eiamutil"
+	errorsutil "github.com/jessesomerville/ephemeral-iam/internal/errors"
+	"github.com/jessesomerville/ephemeral-iam/internal/grant"
+)
+
+// policyUpdateAttempts is how many times a policy update is tried when the
+// policy is changed by someone else at the same time
+const policyUpdateAttempts = 3
+
+// UpdateIamPolicy reads the IAM policy of a project or organization, applies
+// update to it, and writes it back if update returns true. The policy is read
+// as a version 3 policy so that conditional bindings are preserved.
+func UpdateIamPolicy(resource, reason string, update func(*crm.Policy) bool) error {
+	kind, id, err := grant.ParseResource(resource)
+	if err != nil {
+		return errorsutil.EiamError{
+			Log: util.Logger.WithError(err),
+			Msg: "Invalid resource",
+			Err: err,
+		}
+	}
+	crmService, err := crm.NewService(ctx, clientOptions(option.WithRequestReason(reason))...)
+	if err != nil {
+		return &errorsutil.SDKClientCreateError{Err: err, ResourceType: "Cloud Resource Manager"}
+	}
+
+	getReq := &crm.GetIamPolicyRequest{Options: &crm.GetPolicyOptions{RequestedPolicyVersion: 3}}
+	for attempt := 1; ; attempt++ {
+		var policy *crm.Policy
+		if kind == "projects" {
+			policy, err = crmService.Projects.GetIamPolicy(id, getReq).Do()
+		} else {
+			policy, err = crmService.Organizations.GetIamPolicy(resource, getReq).Do()
+		}
+		if err != nil {
+			return errorsutil.EiamError{
+				Log: util.Logger.WithError(err),
+				Msg: fmt.Sprintf("Failed to get the IAM policy of %s", resource),
+				Err: err,
+			}
+		}
+
+		if !update(policy) {
+			return nil
+		}
+
+		// The policy's etag makes the update fail if the policy was changed
+		// since it was read
+		setReq := &crm.SetIamPolicyRequest{Policy: policy}
+		if kind == "projects" {
+			_, err = crmService.Projects.SetIamPolicy(id, setReq).Do()
+		} else {
+			_, err = crmService.Organizations.SetIamPolicy(resource, setReq).Do()
+		}
+		if apiErr, ok := err.(*googleapi.Error); ok && apiErr.Code == http.StatusConflict && attempt < policyUpdateAttempts {
+			util.Logger.Debugf("The IAM policy of %s changed while it was being updated, retrying", resource)
+			continue
+		}
+		if err != nil {
+			return errorsutil.EiamError{
+				Log: util.Logger.WithError(err),
+				Msg: fmt.Sprintf("Failed to update the IAM policy of %s", resource),
+				Err: err,
+			}
+		}
+		return nil
+	}
+}
@@ -20,12 +20,31 @@ var (
 	ctx = context.Background()
 
 	wg sync.WaitGroup
+
+	// credentialsFile is the credentials file that the clients are
+	// authenticated with, or empty to use the application default credentials
+	credentialsFile string
 )
 
+// SetCredentialsFile authenticates the clients with the given credentials file
+// instead of the application default credentials
+func SetCredentialsFile(path string) {
+	credentialsFile = path
+}
+
+// clientOptions returns the options that authenticate a client with the
+// configured credentials followed by opts
+func clientOptions(opts ...option.ClientOption) []option.ClientOption {
+	if credentialsFile == "" {
+		return opts
+	}
+	return append([]option.ClientOption{option.WithCredentialsFile(credentialsFile)}, opts...)
+}
+
 // QueryTestablePermissionsOnResource gets the testable permissions on a resource
 // Modified from https://github.com/salrashid123/gcp_iam/blob/main/query/main.go#L71-L108
 func QueryTestablePermissionsOnResource(resource string) ([]string, error) {
-	iamService, err := iam.NewService(ctx)
+	iamService, err := iam.NewService(ctx, clientOptions()...)
 	if err != nil {
 		return []string{}, &errorsutil.SDKClientCreateError{Err: err, ResourceType: "Cloud IAM"}
 	}
@@ -67,14 +86,14 @@ func QueryTestablePermissionsOnResource(resource string) ([]string, error) {
 func QueryComputeInstancePermissions(permsToTest []string, project, zone, instance, serviceAccountEmail, reason string) ([]string, error) {
 	var computeService *compute.Service
 	if serviceAccountEmail != "" {
-		clientOptions := []option.ClientOption{option.ImpersonateCredentials(serviceAccountEmail), option.WithRequestReason(reason)}
-		if svc, err := compute.NewService(ctx, clientOptions...); err == nil {
+		impersonateOptions := []option.ClientOption{option.ImpersonateCredentials(serviceAccountEmail), option.WithRequestReason(reason)}
+		if svc, err := compute.NewService(ctx, clientOptions(impersonateOptions...)...); err == nil {
 			computeService = svc
 		} else {
 			return []string{}, &errorsutil.SDKClientCreateError{Err: err, ResourceType: "Compute", ServiceAccount: serviceAccountEmail}
 		}
 	} else {
-		if svc, err := compute.NewService(ctx); err == nil {
+		if svc, err := compute.NewService(ctx, clientOptions()...); err == nil {
 			computeService = svc
 		} else {
 			return []string{}, &errorsutil.SDKClientCreateError{Err: err, ResourceType: "Compute"}
@@ -106,14 +125,14 @@ func QueryComputeInstancePermissions(permsToTest []string, project, zone, instan
 func QueryProjectPermissions(permsToTest []string, project, serviceAccountEmail, reason string) (perms []string, err error) {
 	var crmService *crm.Service
 	if serviceAccountEmail != "" {
-		clientOptions := []option.ClientOption{option.ImpersonateCredentials(serviceAccountEmail), option.WithRequestReason(reason)}
-		if svc, err := crm.NewService(ctx, clientOptions...); err == nil {
+		impersonateOptions := []option.ClientOption{option.ImpersonateCredentials(serviceAccountEmail), option.WithRequestReason(reason)}
+		if svc, err := crm.NewService(ctx, clientOptions(impersonateOptions...)...); err == nil {
 			crmService = svc
 		} else {
 			return []string{}, &errorsutil.SDKClientCreateError{Err: err, ResourceType: "Cloud Resource Manager", ServiceAccount: serviceAccountEmail}
 		}
 	} else {
-		if svc, err := crm.NewService(ctx); err == nil {
+		if svc, err := crm.NewService(ctx, clientOptions()...); err == nil {
 			crmService = svc
 		} else {
 			return []string{}, &errorsutil.SDKClientCreateError{Err: err, ResourceType: "Cloud Resource Manager"}
@@ -159,14 +178,14 @@ func QueryProjectPermissions(permsToTest []string, project, serviceAccountEmail,
 func QueryPubSubPermissions(permsToTest []string, project, topic, serviceAccountEmail, reason string) ([]string, error) {
 	var pubsubService *pubsub.Service
 	if serviceAccountEmail != "" {
-		clientOptions := []option.ClientOption{option.ImpersonateCredentials(serviceAccountEmail), option.WithRequestReason(reason)}
-		if svc, err := pubsub.NewService(ctx, clientOptions...); err == nil {
+		impersonateOptions := []option.ClientOption{option.ImpersonateCredentials(serviceAccountEmail), option.WithRequestReason(reason)}
+		if svc, err := pubsub.NewService(ctx, clientOptions(impersonateOptions...)...); err == nil {
 			pubsubService = svc
 		} else {
 			return []string{}, &errorsutil.SDKClientCreateError{Err: err, ResourceType: "PubSub", ServiceAccount: serviceAccountEmail}
 		}
 	} else {
-		if svc, err := pubsub.NewService(ctx); err == nil {
+		if svc, err := pubsub.NewService(ctx, clientOptions()...); err == nil {
 			pubsubService = svc
 		} else {
 			return []string{}, &errorsutil.SDKClientCreateError{Err: err, ResourceType: "PubSub"}
@@ -192,8 +211,8 @@ func QueryPubSubPermissions(permsToTest []string, project, topic, serviceAccount
 
 // QueryServiceAccountPermissions gets the authenticated members permissions on a service account
 // Modified from https://github.com/salrashid123/gcp_iam/blob/main/query/main.go#L150-L173
-func QueryServiceAccountPermissions(permsToTest []string, project, email string) ([]string, error) {
-	iamService, err := iam.NewService(ctx)
+func QueryServiceAccountPermissions(permsToTest []string, project, email string, opts ...option.ClientOption) ([]string, error) {
+	iamService, err := iam.NewService(ctx, clientOptions(opts...)...)
 	if err != nil {
 		return []string{}, &errorsutil.SDKClientCreateError{Err: err, ResourceType: "Cloud IAM"}
 	}
@@ -215,14 +234,14 @@ func QueryServiceAccountPermissions(permsToTest []string, project, email string)
 func QueryStorageBucketPermissions(permsToTest []string, bucket, serviceAccountEmail, reason string) ([]string, error) {
 	var storageService *storage.Service
 	if serviceAccountEmail != "" {
-		clientOptions := []option.ClientOption{option.ImpersonateCredentials(serviceAccountEmail), option.WithRequestReason(reason)}
-		if svc, err := storage.NewService(ctx, clientOptions...); err == nil {
+		impersonateOptions := []option.ClientOption{option.ImpersonateCredentials(serviceAccountEmail), option.WithRequestReason(reason)}
+		if svc, err := storage.NewService(ctx, clientOptions(impersonateOptions...)...); err == nil {
 			storageService = svc
 		} else {
 			return []string{}, &errorsutil.SDKClientCreateError{Err: err, ResourceType: "Cloud Storage", ServiceAccount: serviceAccountEmail}
 		}
 	} else {
-		if svc, err := storage.NewService(ctx); err == nil {
+		if svc, err := storage.NewService(ctx, clientOptions()...); err == nil {
 			storageService = svc
 		} else {
 			return []string{}, &errorsutil.SDKClientCreateError{Err: err, ResourceType: "Cloud Storage"}
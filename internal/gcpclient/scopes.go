@@ -0,0 +1,89 @@
+package gcpclient
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// scopePrefix is the prefix of the URL of every OAuth scope except openid
+const scopePrefix = "https://www.googleapis.com/auth/"
+
+// KnownScopes are the OAuth scopes that access tokens can be generated with.
+// Scopes can be referred to by their full URL or by the part of the URL after
+// https://www.googleapis.com/auth/.
+var KnownScopes = []string{
+	"admin.directory.group",
+	"admin.directory.group.readonly",
+	"admin.directory.user",
+	"admin.directory.user.readonly",
+	"bigquery",
+	"bigquery.readonly",
+	"calendar",
+	"calendar.readonly",
+	"cloud-platform",
+	"cloud-platform.read-only",
+	"compute",
+	"compute.readonly",
+	"devstorage.full_control",
+	"devstorage.read_only",
+	"devstorage.read_write",
+	"documents",
+	"documents.readonly",
+	"drive",
+	"drive.file",
+	"drive.readonly",
+	"gmail.readonly",
+	"gmail.send",
+	"logging.read",
+	"logging.write",
+	"monitoring",
+	"monitoring.read",
+	"ndev.clouddns.readwrite",
+	"openid",
+	"pubsub",
+	"spreadsheets",
+	"spreadsheets.readonly",
+	"sqlservice.admin",
+	"trace.append",
+	"userinfo.email",
+	"userinfo.profile",
+}
+
+// ResolveScopes validates the provided scopes against KnownScopes and returns
+// their full URLs, without duplicates
+func ResolveScopes(scopes []string) ([]string, error) {
+	known := make(map[string]bool, len(KnownScopes))
+	for _, scope := range KnownScopes {
+		known[scope] = true
+	}
+
+	resolved := []string{}
+	seen := map[string]bool{}
+	var unknown []string
+	for _, scope := range scopes {
+		name := strings.TrimPrefix(strings.TrimSpace(scope), scopePrefix)
+		if !known[name] {
+			unknown = append(unknown, scope)
+			continue
+		}
+		url := scopePrefix + name
+		if name == "openid" {
+			url = name
+		}
+		if !seen[url] {
+			seen[url] = true
+			resolved = append(resolved, url)
+		}
+	}
+
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return nil, fmt.Errorf("unknown OAuth scopes %s, the supported scopes are: %s",
+			strings.Join(unknown, ", "), strings.Join(KnownScopes, ", "))
+	}
+	if len(resolved) == 0 {
+		return nil, fmt.Errorf("at least one OAuth scope is required")
+	}
+	return resolved, nil
+}
@@ -0,0 +1,59 @@
+package gcpclient
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestResolveScopes(t *testing.T) {
+	tests := []struct {
+		name    string
+		scopes  []string
+		want    []string
+		wantErr bool
+	}{
+		{
+			name:   "short names",
+			scopes: []string{"cloud-platform", "drive.readonly", "openid"},
+			want: []string{
+				"https://www.googleapis.com/auth/cloud-platform",
+				"https://www.googleapis.com/auth/drive.readonly",
+				"openid",
+			},
+		},
+		{
+			name:   "full URLs and duplicates",
+			scopes: []string{"https://www.googleapis.com/auth/spreadsheets", "spreadsheets", " userinfo.email "},
+			want: []string{
+				"https://www.googleapis.com/auth/spreadsheets",
+				"https://www.googleapis.com/auth/userinfo.email",
+			},
+		},
+		{
+			name:    "unknown scope",
+			scopes:  []string{"cloud-platform", "https://www.googleapis.com/auth/not-a-scope"},
+			wantErr: true,
+		},
+		{
+			name:    "unknown host",
+			scopes:  []string{"https://example.com/auth/cloud-platform"},
+			wantErr: true,
+		},
+		{
+			name:    "no scopes",
+			scopes:  []string{},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ResolveScopes(tt.scopes)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ResolveScopes(%q) error = %v, wantErr %t", tt.scopes, err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ResolveScopes(%q) = %q, want %q", tt.scopes, got, tt.want)
+			}
+		})
+	}
+}
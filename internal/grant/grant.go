@@ -0,0 +1,224 @@
+// Package grant manages time-bound IAM role grants. Instead of impersonating a
+// service account, the user is granted a role on a resource through an IAM
+// binding with a condition that stops matching once the grant expires, so
+// audit logs show the user's own identity. Grants are recorded locally so that
+// they can be revoked, and their bindings removed once they expire.
+package grant
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	crm "google.golang.org/api/cloudresourcemanager/v1"
+)
+
+const (
+	// titlePrefix is the prefix of the title of every condition that eiam adds
+	titlePrefix = "eiam-grant-"
+	// maxDescriptionLength is the maximum length of an IAM condition's
+	// description
+	maxDescriptionLength = 256
+)
+
+// Grant is a role that was granted to a member on a resource until Expiry
+type Grant struct {
+	ID       string    `json:"id"`
+	Role     string    `json:"role"`
+	Resource string    `json:"resource"`
+	Member   string    `json:"member"`
+	Reason   string    `json:"reason"`
+	Created  time.Time `json:"created"`
+	Expiry   time.Time `json:"expiry"`
+}
+
+// New returns a grant of the role on the resource to the member that expires
+// after the duration
+func New(role, resource, member, reason string, duration time.Duration) (*Grant, error) {
+	if !strings.HasPrefix(role, "roles/") && !strings.Contains(role, "/roles/") {
+		return nil, fmt.Errorf("%q is not a role, it must have the form roles/ROLE, projects/PROJECT/roles/ROLE or organizations/ORGANIZATION/roles/ROLE", role)
+	}
+	if _, _, err := ParseResource(resource); err != nil {
+		return nil, err
+	}
+	id := make([]byte, 4)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	now := time.Now().UTC().Truncate(time.Second)
+	return &Grant{
+		ID:       hex.EncodeToString(id),
+		Role:     role,
+		Resource: resource,
+		Member:   member,
+		Reason:   reason,
+		Created:  now,
+		Expiry:   now.Add(duration),
+	}, nil
+}
+
+// Expired returns true if the grant's condition no longer matches
+func (g *Grant) Expired(now time.Time) bool {
+	return !now.Before(g.Expiry)
+}
+
+// Condition returns the IAM condition that limits the grant's binding to the
+// time before the grant expires
+func (g *Grant) Condition() *crm.Expr {
+	description := g.Reason
+	if len(description) > maxDescriptionLength {
+		// Cut on a rune boundary so the description stays valid UTF-8
+		end := maxDescriptionLength
+		for end > 0 && !utf8.RuneStart(description[end]) {
+			end--
+		}
+		description = description[:end]
+	}
+	return &crm.Expr{
+		Title:       titlePrefix + g.ID,
+		Description: description,
+		Expression:  fmt.Sprintf("request.time < timestamp(%q)", g.Expiry.UTC().Format(time.RFC3339)),
+	}
+}
+
+// ParseResource returns the type and ID of a resource that grants can be made
+// on, which is either projects/PROJECT_ID or organizations/ORGANIZATION_ID
+func ParseResource(resource string) (kind, id string, err error) {
+	parts := strings.Split(strings.TrimPrefix(resource, "//cloudresourcemanager.googleapis.com/"), "/")
+	if len(parts) == 2 && parts[1] != "" && (parts[0] == "projects" || parts[0] == "organizations") {
+		return parts[0], parts[1], nil
+	}
+	return "", "", fmt.Errorf("%q is not a supported resource, it must have the form projects/PROJECT_ID or organizations/ORGANIZATION_ID", resource)
+}
+
+// AddBinding adds the grant's conditional binding to the policy. Conditional
+// bindings require version 3 policies.
+func AddBinding(policy *crm.Policy, g *Grant) {
+	policy.Version = 3
+	policy.Bindings = append(policy.Bindings, &crm.Binding{
+		Role:      g.Role,
+		Members:   []string{g.Member},
+		Condition: g.Condition(),
+	})
+}
+
+// RemoveBinding removes the grant's member from the bindings that have the
+// grant's condition, and drops the bindings that are left without members. It
+// returns false if the policy doesn't have the grant's binding.
+func RemoveBinding(policy *crm.Policy, g *Grant) bool {
+	title := titlePrefix + g.ID
+	removed := false
+	bindings := policy.Bindings[:0]
+	for _, binding := range policy.Bindings {
+		if binding.Role == g.Role && binding.Condition != nil && binding.Condition.Title == title {
+			members := binding.Members[:0]
+			for _, member := range binding.Members {
+				if member == g.Member {
+					removed = true
+					continue
+				}
+				members = append(members, member)
+			}
+			binding.Members = members
+			if len(members) == 0 {
+				continue
+			}
+		}
+		bindings = append(bindings, binding)
+	}
+	policy.Bindings = bindings
+	policy.Version = 3
+	return removed
+}
+
+// Store records the grants that were made in a file, so that they can be
+// revoked later
+type Store struct {
+	path string
+	mu   sync.Mutex
+}
+
+// NewStore returns a store that records grants in the file at path
+func NewStore(path string) *Store {
+	return &Store{path: path}
+}
+
+// List returns the recorded grants, ordered by expiry
+func (s *Store) List() ([]*Grant, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.read()
+}
+
+// Get returns the recorded grant with the given ID
+func (s *Store) Get(id string) (*Grant, error) {
+	grants, err := s.List()
+	if err != nil {
+		return nil, err
+	}
+	for _, g := range grants {
+		if g.ID == id {
+			return g, nil
+		}
+	}
+	return nil, fmt.Errorf("no grant with ID %s", id)
+}
+
+// Add records a grant
+func (s *Store) Add(g *Grant) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	grants, err := s.read()
+	if err != nil {
+		return err
+	}
+	return s.write(append(grants, g))
+}
+
+// Remove deletes the record of the grant with the given ID
+func (s *Store) Remove(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	grants, err := s.read()
+	if err != nil {
+		return err
+	}
+	kept := grants[:0]
+	for _, g := range grants {
+		if g.ID != id {
+			kept = append(kept, g)
+		}
+	}
+	return s.write(kept)
+}
+
+func (s *Store) read() ([]*Grant, error) {
+	data, err := ioutil.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return []*Grant{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	grants := []*Grant{}
+	if err := json.Unmarshal(data, &grants); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %v", s.path, err)
+	}
+	sort.Slice(grants, func(i, j int) bool { return grants[i].Expiry.Before(grants[j].Expiry) })
+	return grants, nil
+}
+
+func (s *Store) write(grants []*Grant) error {
+	data, err := json.MarshalIndent(grants, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(s.path, data, 0o600)
+}
@@ -0,0 +1,121 @@
+package grant
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	crm "google.golang.org/api/cloudresourcemanager/v1"
+)
+
+func TestBinding(t *testing.T) {
+	g, err := New("roles/storage.admin", "projects/my-project", "user:alice@example.com", "ephemeral-iam abc123: JIRA-1234", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "request.time < timestamp(\"" + g.Expiry.Format(time.RFC3339) + "\")"
+	if got := g.Condition().Expression; got != want {
+		t.Errorf("condition = %s, want %s", got, want)
+	}
+
+	viewer := &crm.Binding{Role: "roles/viewer", Members: []string{"user:alice@example.com"}}
+	policy := &crm.Policy{Version: 1, Bindings: []*crm.Binding{viewer}}
+	AddBinding(policy, g)
+	if policy.Version != 3 || len(policy.Bindings) != 2 {
+		t.Fatalf("unexpected policy after adding the grant: version %d, %d bindings", policy.Version, len(policy.Bindings))
+	}
+
+	// Another grant of the same role isn't affected
+	other, _ := New("roles/storage.admin", "projects/my-project", "user:alice@example.com", "r", time.Hour)
+	if RemoveBinding(policy, other) {
+		t.Error("removed the binding of a different grant")
+	}
+	if !RemoveBinding(policy, g) {
+		t.Error("the grant's binding was not found")
+	}
+	if len(policy.Bindings) != 1 || policy.Bindings[0] != viewer {
+		t.Errorf("unexpected bindings after removing the grant: %+v", policy.Bindings)
+	}
+}
+
+func TestConditionDescription(t *testing.T) {
+	// 'é' is two bytes, so byte 256 falls in the middle of a rune
+	reason := "x" + strings.Repeat("é", 200)
+	g, err := New("roles/viewer", "projects/my-project", "user:alice@example.com", reason, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	description := g.Condition().Description
+	if !utf8.ValidString(description) {
+		t.Errorf("description is not valid UTF-8: %q", description)
+	}
+	if len(description) != 255 || !strings.HasPrefix(reason, description) {
+		t.Errorf("description is %d bytes, want the first 255 bytes of the reason", len(description))
+	}
+}
+
+func TestNewInvalid(t *testing.T) {
+	tests := []struct {
+		name, role, resource string
+	}{
+		{"not a role", "storage.admin", "projects/my-project"},
+		{"folder", "roles/viewer", "folders/123"},
+		{"bucket", "roles/viewer", "//storage.googleapis.com/projects/_/buckets/b"},
+		{"missing ID", "roles/viewer", "projects/"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := New(tt.role, tt.resource, "user:alice@example.com", "r", time.Hour); err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+	if _, err := New("organizations/123/roles/custom", "//cloudresourcemanager.googleapis.com/organizations/123", "user:alice@example.com", "r", time.Hour); err != nil {
+		t.Errorf("unexpected error for a custom organization role: %v", err)
+	}
+}
+
+func TestStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "eiam-grant")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store := NewStore(filepath.Join(dir, "grants.json"))
+
+	if grants, err := store.List(); err != nil || len(grants) != 0 {
+		t.Fatalf("List() = %v, %v for a new store, want no grants", grants, err)
+	}
+	long, _ := New("roles/viewer", "projects/p", "user:alice@example.com", "r", time.Hour)
+	short, _ := New("roles/editor", "projects/p", "user:alice@example.com", "r", time.Minute)
+	for _, g := range []*Grant{long, short} {
+		if err := store.Add(g); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	grants, err := store.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(grants) != 2 || grants[0].ID != short.ID {
+		t.Errorf("grants are not ordered by expiry: %+v", grants)
+	}
+	if grants[0].Expired(time.Now()) || !grants[0].Expired(short.Expiry) {
+		t.Error("grant expiry is wrong")
+	}
+
+	if err := store.Remove(short.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Get(short.ID); err == nil {
+		t.Error("removed grant is still recorded")
+	}
+	if g, err := store.Get(long.ID); err != nil || g.Role != "roles/viewer" {
+		t.Errorf("Get() = %+v, %v", g, err)
+	}
+}
@@ -0,0 +1,102 @@
+// Package idtoken authenticates requests to services that are protected by
+// Identity-Aware Proxy or Cloud Run authentication with a service account's
+// OpenID Connect ID tokens.
+package idtoken
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// refreshMargin is how long before the cached ID token expires that a new one
+// is generated
+var refreshMargin = time.Minute
+
+// GenerateFunc generates a new ID token
+type GenerateFunc func() (string, error)
+
+// Source caches an ID token and generates a new one shortly before it expires
+type Source struct {
+	generate GenerateFunc
+
+	mu     sync.Mutex
+	token  string
+	expiry time.Time
+}
+
+// NewSource returns a Source that generates ID tokens with the given function
+func NewSource(generate GenerateFunc) *Source {
+	return &Source{generate: generate}
+}
+
+// Token returns a valid ID token
+func (s *Source) Token() (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.token != "" && time.Now().Add(refreshMargin).Before(s.expiry) {
+		return s.token, nil
+	}
+	token, err := s.generate()
+	if err != nil {
+		return "", err
+	}
+	expiry, err := Expiry(token)
+	if err != nil {
+		return "", err
+	}
+	s.token, s.expiry = token, expiry
+	return token, nil
+}
+
+// Expiry returns when an ID token expires. The token's signature is not
+// verified.
+func Expiry(token string) (time.Time, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return time.Time{}, fmt.Errorf("ID token is not a JWT")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to decode ID token payload: %v", err)
+	}
+	var claims struct {
+		Exp int64 `json:"exp"`
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return time.Time{}, fmt.Errorf("failed to parse ID token claims: %v", err)
+	}
+	if claims.Exp == 0 {
+		return time.Time{}, fmt.Errorf("ID token has no exp claim")
+	}
+	return time.Unix(claims.Exp, 0), nil
+}
+
+// NewProxy returns a reverse proxy to target that adds an ID token from the
+// source to the Authorization header of every request
+func NewProxy(target *url.URL, source *Source) http.Handler {
+	rp := httputil.NewSingleHostReverseProxy(target)
+	director := rp.Director
+	rp.Director = func(r *http.Request) {
+		director(r)
+		// Cloud Run and IAP route requests by their Host header
+		r.Host = target.Host
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, err := source.Token()
+		if err != nil {
+			http.Error(w, fmt.Sprintf("ephemeral-iam: failed to generate ID token: %v", err), http.StatusBadGateway)
+			return
+		}
+		r.Header.Set("Authorization", "Bearer "+token)
+		rp.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,105 @@
+package idtoken
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// testToken returns an unsigned JWT that expires at the given time
+func testToken(id int, exp time.Time) string {
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"RS256","typ":"JWT"}`))
+	payload := base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf(`{"aud":"test","exp":%d,"jti":"%d"}`, exp.Unix(), id)))
+	return fmt.Sprintf("%s.%s.signature", header, payload)
+}
+
+func TestSourceCachesToken(t *testing.T) {
+	generated := 0
+	expiry := time.Now().Add(time.Hour)
+	source := NewSource(func() (string, error) {
+		generated++
+		return testToken(generated, expiry), nil
+	})
+
+	for i := 0; i < 3; i++ {
+		token, err := source.Token()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if token != testToken(1, expiry) {
+			t.Errorf("Token() = %q, want the first generated token", token)
+		}
+	}
+	if generated != 1 {
+		t.Errorf("generated %d tokens, want 1", generated)
+	}
+
+	// A token that expires within the refresh margin is replaced
+	expiry = time.Now().Add(refreshMargin / 2)
+	source.expiry = expiry
+	if _, err := source.Token(); err != nil {
+		t.Fatal(err)
+	}
+	if generated != 2 {
+		t.Errorf("generated %d tokens, want 2", generated)
+	}
+}
+
+func TestExpiry(t *testing.T) {
+	exp := time.Unix(1700000000, 0)
+	if got, err := Expiry(testToken(1, exp)); err != nil || !got.Equal(exp) {
+		t.Errorf("Expiry() = %v, %v, want %v", got, err, exp)
+	}
+	for _, token := range []string{"", "not-a-jwt", "a.!!!.c", "a." + base64.RawURLEncoding.EncodeToString([]byte(`{}`)) + ".c"} {
+		if _, err := Expiry(token); err == nil {
+			t.Errorf("Expiry(%q) returned no error", token)
+		}
+	}
+}
+
+func TestProxy(t *testing.T) {
+	token := testToken(1, time.Now().Add(time.Hour))
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if got := r.Header.Get("Authorization"); got != "Bearer "+token {
+			http.Error(w, "bad token", http.StatusUnauthorized)
+			return
+		}
+		fmt.Fprintf(w, "%s %s", r.Host, r.URL.Path)
+	}))
+	defer backend.Close()
+	target, _ := url.Parse(backend.URL)
+
+	proxy := httptest.NewServer(NewProxy(target, NewSource(func() (string, error) {
+		return token, nil
+	})))
+	defer proxy.Close()
+
+	resp, err := http.Get(proxy.URL + "/healthz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if want := target.Host + " /healthz"; resp.StatusCode != http.StatusOK || string(body) != want {
+		t.Errorf("got %d %q, want 200 %q", resp.StatusCode, body, want)
+	}
+
+	failing := httptest.NewServer(NewProxy(target, NewSource(func() (string, error) {
+		return "", errors.New("permission denied")
+	})))
+	defer failing.Close()
+	resp, err = http.Get(failing.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadGateway {
+		t.Errorf("status = %d, want %d when the token cannot be generated", resp.StatusCode, http.StatusBadGateway)
+	}
+}
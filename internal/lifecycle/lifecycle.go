@@ -0,0 +1,161 @@
+// Package lifecycle tears down a privileged session exactly once, whether it
+// ends normally, is killed by a signal, or exits through a fatal log entry.
+package lifecycle
+
+import (
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+
+	"github.com/sirupsen/logrus"
+
+	util "github.com/jessesomerville/ephemeral-iam/internal/eiamutil"
+)
+
+// Signals are the signals that end a privileged session
+var Signals = []os.Signal{
+	os.Interrupt,
+	syscall.SIGTERM,
+	syscall.SIGHUP,
+	syscall.SIGQUIT,
+}
+
+// terminalSignals are the signals that the terminal sends to every process in
+// its foreground process group when CTRL+C or CTRL+\ is pressed
+var terminalSignals = map[os.Signal]bool{
+	os.Interrupt:    true,
+	syscall.SIGQUIT: true,
+}
+
+type cleanupStep struct {
+	name string
+	fn   func() error
+}
+
+// Manager traps the signals that end a privileged session, forwards them to
+// the session's child process, and runs the session's cleanup chain
+type Manager struct {
+	mu       sync.Mutex
+	steps    []cleanupStep
+	child    *os.Process
+	received os.Signal
+	// foreground is set if the child shares eiam's foreground process group
+	foreground bool
+
+	signals     chan os.Signal
+	done        chan struct{}
+	doneOnce    sync.Once
+	cleanupOnce sync.Once
+	stopOnce    sync.Once
+}
+
+// New returns a Manager. Signals are not trapped until Start is called.
+func New() *Manager {
+	return &Manager{
+		signals: make(chan os.Signal, 1),
+		done:    make(chan struct{}),
+	}
+}
+
+// Start traps the session signals and makes fatal log entries run the
+// cleanup chain before the process exits
+func (m *Manager) Start() {
+	signal.Notify(m.signals, Signals...)
+	logrus.RegisterExitHandler(m.Cleanup)
+
+	go func() {
+		for sig := range m.signals {
+			m.handleSignal(sig)
+		}
+	}()
+}
+
+// Stop stops trapping signals. It does not run the cleanup chain.
+func (m *Manager) Stop() {
+	m.stopOnce.Do(func() {
+		signal.Stop(m.signals)
+		close(m.signals)
+	})
+}
+
+// OnCleanup adds a step to the cleanup chain. Like deferred functions, steps
+// are run in the reverse order that they were added so that resources are torn
+// down in the reverse order that they were set up.
+func (m *Manager) OnCleanup(name string, fn func() error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.steps = append(m.steps, cleanupStep{name: name, fn: fn})
+}
+
+// SetChild sets the process that received signals are forwarded to
+func (m *Manager) SetChild(p *os.Process) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.child = p
+	m.foreground = false
+}
+
+// SetForegroundChild sets a child process that shares eiam's terminal. Signals
+// sent by the terminal already reach the child, so they are not forwarded a
+// second time. Only the other signals, e.g. a SIGTERM sent to eiam, are.
+func (m *Manager) SetForegroundChild(p *os.Process) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.child = p
+	m.foreground = true
+}
+
+// Done returns a channel that is closed when the session should end because a
+// signal was received
+func (m *Manager) Done() <-chan struct{} {
+	return m.done
+}
+
+// Signal returns the signal that ended the session, if any
+func (m *Manager) Signal() os.Signal {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.received
+}
+
+// Cleanup runs each step of the cleanup chain. Later calls do nothing, so it
+// is safe to call from every path that ends the session. A failed step is
+// logged and does not stop the steps after it from running.
+func (m *Manager) Cleanup() {
+	m.cleanupOnce.Do(func() {
+		m.mu.Lock()
+		steps := m.steps
+		m.mu.Unlock()
+
+		for i := len(steps) - 1; i >= 0; i-- {
+			step := steps[i]
+			util.Logger.Debugf("Running cleanup step: %s", step.name)
+			if err := step.fn(); err != nil {
+				util.Logger.WithError(err).Errorf("Cleanup step failed: %s", step.name)
+			}
+		}
+	})
+}
+
+func (m *Manager) handleSignal(sig os.Signal) {
+	m.mu.Lock()
+	child := m.child
+	if m.foreground && terminalSignals[sig] {
+		child = nil
+	}
+	if m.received == nil {
+		m.received = sig
+	}
+	m.mu.Unlock()
+
+	util.Logger.Debugf("Received %s, ending privileged session", sig)
+	if child != nil {
+		if err := child.Signal(sig); err != nil && err != os.ErrProcessDone {
+			util.Logger.WithError(err).Debugf("Failed to forward %s to child process %d", sig, child.Pid)
+		}
+	}
+	m.doneOnce.Do(func() {
+		close(m.done)
+	})
+}
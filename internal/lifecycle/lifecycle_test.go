@@ -0,0 +1,176 @@
+package lifecycle
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"reflect"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	util "github.com/jessesomerville/ephemeral-iam/internal/eiamutil"
+)
+
+func TestMain(m *testing.M) {
+	util.Logger = logrus.New()
+	util.Logger.Out = ioutil.Discard
+	os.Exit(m.Run())
+}
+
+func TestSignalEndsSession(t *testing.T) {
+	for _, sig := range Signals {
+		sig := sig
+		t.Run(sig.String(), func(t *testing.T) {
+			child := exec.Command("sleep", "30")
+			if err := child.Start(); err != nil {
+				t.Fatalf("failed to start child process: %v", err)
+			}
+			defer child.Process.Kill()
+
+			var ran []string
+			m := New()
+			m.OnCleanup("first", func() error {
+				ran = append(ran, "first")
+				return nil
+			})
+			m.OnCleanup("second", func() error {
+				ran = append(ran, "second")
+				return nil
+			})
+			m.SetChild(child.Process)
+			m.Start()
+			defer m.Stop()
+
+			if err := syscall.Kill(os.Getpid(), sig.(syscall.Signal)); err != nil {
+				t.Fatalf("failed to send %s: %v", sig, err)
+			}
+
+			select {
+			case <-m.Done():
+			case <-time.After(5 * time.Second):
+				t.Fatalf("session was not ended by %s", sig)
+			}
+			if got := m.Signal(); got != sig {
+				t.Errorf("Signal() = %v, want %v", got, sig)
+			}
+
+			// The signal is forwarded to the child process
+			err := child.Wait()
+			var exitErr *exec.ExitError
+			if !errors.As(err, &exitErr) {
+				t.Fatalf("child process exited with %v, want it to be killed by %s", err, sig)
+			}
+			status := exitErr.Sys().(syscall.WaitStatus)
+			if !status.Signaled() || status.Signal() != sig {
+				t.Errorf("child process exited with %v, want it to be killed by %s", status, sig)
+			}
+
+			// The cleanup chain runs once, in reverse order
+			m.Cleanup()
+			m.Cleanup()
+			if want := []string{"second", "first"}; !reflect.DeepEqual(ran, want) {
+				t.Errorf("cleanup steps ran %v, want %v", ran, want)
+			}
+		})
+	}
+}
+
+func TestForegroundChildSignals(t *testing.T) {
+	tests := map[os.Signal]bool{
+		os.Interrupt:    false,
+		syscall.SIGQUIT: false,
+		syscall.SIGTERM: true,
+	}
+	for sig, forwarded := range tests {
+		sig, forwarded := sig, forwarded
+		t.Run(sig.String(), func(t *testing.T) {
+			child := exec.Command("sleep", "30")
+			if err := child.Start(); err != nil {
+				t.Fatalf("failed to start child process: %v", err)
+			}
+			defer child.Process.Kill()
+			exited := make(chan struct{})
+			go func() {
+				child.Wait()
+				close(exited)
+			}()
+
+			m := New()
+			m.SetForegroundChild(child.Process)
+			m.Start()
+			defer m.Stop()
+
+			// Only eiam is signalled, as if the signal was sent with kill
+			if err := syscall.Kill(os.Getpid(), sig.(syscall.Signal)); err != nil {
+				t.Fatalf("failed to send %s: %v", sig, err)
+			}
+			select {
+			case <-m.Done():
+			case <-time.After(5 * time.Second):
+				t.Fatalf("session was not ended by %s", sig)
+			}
+
+			select {
+			case <-exited:
+				if !forwarded {
+					t.Errorf("%s was forwarded to the child process", sig)
+				}
+			case <-time.After(500 * time.Millisecond):
+				if forwarded {
+					t.Errorf("%s was not forwarded to the child process", sig)
+				}
+			}
+		})
+	}
+}
+
+func TestCleanupContinuesAfterFailedStep(t *testing.T) {
+	var ran []string
+	m := New()
+	m.OnCleanup("first", func() error {
+		ran = append(ran, "first")
+		return nil
+	})
+	m.OnCleanup("failing", func() error {
+		ran = append(ran, "failing")
+		return errors.New("cleanup failed")
+	})
+	m.OnCleanup("last", func() error {
+		ran = append(ran, "last")
+		return nil
+	})
+
+	m.Cleanup()
+	if want := []string{"last", "failing", "first"}; !reflect.DeepEqual(ran, want) {
+		t.Errorf("cleanup steps ran %v, want %v", ran, want)
+	}
+}
+
+func TestCleanupWithoutSignal(t *testing.T) {
+	m := New()
+	m.Start()
+	defer m.Stop()
+
+	ran := 0
+	m.OnCleanup("step", func() error {
+		ran++
+		return nil
+	})
+	m.Cleanup()
+
+	if ran != 1 {
+		t.Errorf("cleanup step ran %d times, want 1", ran)
+	}
+	if sig := m.Signal(); sig != nil {
+		t.Errorf("Signal() = %v, want nil", sig)
+	}
+	select {
+	case <-m.Done():
+		t.Error("Done() is closed without a signal being received")
+	default:
+	}
+}
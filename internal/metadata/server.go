@@ -0,0 +1,141 @@
+// Package metadata emulates the parts of the GCE metadata server that client
+// libraries use to find credentials. Tools that are pointed at it with
+// GCE_METADATA_HOST act as the privileged session's service account.
+//
+// See https://cloud.google.com/compute/docs/metadata/overview
+package metadata
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	// EnvHost is the environment variable that client libraries read the
+	// address of the metadata server from
+	EnvHost = "GCE_METADATA_HOST"
+	// EnvIP is the environment variable that some client libraries read the
+	// address to check if the metadata server is running from
+	EnvIP = "GCE_METADATA_IP"
+)
+
+const (
+	flavorHeader = "Metadata-Flavor"
+	flavorGoogle = "Google"
+
+	serviceAccountsPath = "/computeMetadata/v1/instance/service-accounts/"
+)
+
+// TokenFunc returns the current access token of the service account and when
+// it expires
+type TokenFunc func() (string, time.Time)
+
+// Server answers metadata requests for a single service account
+type Server struct {
+	ServiceAccount string
+	Project        string
+	Scopes         []string
+	Token          TokenFunc
+}
+
+// tokenResponse is the body of a response from the token endpoint
+type tokenResponse struct {
+	AccessToken string `json:"access_token"`
+	ExpiresIn   int64  `json:"expires_in"`
+	TokenType   string `json:"token_type"`
+}
+
+// serviceAccountInfo is the body of a recursive request for a service account
+type serviceAccountInfo struct {
+	Aliases []string `json:"aliases"`
+	Email   string   `json:"email"`
+	Scopes  []string `json:"scopes"`
+}
+
+// ServeHTTP implements http.Handler
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set(flavorHeader, flavorGoogle)
+	w.Header().Set("Server", "Metadata Server for VM")
+
+	// The real metadata server rejects requests that have been forwarded by a
+	// proxy, and requests without the Metadata-Flavor header, so that it can't
+	// be reached from a browser or through server-side request forgery
+	if r.Header.Get("X-Forwarded-For") != "" || r.Header.Get(flavorHeader) != flavorGoogle {
+		http.Error(w, "Missing Metadata-Flavor:Google header.", http.StatusForbidden)
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed.", http.StatusMethodNotAllowed)
+		return
+	}
+
+	switch p := r.URL.Path; {
+	case p == "/" || p == "/computeMetadata/v1/":
+		// Client libraries request the root to check if the metadata server
+		// is available
+		writeText(w, "")
+	case p == "/computeMetadata/v1/project/project-id":
+		writeText(w, s.Project)
+	case p == serviceAccountsPath:
+		writeText(w, fmt.Sprintf("default/\n%s/\n", s.ServiceAccount))
+	case strings.HasPrefix(p, serviceAccountsPath):
+		s.serveServiceAccount(w, r, strings.TrimPrefix(p, serviceAccountsPath))
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// serveServiceAccount answers requests for the service account's details. The
+// service account can be referred to as "default" or by its email address.
+func (s *Server) serveServiceAccount(w http.ResponseWriter, r *http.Request, p string) {
+	parts := strings.SplitN(p, "/", 2)
+	if len(parts) != 2 || (parts[0] != "default" && parts[0] != s.ServiceAccount) {
+		http.NotFound(w, r)
+		return
+	}
+
+	switch parts[1] {
+	case "":
+		if r.URL.Query().Get("recursive") != "true" {
+			writeText(w, "aliases\nemail\nidentity\nscopes\ntoken\n")
+			return
+		}
+		writeJSON(w, serviceAccountInfo{
+			Aliases: []string{"default"},
+			Email:   s.ServiceAccount,
+			Scopes:  s.Scopes,
+		})
+	case "aliases":
+		writeText(w, "default\n")
+	case "email":
+		writeText(w, s.ServiceAccount)
+	case "scopes":
+		writeText(w, strings.Join(s.Scopes, "\n")+"\n")
+	case "token":
+		token, expiry := s.Token()
+		expiresIn := int64(time.Until(expiry).Seconds())
+		if expiresIn < 0 {
+			expiresIn = 0
+		}
+		writeJSON(w, tokenResponse{
+			AccessToken: token,
+			ExpiresIn:   expiresIn,
+			TokenType:   "Bearer",
+		})
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func writeText(w http.ResponseWriter, body string) {
+	w.Header().Set("Content-Type", "application/text")
+	fmt.Fprint(w, body)
+}
+
+func writeJSON(w http.ResponseWriter, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(body)
+}
@@ -0,0 +1,102 @@
+package metadata
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/compute/metadata"
+)
+
+const testServiceAccount = "example@my-project.iam.gserviceaccount.com"
+
+func newTestServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(&Server{
+		ServiceAccount: testServiceAccount,
+		Project:        "my-project",
+		Scopes:         []string{"https://www.googleapis.com/auth/cloud-platform"},
+		Token: func() (string, time.Time) {
+			return "test-token", time.Now().Add(30 * time.Minute)
+		},
+	})
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestClientLibrary(t *testing.T) {
+	srv := newTestServer(t)
+	oldHost, hadHost := os.LookupEnv(EnvHost)
+	os.Setenv(EnvHost, strings.TrimPrefix(srv.URL, "http://"))
+	defer func() {
+		if hadHost {
+			os.Setenv(EnvHost, oldHost)
+		} else {
+			os.Unsetenv(EnvHost)
+		}
+	}()
+
+	client := metadata.NewClient(srv.Client())
+	if project, err := client.ProjectID(); err != nil || project != "my-project" {
+		t.Errorf("ProjectID() = %q, %v, want my-project", project, err)
+	}
+	if email, err := client.Email(""); err != nil || email != testServiceAccount {
+		t.Errorf("Email() = %q, %v, want %s", email, err, testServiceAccount)
+	}
+	if scopes, err := client.Scopes(testServiceAccount); err != nil || len(scopes) != 1 {
+		t.Errorf("Scopes() = %v, %v, want the cloud-platform scope", scopes, err)
+	}
+
+	tokenJSON, err := client.Get("instance/service-accounts/default/token")
+	if err != nil {
+		t.Fatalf("failed to get token: %v", err)
+	}
+	var token tokenResponse
+	if err := json.Unmarshal([]byte(tokenJSON), &token); err != nil {
+		t.Fatalf("failed to parse token response %q: %v", tokenJSON, err)
+	}
+	if token.AccessToken != "test-token" || token.TokenType != "Bearer" || token.ExpiresIn <= 0 || token.ExpiresIn > 1800 {
+		t.Errorf("unexpected token response: %+v", token)
+	}
+}
+
+func TestRejectedRequests(t *testing.T) {
+	srv := newTestServer(t)
+	tokenURL := srv.URL + serviceAccountsPath + "default/token"
+
+	tests := []struct {
+		name    string
+		method  string
+		url     string
+		headers map[string]string
+		status  int
+	}{
+		{"missing flavor header", http.MethodGet, tokenURL, nil, http.StatusForbidden},
+		{"forwarded request", http.MethodGet, tokenURL, map[string]string{flavorHeader: flavorGoogle, "X-Forwarded-For": "10.0.0.1"}, http.StatusForbidden},
+		{"post", http.MethodPost, tokenURL, map[string]string{flavorHeader: flavorGoogle}, http.StatusMethodNotAllowed},
+		{"other service account", http.MethodGet, srv.URL + serviceAccountsPath + "other@my-project.iam.gserviceaccount.com/token", map[string]string{flavorHeader: flavorGoogle}, http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest(tt.method, tt.url, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for k, v := range tt.headers {
+				req.Header.Set(k, v)
+			}
+			resp, err := srv.Client().Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != tt.status {
+				t.Errorf("status = %d, want %d", resp.StatusCode, tt.status)
+			}
+		})
+	}
+}
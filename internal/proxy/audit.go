@@ -0,0 +1,158 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/elazarl/goproxy"
+	"github.com/spf13/viper"
+
+	util "github.com/jessesomerville/ephemeral-iam/internal/eiamutil"
+	errorsutil "github.com/jessesomerville/ephemeral-iam/internal/errors"
+)
+
+// auditRecord is a single line of the audit log. One is written for every
+// request that is sent through the auth proxy.
+type auditRecord struct {
+	Timestamp      time.Time `json:"timestamp"`
+	SessionID      string    `json:"sessionId"`
+	ServiceAccount string    `json:"serviceAccount"`
+	Method         string    `json:"method"`
+	Host           string    `json:"host"`
+	Path           string    `json:"path"`
+	Status         int       `json:"status"`
+	LatencyMs      int64     `json:"latencyMs"`
+	RequestBytes   int64     `json:"requestBytes"`
+	ResponseBytes  int64     `json:"responseBytes"`
+	Denied         string    `json:"denied,omitempty"`
+	Error          string    `json:"error,omitempty"`
+}
+
+// auditLog writes an auditRecord as a line of JSON for each proxied request
+type auditLog struct {
+	mu      sync.Mutex
+	file    *os.File
+	encoder *json.Encoder
+}
+
+func newAuditLog(sessionID string) (*auditLog, error) {
+	timestamp := time.Now().Format("20060102150405")
+	filename := filepath.Join(viper.GetString("authproxy.logdir"), fmt.Sprintf("%s_%s_audit.jsonl", timestamp, sessionID))
+	file, err := os.OpenFile(filename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return nil, errorsutil.EiamError{
+			Log: util.Logger.WithError(err),
+			Msg: "Failed to create audit log file",
+			Err: err,
+		}
+	}
+	util.Logger.Infof("Writing audit logs to %s", filename)
+	return &auditLog{file: file, encoder: json.NewEncoder(file)}, nil
+}
+
+func (a *auditLog) write(record *auditRecord) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.encoder.Encode(record)
+}
+
+// Close closes the audit log file
+func (a *auditLog) Close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.file.Close()
+}
+
+// newAuditRecord starts the audit record of a request
+func (s *privilegedSession) newAuditRecord(r *http.Request) *auditRecord {
+	host := r.URL.Hostname()
+	if host == "" {
+		host = r.Host
+	}
+	return &auditRecord{
+		Timestamp:      time.Now().UTC(),
+		SessionID:      s.id,
+		ServiceAccount: s.svcAcct,
+		Method:         r.Method,
+		Host:           host,
+		Path:           r.URL.Path,
+	}
+}
+
+// logDenied records a request that was rejected by the auth proxy's policy
+func (a *auditLog) logDenied(ctx *goproxy.ProxyCtx, record *auditRecord, reason error) {
+	record.Status = http.StatusForbidden
+	record.Denied = reason.Error()
+	if err := a.write(record); err != nil {
+		ctx.Warnf("Failed to write audit record: %v", err)
+	}
+}
+
+// roundTripper sends a request upstream and records it once the response body
+// has been sent back to the client
+func (a *auditLog) roundTripper(record *auditRecord, tr http.RoundTripper) goproxy.RoundTripper {
+	return goproxy.RoundTripperFunc(func(r *http.Request, ctx *goproxy.ProxyCtx) (*http.Response, error) {
+		start := time.Now()
+		reqBody := &countingReadCloser{ReadCloser: r.Body}
+		if r.Body != nil {
+			r.Body = reqBody
+		}
+
+		resp, err := tr.RoundTrip(r)
+		if err != nil {
+			record.LatencyMs = time.Since(start).Milliseconds()
+			record.RequestBytes = atomic.LoadInt64(&reqBody.n)
+			record.Error = err.Error()
+			if err := a.write(record); err != nil {
+				ctx.Warnf("Failed to write audit record: %v", err)
+			}
+			return nil, err
+		}
+
+		record.Status = resp.StatusCode
+		resp.Body = &countingReadCloser{
+			ReadCloser: resp.Body,
+			onClose: func(n int64) {
+				record.LatencyMs = time.Since(start).Milliseconds()
+				record.RequestBytes = atomic.LoadInt64(&reqBody.n)
+				record.ResponseBytes = n
+				if err := a.write(record); err != nil {
+					ctx.Warnf("Failed to write audit record: %v", err)
+				}
+			},
+		}
+		return resp, nil
+	})
+}
+
+// countingReadCloser counts the bytes read from the underlying body and calls
+// onClose with the total when it is closed
+type countingReadCloser struct {
+	io.ReadCloser
+	n       int64
+	onClose func(int64)
+	once    sync.Once
+}
+
+func (c *countingReadCloser) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	atomic.AddInt64(&c.n, int64(n))
+	return n, err
+}
+
+func (c *countingReadCloser) Close() error {
+	err := c.ReadCloser.Close()
+	if c.onClose != nil {
+		c.once.Do(func() {
+			c.onClose(atomic.LoadInt64(&c.n))
+		})
+	}
+	return err
+}
@@ -0,0 +1,105 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"syscall"
+	"time"
+
+	util "github.com/jessesomerville/ephemeral-iam/internal/eiamutil"
+	errorsutil "github.com/jessesomerville/ephemeral-iam/internal/errors"
+	"github.com/jessesomerville/ephemeral-iam/internal/lifecycle"
+)
+
+// commandStopTimeout is how long a command is given to exit after it is sent
+// SIGTERM at the end of the session before it is killed
+var commandStopTimeout = 10 * time.Second
+
+// sessionCommand is a command that is run in the session instead of the
+// privileged sub-shell
+type sessionCommand struct {
+	cmd    *exec.Cmd
+	exited chan struct{}
+	err    error
+}
+
+// startCommand runs command in the session with the user's terminal attached.
+// The session ends when the command exits, and a command that is still running
+// when the session ends is stopped.
+func startCommand(session *privilegedSession, lc *lifecycle.Manager, defaultCluster map[string]string, command []string) (*sessionCommand, error) {
+	cmdEnv, err := sessionEnv(session, defaultCluster)
+	if err != nil {
+		return nil, err
+	}
+
+	c := exec.Command(command[0], command[1:]...)
+	c.Env = cmdEnv
+	c.Stdin = os.Stdin
+	c.Stdout = os.Stdout
+	c.Stderr = os.Stderr
+	if err := c.Start(); err != nil {
+		return nil, errorsutil.EiamError{
+			Log: util.Logger.WithError(err),
+			Msg: fmt.Sprintf("Failed to run %s", command[0]),
+			Err: err,
+		}
+	}
+	// The command stays in the terminal's foreground process group so that it
+	// can read from the terminal
+	lc.SetForegroundChild(c.Process)
+
+	sc := &sessionCommand{cmd: c, exited: make(chan struct{})}
+	go func() {
+		sc.err = c.Wait()
+		close(sc.exited)
+		// End the session when the command exits
+		session.stop()
+	}()
+	lc.OnCleanup("stop command", sc.stop)
+	return sc, nil
+}
+
+// stop sends SIGTERM to the command if it is still running, and kills it if it
+// has not exited after commandStopTimeout
+func (sc *sessionCommand) stop() error {
+	select {
+	case <-sc.exited:
+		return nil
+	default:
+	}
+
+	util.Logger.Warnf("Privileged session ended before %s exited, stopping it", sc.cmd.Path)
+	if err := sc.cmd.Process.Signal(syscall.SIGTERM); err != nil && err != os.ErrProcessDone {
+		return err
+	}
+	select {
+	case <-sc.exited:
+		return nil
+	case <-time.After(commandStopTimeout):
+	}
+	if err := sc.cmd.Process.Kill(); err != nil && err != os.ErrProcessDone {
+		return err
+	}
+	<-sc.exited
+	return nil
+}
+
+// exitCode returns the exit code of the command once it has exited. A command
+// that was killed by a signal exits with 128 plus the signal number, like it
+// would in a shell.
+func (sc *sessionCommand) exitCode() int {
+	<-sc.exited
+	var exitErr *exec.ExitError
+	if !errors.As(sc.err, &exitErr) {
+		if sc.err != nil {
+			return 1
+		}
+		return 0
+	}
+	if status, ok := exitErr.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+		return 128 + int(status.Signal())
+	}
+	return exitErr.ExitCode()
+}
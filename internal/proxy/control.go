@@ -0,0 +1,103 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/jessesomerville/ephemeral-iam/internal/gcpclient"
+	"github.com/jessesomerville/ephemeral-iam/internal/session"
+)
+
+// canGenerateAccessToken checks that the user can still generate the session's
+// access tokens before the session is extended
+var canGenerateAccessToken = gcpclient.CanGenerateAccessToken
+
+// startControlServer serves the session's control socket which is used by the
+// `eiam session` commands to interact with the running session
+func startControlServer(s *privilegedSession) (*http.Server, error) {
+	l, err := session.Listen(s.id)
+	if err != nil {
+		return nil, err
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", s.handleStatus)
+	mux.HandleFunc("/stop", s.handleStop)
+	mux.HandleFunc("/extend", s.handleExtend)
+
+	srv := &http.Server{Handler: mux}
+	go srv.Serve(l)
+	return srv, nil
+}
+
+func (s *privilegedSession) handleStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeControlError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s is not allowed", r.Method))
+		return
+	}
+	writeControlResponse(w, s.info())
+}
+
+func (s *privilegedSession) handleStop(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeControlError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s is not allowed", r.Method))
+		return
+	}
+	printToShell("Privileged session was stopped with `eiam session stop`")
+	writeControlResponse(w, struct{}{})
+	s.stop()
+}
+
+func (s *privilegedSession) handleExtend(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeControlError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s is not allowed", r.Method))
+		return
+	}
+
+	var req session.ExtendRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeControlError(w, http.StatusBadRequest, fmt.Errorf("failed to decode request: %v", err))
+		return
+	}
+	duration, err := time.ParseDuration(req.Duration)
+	if err != nil || duration <= 0 {
+		writeControlError(w, http.StatusBadRequest, fmt.Errorf("invalid duration %q", req.Duration))
+		return
+	}
+	if req.Reason == "" {
+		writeControlError(w, http.StatusBadRequest, fmt.Errorf("a reason is required to extend the session"))
+		return
+	}
+
+	// Make sure the user is still allowed to generate the session's access
+	// tokens, which is checked the same way as when the session was started
+	hasAccess, err := canGenerateAccessToken(s.project, s.svcAcct, s.subject, s.formatReason(req.Reason), s.delegates...)
+	if err != nil {
+		writeControlError(w, http.StatusInternalServerError, fmt.Errorf("failed to check access to %s: %v", s.svcAcct, err))
+		return
+	} else if !hasAccess {
+		writeControlError(w, http.StatusForbidden, fmt.Errorf("you no longer have access to generate access tokens for %s", s.svcAcct))
+		return
+	}
+
+	end, err := s.extend(req.Reason, duration)
+	if err != nil {
+		writeControlError(w, http.StatusBadRequest, err)
+		return
+	}
+	printToShell(fmt.Sprintf("Privileged session extended until %s", end.Format(time.RFC1123)))
+	writeControlResponse(w, session.ExtendResponse{End: end})
+}
+
+func writeControlResponse(w http.ResponseWriter, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(body)
+}
+
+func writeControlError(w http.ResponseWriter, status int, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(session.ErrorResponse{Error: err.Error()})
+}
@@ -0,0 +1,66 @@
+package proxy
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	util "github.com/jessesomerville/ephemeral-iam/internal/eiamutil"
+	sessionpkg "github.com/jessesomerville/ephemeral-iam/internal/session"
+)
+
+func TestControlExtendSubject(t *testing.T) {
+	log := logrus.New()
+	log.Out = ioutil.Discard
+	util.Logger = log
+	defer func() { util.Logger = nil }()
+
+	session := newTestSession(t, false)
+	session.subject = "alice@example.com"
+	session.delegates = []string{"gateway@admin-project.iam.gserviceaccount.com"}
+	session.end = time.Now().Add(10 * time.Minute)
+	if err := sessionpkg.Create(session.id); err != nil {
+		t.Fatal(err)
+	}
+	defer sessionpkg.Remove(session.id)
+	srv, err := startControlServer(session)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	var gotSubject string
+	var gotDelegates []string
+	hasAccess := true
+	defer func(check func(string, string, string, string, ...string) (bool, error)) {
+		canGenerateAccessToken = check
+	}(canGenerateAccessToken)
+	canGenerateAccessToken = func(project, serviceAccountEmail, subject, reason string, delegates ...string) (bool, error) {
+		gotSubject, gotDelegates = subject, delegates
+		return hasAccess, nil
+	}
+
+	before, _ := session.endTime()
+	end, err := sessionpkg.Extend(session.id, "more time", 10*time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gotSubject != session.subject || strings.Join(gotDelegates, ",") != strings.Join(session.delegates, ",") {
+		t.Errorf("access was checked for subject %q through %v, want %q through %v", gotSubject, gotDelegates, session.subject, session.delegates)
+	}
+	if want := before.Add(10 * time.Minute); !end.Equal(want) {
+		t.Errorf("session was extended until %s, want %s", end, want)
+	}
+
+	// The session is not extended once the user can't generate its tokens
+	hasAccess = false
+	if _, err := sessionpkg.Extend(session.id, "more time", 10*time.Minute); err == nil {
+		t.Error("expected the session not to be extended without access")
+	}
+	if current, _ := session.endTime(); !current.Equal(end) {
+		t.Errorf("session end = %s, want %s", current, end)
+	}
+}
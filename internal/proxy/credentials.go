@@ -0,0 +1,76 @@
+package proxy
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	util "github.com/jessesomerville/ephemeral-iam/internal/eiamutil"
+	errorsutil "github.com/jessesomerville/ephemeral-iam/internal/errors"
+	"github.com/jessesomerville/ephemeral-iam/internal/gcpclient"
+	sessionpkg "github.com/jessesomerville/ephemeral-iam/internal/session"
+)
+
+// envCredentials is the environment variable that client libraries read the
+// path to an application default credentials file from
+const envCredentials = "GOOGLE_APPLICATION_CREDENTIALS"
+
+// adcFileName is the name of the application default credentials file in a
+// gcloud configuration directory
+const adcFileName = "application_default_credentials.json"
+
+// writeImpersonatedCredentials writes an application default credentials file
+// that impersonates the session's service account to the session's directory.
+// Client libraries that use it call the IAM Credentials API directly, so they
+// don't need to trust the auth proxy's certificate. The file is removed along
+// with the rest of the session's state when the session ends.
+func writeImpersonatedCredentials(session *privilegedSession, lifetime time.Duration) error {
+	creds, err := gcpclient.ImpersonatedCredentialsFile(session.svcAcct, session.delegates, lifetime)
+	if err != nil {
+		return err
+	}
+
+	credentialsFile := sessionpkg.CredentialsPath(session.id)
+	if err := ioutil.WriteFile(credentialsFile, creds, 0o600); err != nil {
+		return errorsutil.EiamError{
+			Log: util.Logger.WithError(err),
+			Msg: "Failed to write impersonated credentials file",
+			Err: err,
+		}
+	}
+	session.credentialsFile = credentialsFile
+	return nil
+}
+
+// setupCredentialsFile writes the impersonated credentials file if it was
+// requested. If it isn't written, the user's own application default
+// credentials are removed from the session instead.
+func setupCredentialsFile(session *privilegedSession, opts SessionOptions) error {
+	if opts.CredentialsFile {
+		if opts.Subject != "" {
+			// Impersonated credentials files can't use domain-wide delegation
+			util.Logger.Warnf("Client libraries in the privileged sub-shell will not act as %s unless --metadata-server is set", opts.Subject)
+		} else if err := writeImpersonatedCredentials(session, opts.Duration); err != nil {
+			util.Logger.WithError(err).Warn("Client libraries in the privileged sub-shell will not use the service account's credentials")
+		} else {
+			return nil
+		}
+	}
+	return removeUserCredentials(session)
+}
+
+// removeUserCredentials removes the user's own application default credentials
+// from the session's copy of the gcloud config, so that client libraries in the
+// privileged sub-shell don't fall back to them
+func removeUserCredentials(session *privilegedSession) error {
+	adcFile := filepath.Join(session.gcloudConfig, adcFileName)
+	if err := os.Remove(adcFile); err != nil && !os.IsNotExist(err) {
+		return errorsutil.EiamError{
+			Log: util.Logger.WithError(err),
+			Msg: "Failed to remove application default credentials from the session's gcloud config",
+			Err: err,
+		}
+	}
+	return nil
+}
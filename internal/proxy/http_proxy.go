@@ -4,122 +4,274 @@ import (
 	"context"
 	"crypto/tls"
 	"fmt"
+	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
 	"os"
-	"os/signal"
 	"path/filepath"
 	"sync"
-	"syscall"
+	"sync/atomic"
 	"time"
 
 	"github.com/elazarl/goproxy"
 	"github.com/spf13/viper"
 	"golang.org/x/term"
+	credentialspb "google.golang.org/genproto/googleapis/iam/credentials/v1"
 
 	util "github.com/jessesomerville/ephemeral-iam/internal/eiamutil"
 	errorsutil "github.com/jessesomerville/ephemeral-iam/internal/errors"
 	"github.com/jessesomerville/ephemeral-iam/internal/gcpclient"
+	"github.com/jessesomerville/ephemeral-iam/internal/lifecycle"
+	"github.com/jessesomerville/ephemeral-iam/internal/proxy/policy"
+	sessionpkg "github.com/jessesomerville/ephemeral-iam/internal/session"
 )
 
 var (
 	certCache = make(map[string]*tls.Certificate)
 	certLock  = &sync.Mutex{}
-
-	wg sync.WaitGroup
 )
 
-// StartProxyServer spins up the proxy that replaces the gcloud auth token
-func StartProxyServer(accessToken, reason, svcAcct, project string, expirationDate time.Time, defaultCluster map[string]string) error {
+// SessionOptions configures a privileged session
+type SessionOptions struct {
+	// AccessToken is the session's first access token
+	AccessToken *credentialspb.GenerateAccessTokenResponse
+	// Reason is the formatted reason that is attached to requests
+	Reason         string
+	ServiceAccount string
+	// Subject is the Google Workspace user that the session's access tokens
+	// act as through domain-wide delegation, if any
+	Subject string
+	Project string
+	// Delegates are the service accounts that ServiceAccount is impersonated
+	// through
+	Delegates []string
+	// Scopes are the OAuth scopes of the session's access tokens
+	Scopes         []string
+	Duration       time.Duration
+	ReadOnly       bool
+	Record         bool
+	MetadataServer bool
+	// CredentialsFile writes an impersonated credentials file for client
+	// libraries in the session
+	CredentialsFile bool
+	// Command is run in the session instead of the privileged sub-shell if it
+	// is not empty
+	Command        []string
+	DefaultCluster map[string]string
+}
+
+// StartProxyServer spins up the proxy that replaces the gcloud auth token. If
+// opts.Command is not empty, it is run in the session instead of the privileged
+// sub-shell, and its exit code is returned as an errorsutil.ExitCodeError.
+func StartProxyServer(opts SessionOptions) error {
 	if err := checkProxyCertificate(); err != nil {
 		return err
 	}
 
-	srv, err := createProxy(accessToken, reason)
+	session := newPrivilegedSession(opts)
+	command := opts.Command
+	if opts.Record && len(command) > 0 {
+		// The command is attached to the user's terminal directly so that its
+		// output is passed through unchanged
+		util.Logger.Warn("Only the privileged sub-shell can be recorded, the command's output will not be recorded")
+	} else if opts.Record {
+		session.recording = sessionpkg.RecordingPath(session.id)
+	}
+
+	// Tear down the session exactly once no matter how it ends
+	lc := lifecycle.New()
+	lc.Start()
+	defer lc.Stop()
+	defer lc.Cleanup()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-lc.Done():
+			session.stop()
+		case <-ctx.Done():
+		}
+	}()
+
+	// Everything the session creates is kept in its own directory so that
+	// multiple sessions can run at the same time
+	if err := sessionpkg.Create(session.id); err != nil {
+		return err
+	}
+	lc.OnCleanup("remove session state", func() error {
+		return sessionpkg.Remove(session.id)
+	})
+
+	if err := session.writeExpiry(); err != nil {
+		return errorsutil.EiamError{
+			Log: util.Logger.WithError(err),
+			Msg: "Failed to write the session expiry file",
+			Err: err,
+		}
+	}
+
+	if err := ioutil.WriteFile(session.kubeConfig, nil, 0o600); err != nil {
+		return errorsutil.EiamError{
+			Log: util.Logger.WithError(err),
+			Msg: "Failed to create temp kubeconfig",
+			Err: err,
+		}
+	}
+
+	listener, err := listenForProxy()
 	if err != nil {
 		return err
 	}
+	session.proxyAddress = listener.Addr().String()
 
-	// Catch interrupts to gracefully shutdown the proxy and restore the gcloud config
-	idleConnsClosed := make(chan struct{})
-	sigint := make(chan os.Signal, 1)
-	go func() {
-		signal.Notify(sigint, os.Interrupt)
-		<-sigint
+	util.Logger.Info("Configuring gcloud to use auth proxy")
+	proxyHost, proxyPort, _ := net.SplitHostPort(session.proxyAddress)
+	if err := gcpclient.ConfigureGcloudProxy(session.gcloudConfig, opts.Project, proxyHost, proxyPort); err != nil {
+		listener.Close()
+		return err
+	}
 
-		// An interrupt signal was received, shutdown the proxy server
-		if err := srv.Shutdown(context.Background()); err != nil {
-			util.Logger.WithError(err).Error("failed to properly shut down proxy server")
+	// Application default credentials come from either the metadata server or
+	// a credentials file, since the file would take precedence. Without
+	// either, the user's own credentials are removed from the session.
+	if opts.MetadataServer {
+		if err := startMetadataServer(session, lc); err != nil {
+			listener.Close()
+			return err
 		}
-		close(idleConnsClosed)
-		util.Logger.Info("Stopping auth proxy and restoring gcloud config")
-		errorsutil.CheckRevertGcloudConfigError(gcpclient.UnsetGcloudProxy())
-		os.Exit(0)
-	}()
+	} else if err := setupCredentialsFile(session, opts); err != nil {
+		listener.Close()
+		return err
+	}
+
+	audit, err := newAuditLog(session.id)
+	if err != nil {
+		listener.Close()
+		return err
+	}
+	lc.OnCleanup("close audit log", audit.Close)
+
+	srv, logFile, err := createProxy(session, audit)
+	if err != nil {
+		listener.Close()
+		return err
+	}
+	lc.OnCleanup("close auth proxy log", logFile.Close)
+	lc.OnCleanup("stop auth proxy", func() error {
+		return srv.Shutdown(context.Background())
+	})
+
+	controlSrv, err := startControlServer(session)
+	if err != nil {
+		listener.Close()
+		return err
+	}
+	lc.OnCleanup("close control socket", controlSrv.Close)
 
-	proxyServerExit := &sync.WaitGroup{}
-	proxyServerExit.Add(1)
 	go func() {
-		defer proxyServerExit.Done()
-		if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+		if err := srv.Serve(listener); err != http.ErrServerClosed {
 			util.Logger.WithError(err).Fatal("failed to start the auth proxy")
 		}
-		<-idleConnsClosed
 	}()
 
-	sessionLength := time.Until(expirationDate)
-	sessionEnd := time.Now().Add(sessionLength).Format(time.RFC1123)
-	util.Logger.Infof("Starting auth proxy. Privileged session will last until %s", sessionEnd)
+	end, _ := session.endTime()
+	util.Logger.Infof("Starting auth proxy on %s. Privileged session %s will last until %s", session.proxyAddress, session.id, end.Format(time.RFC1123))
+
+	// Keep the access token valid for the full length of the session
+	go session.refreshToken(ctx)
+	lc.OnCleanup("stop token refresher", func() error {
+		cancel()
+		return nil
+	})
 
-	wg.Add(1)
 	var oldState *term.State
-	// TODO: Instead of handling errors in the startShell function, handle them here
-	go startShell(svcAcct, accessToken, expirationDate.Format(time.RFC3339Nano), defaultCluster, &oldState)
+	lc.OnCleanup("restore terminal", func() error {
+		if oldState == nil {
+			return nil
+		}
+		return term.Restore(int(os.Stdin.Fd()), oldState)
+	})
 
-	// Shut down the auth proxy when the user exits the sub-shell
-	go func() {
-		wg.Wait()
-		sigint <- syscall.SIGINT
-	}()
+	var sc *sessionCommand
+	if len(command) > 0 {
+		if sc, err = startCommand(session, lc, opts.DefaultCluster, command); err != nil {
+			return err
+		}
+	} else {
+		// TODO: Instead of handling errors in the startShell function, handle them here
+		go startShell(session, lc, opts.DefaultCluster, &oldState)
+	}
 
-	time.Sleep(sessionLength)
+	session.waitForEnd()
+	lc.Cleanup()
 
-	if err := term.Restore(int(os.Stdin.Fd()), oldState); err != nil {
-		return errorsutil.EiamError{
-			Log: util.Logger.WithError(err),
-			Msg: "Failed to restore original shell",
-			Err: err,
+	if sig := lc.Signal(); sig != nil {
+		util.Logger.Infof("Received %s, privileged session ended", sig)
+	} else {
+		util.Logger.Info("Privileged session ended")
+	}
+
+	// Pass the exit code of the command on to the caller
+	if sc != nil {
+		if code := sc.exitCode(); code != 0 {
+			return errorsutil.ExitCodeError{Code: code}
 		}
 	}
+	return nil
+}
 
-	util.Logger.Info("Privileged session expired, stopping auth proxy and restoring gcloud config")
-	if err := srv.Shutdown(context.Background()); err != nil {
-		return errorsutil.EiamError{
+// listenForProxy binds the auth proxy to the configured address and port. If
+// the port is already in use, e.g. by another privileged session, a free port
+// is used instead.
+func listenForProxy() (net.Listener, error) {
+	address := viper.GetString("authproxy.proxyaddress")
+	l, err := net.Listen("tcp", net.JoinHostPort(address, viper.GetString("authproxy.proxyport")))
+	if err == nil {
+		return l, nil
+	}
+	util.Logger.WithError(err).Debug("Configured auth proxy port is unavailable, using a free port instead")
+
+	l, err = net.Listen("tcp", net.JoinHostPort(address, "0"))
+	if err != nil {
+		return nil, errorsutil.EiamError{
 			Log: util.Logger.WithError(err),
-			Msg: "Failed to properly shut down proxy server",
+			Msg: fmt.Sprintf("Failed to find a free port for the auth proxy on %s", address),
 			Err: err,
 		}
 	}
-	errorsutil.CheckRevertGcloudConfigError(gcpclient.UnsetGcloudProxy())
-	return nil
+	return l, nil
 }
 
-func createProxy(accessToken, reason string) (*http.Server, error) {
+func createProxy(session *privilegedSession, audit *auditLog) (*http.Server, *os.File, error) {
 	proxy := goproxy.NewProxyHttpServer()
 	proxy.Verbose = viper.GetBool("authproxy.verbose")
 
+	requestPolicy := &policy.Policy{
+		AllowedHosts:   viper.GetStringSlice("authproxy.allowedhosts"),
+		AllowedMethods: viper.GetStringSlice("authproxy.allowedmethods"),
+		ReadOnly:       session.readOnly,
+	}
+	if err := requestPolicy.Validate(); err != nil {
+		return nil, nil, errorsutil.EiamError{
+			Log: util.Logger.WithError(err),
+			Msg: "Invalid auth proxy policy",
+			Err: err,
+		}
+	}
+
 	// Create log file
 	timestamp := time.Now().Format("20060102150405")
 	logFilename := filepath.Join(viper.GetString("authproxy.logdir"), fmt.Sprintf("%s_auth_proxy.log", timestamp))
 	logFile, err := os.OpenFile(logFilename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o666)
 	if err != nil {
-		return nil, errorsutil.EiamError{
+		return nil, nil, errorsutil.EiamError{
 			Log: util.Logger.WithError(err),
 			Msg: "Failed to create log file",
 			Err: err,
 		}
 	}
-	defer logFile.Close()
 
 	// Set auth proxy to log to file
 	proxy.Logger = log.New(logFile, "", log.LstdFlags)
@@ -127,22 +279,38 @@ func createProxy(accessToken, reason string) (*http.Server, error) {
 
 	if err := setCa(viper.GetString("authproxy.certfile"), viper.GetString("authproxy.keyfile")); err != nil {
 		util.Logger.Error("Failed to set proxy certificate authority")
-		return nil, err
+		logFile.Close()
+		return nil, nil, err
 	}
 
 	proxy.OnRequest().HandleConnect(goproxy.FuncHttpsHandler(proxyConnectHandle))
 
 	proxy.OnRequest().DoFunc(func(r *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+		atomic.AddInt64(&session.requests, 1)
+		record := session.newAuditRecord(r)
+
+		// Never attach the service account's credentials to a request that is
+		// not allowed by the policy
+		if err := requestPolicy.Check(r); err != nil {
+			ctx.Warnf("Denied %s %s: %v", r.Method, r.URL.String(), err)
+			audit.logDenied(ctx, record, err)
+			return r, goproxy.NewResponse(r, goproxy.ContentTypeText, http.StatusForbidden, fmt.Sprintf("ephemeral-iam: %v\n", err))
+		}
+
+		accessToken, _ := session.token()
 		r.Header.Set("authorization", fmt.Sprintf("Bearer %s", accessToken))
-		r.Header.Set("X-Goog-Request-Reason", reason)
+		r.Header.Set("X-Goog-Request-Reason", session.currentReason())
+
+		// Record the request once its response has been sent to the client
+		ctx.RoundTripper = audit.roundTripper(record, proxy.Tr)
 		return r, nil
 	})
 
 	srv := &http.Server{
-		Addr:    fmt.Sprintf("%s:%s", viper.GetString("authproxy.proxyaddress"), viper.GetString("authproxy.proxyport")),
+		Addr:    session.proxyAddress,
 		Handler: proxy,
 	}
-	return srv, nil
+	return srv, logFile, nil
 }
 
 func proxyConnectHandle(host string, ctx *goproxy.ProxyCtx) (*goproxy.ConnectAction, string) {
@@ -0,0 +1,66 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+
+	"github.com/spf13/viper"
+
+	util "github.com/jessesomerville/ephemeral-iam/internal/eiamutil"
+	errorsutil "github.com/jessesomerville/ephemeral-iam/internal/errors"
+	"github.com/jessesomerville/ephemeral-iam/internal/lifecycle"
+	"github.com/jessesomerville/ephemeral-iam/internal/metadata"
+)
+
+// metadataEnv returns the environment variables that point client libraries at
+// the metadata server. Some libraries check that the metadata server is running
+// using the address in GCE_METADATA_IP instead of GCE_METADATA_HOST.
+func metadataEnv(address string) []string {
+	return []string{
+		fmt.Sprintf("%s=%s", metadata.EnvHost, address),
+		fmt.Sprintf("%s=%s", metadata.EnvIP, address),
+	}
+}
+
+// startMetadataServer starts a GCE metadata server that serves the session's
+// access token, so that tools which use application default credentials act as
+// the service account
+func startMetadataServer(session *privilegedSession, lc *lifecycle.Manager) error {
+	// Application default credentials are looked up in the gcloud config
+	// before the metadata server
+	if err := removeUserCredentials(session); err != nil {
+		return err
+	}
+
+	l, err := net.Listen("tcp", net.JoinHostPort(viper.GetString("authproxy.proxyaddress"), "0"))
+	if err != nil {
+		return errorsutil.EiamError{
+			Log: util.Logger.WithError(err),
+			Msg: "Failed to start the metadata server",
+			Err: err,
+		}
+	}
+	session.metadataAddress = l.Addr().String()
+
+	srv := &http.Server{
+		Handler: &metadata.Server{
+			ServiceAccount: session.svcAcct,
+			Project:        session.project,
+			Scopes:         session.scopes,
+			Token:          session.token,
+		},
+	}
+	go func() {
+		if err := srv.Serve(l); err != http.ErrServerClosed {
+			util.Logger.WithError(err).Error("metadata server stopped unexpectedly")
+		}
+	}()
+	lc.OnCleanup("stop metadata server", func() error {
+		return srv.Shutdown(context.Background())
+	})
+
+	util.Logger.Infof("Serving credentials for %s from the metadata server on %s", session.svcAcct, session.metadataAddress)
+	return nil
+}
@@ -0,0 +1,205 @@
+// Package policy decides which requests the auth proxy is allowed to attach a
+// service account's credentials to.
+package policy
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// ReadOnlyMethods are the HTTP methods that are allowed in read-only mode
+var ReadOnlyMethods = []string{
+	http.MethodGet,
+	http.MethodHead,
+	http.MethodOptions,
+}
+
+// ReadOnlyRPCs are custom methods, e.g. 'projects/my-project:getIamPolicy',
+// that only read resources. They are allowed in read-only mode even though
+// they are sent as POST requests.
+var ReadOnlyRPCs = []string{
+	"analyzeIamPolicy",
+	"batchGet",
+	"batchGetEffectiveIamPolicies",
+	"get",
+	"getAncestry",
+	"getEffectiveOrgPolicy",
+	"getIamPolicy",
+	"getOrgPolicy",
+	"list",
+	"listAvailableOrgPolicyConstraints",
+	"listOrgPolicies",
+	"queryAuditableServices",
+	"queryGrantableRoles",
+	"queryTestablePermissions",
+	"search",
+	"searchAllIamPolicies",
+	"searchAllResources",
+	"testIamPermissions",
+}
+
+// MethodOverrideHeaders are headers that make Google APIs handle a request as
+// if it used a different HTTP method. Requests that carry them are rejected in
+// read-only mode, since a POST or GET could otherwise be handled as a DELETE.
+var MethodOverrideHeaders = []string{
+	"X-HTTP-Method",
+	"X-HTTP-Method-Override",
+	"X-Method-Override",
+}
+
+// apiVersion matches the first segment of the REST paths that custom methods
+// are called on, e.g. 'v1', 'v1beta2' or 'v1p1beta1'
+var apiVersion = regexp.MustCompile(`^v[0-9]+(p[0-9]+)?((alpha|beta)[0-9]*)?$`)
+
+// TokenEndpoints are the OAuth 2.0 endpoints that gcloud uses to refresh its
+// credentials. They are allowed in read-only mode since they do not modify
+// any resources.
+var TokenEndpoints = []string{
+	"accounts.google.com/o/oauth2/token",
+	"oauth2.googleapis.com/token",
+	"www.googleapis.com/oauth2/v4/token",
+}
+
+// Policy is evaluated for every request that is sent through the auth proxy
+type Policy struct {
+	// AllowedHosts are glob patterns, such as '*.googleapis.com', that match
+	// the hosts that requests can be sent to
+	AllowedHosts []string
+	// AllowedMethods are the HTTP methods that requests can use
+	AllowedMethods []string
+	// ReadOnly only allows requests that use a read-only method or call a
+	// read-only RPC
+	ReadOnly bool
+}
+
+// DeniedError is returned when a request is blocked by the policy
+type DeniedError struct {
+	Reason string
+}
+
+func (e *DeniedError) Error() string {
+	return e.Reason
+}
+
+// Validate checks that the policy's host patterns and methods are well formed
+func (p *Policy) Validate() error {
+	for _, pattern := range p.AllowedHosts {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid host pattern %q: %v", pattern, err)
+		}
+	}
+	for _, method := range p.AllowedMethods {
+		if method == "" || strings.ToUpper(method) != method {
+			return fmt.Errorf("invalid HTTP method %q, methods must be uppercase", method)
+		}
+	}
+	return nil
+}
+
+// Check returns a *DeniedError describing why the request is not allowed, or
+// nil if it is allowed
+func (p *Policy) Check(r *http.Request) error {
+	host := requestHost(r)
+	if !p.hostAllowed(host) {
+		return &DeniedError{Reason: fmt.Sprintf("requests to %s are not allowed by the auth proxy's host allowlist", host)}
+	}
+	if !contains(p.AllowedMethods, r.Method) {
+		return &DeniedError{Reason: fmt.Sprintf("%s requests are not allowed by the auth proxy's method policy", r.Method)}
+	}
+	if p.ReadOnly && hasMethodOverride(r) {
+		return &DeniedError{Reason: "requests that override their HTTP method are not allowed in a read-only session"}
+	}
+	if p.ReadOnly && !isReadOnly(r, host) {
+		return &DeniedError{Reason: fmt.Sprintf("%s %s is not allowed in a read-only session", r.Method, r.URL.Path)}
+	}
+	return nil
+}
+
+// isReadOnly checks if a request only reads resources
+func isReadOnly(r *http.Request, host string) bool {
+	if contains(ReadOnlyMethods, r.Method) {
+		return true
+	}
+	if r.Method != http.MethodPost {
+		return false
+	}
+	if contains(TokenEndpoints, host+r.URL.Path) {
+		return true
+	}
+	if method, ok := customMethod(r); ok {
+		return contains(ReadOnlyRPCs, method)
+	}
+	return false
+}
+
+// customMethod returns the custom method that a request calls. Custom methods
+// are appended to the resource name, e.g. '/v1/projects/my-project:getIamPolicy'.
+// The escaped path is used so that an escaped colon in a resource name, such as
+// a Cloud Storage object name, is not mistaken for a custom method, and only
+// paths that start with an API version and have no empty or dot segments are
+// recognized.
+func customMethod(r *http.Request) (string, bool) {
+	segments := strings.Split(strings.TrimPrefix(r.URL.EscapedPath(), "/"), "/")
+	if len(segments) < 2 || !apiVersion.MatchString(segments[0]) {
+		return "", false
+	}
+	last := len(segments) - 1
+	for i, segment := range segments {
+		if segment == "" || segment == "." || segment == ".." {
+			return "", false
+		}
+		if i < last && strings.Contains(segment, ":") {
+			return "", false
+		}
+	}
+	i := strings.LastIndex(segments[last], ":")
+	if i == -1 {
+		return "", false
+	}
+	return segments[last][i+1:], true
+}
+
+// hasMethodOverride checks if a request carries a header that overrides its
+// HTTP method
+func hasMethodOverride(r *http.Request) bool {
+	for _, header := range MethodOverrideHeaders {
+		if _, ok := r.Header[http.CanonicalHeaderKey(header)]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *Policy) hostAllowed(host string) bool {
+	for _, pattern := range p.AllowedHosts {
+		if ok, _ := path.Match(strings.ToLower(pattern), host); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// requestHost returns the lowercase hostname of a request without its port
+func requestHost(r *http.Request) string {
+	host := r.URL.Host
+	if host == "" {
+		host = r.Host
+	}
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.ToLower(strings.TrimSuffix(host, "."))
+}
+
+func contains(items []string, item string) bool {
+	for _, i := range items {
+		if i == item {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,105 @@
+package policy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+var testPolicy = Policy{
+	AllowedHosts:   []string{"*.googleapis.com", "accounts.google.com"},
+	AllowedMethods: []string{"GET", "HEAD", "OPTIONS", "POST", "PUT", "PATCH", "DELETE"},
+}
+
+func TestCheck(t *testing.T) {
+	readOnly := testPolicy
+	readOnly.ReadOnly = true
+
+	tests := []struct {
+		name    string
+		policy  Policy
+		method  string
+		url     string
+		allowed bool
+	}{
+		{"allowed host", testPolicy, "GET", "https://storage.googleapis.com/storage/v1/b", true},
+		{"allowed host with port", testPolicy, "GET", "https://compute.googleapis.com:443/compute/v1", true},
+		{"exact host", testPolicy, "POST", "https://accounts.google.com/o/oauth2/token", true},
+		{"uppercase host", testPolicy, "GET", "https://STORAGE.googleapis.com/", true},
+		{"non-google host", testPolicy, "GET", "https://example.com/", false},
+		{"lookalike host", testPolicy, "GET", "https://googleapis.com.example.com/", false},
+		{"bare domain", testPolicy, "GET", "https://googleapis.com/", false},
+		{"disallowed method", testPolicy, "TRACE", "https://storage.googleapis.com/", false},
+		{"read-only get", readOnly, "GET", "https://storage.googleapis.com/", true},
+		{"read-only delete", readOnly, "DELETE", "https://storage.googleapis.com/storage/v1/b/bucket", false},
+		{"read-only post", readOnly, "POST", "https://compute.googleapis.com/compute/v1/projects/p/zones/z/instances", false},
+		{"read-only head", readOnly, "HEAD", "https://storage.googleapis.com/", true},
+		{"read-only rpc", readOnly, "POST", "https://cloudresourcemanager.googleapis.com/v1/projects/p:getIamPolicy", true},
+		{"read-only test permissions", readOnly, "POST", "https://cloudresourcemanager.googleapis.com/v1/projects/p:testIamPermissions", true},
+		{"read-only mutating rpc", readOnly, "POST", "https://cloudresourcemanager.googleapis.com/v1/projects/p:setIamPolicy", false},
+		{"read-only rpc with get prefix", readOnly, "POST", "https://example.googleapis.com/v1/things/t:getAndDelete", false},
+		{"read-only token refresh", readOnly, "POST", "https://oauth2.googleapis.com/token", true},
+		{"read-only put", readOnly, "PUT", "https://storage.googleapis.com/upload/bucket:get", false},
+		{"read-only rpc on a versionless path", readOnly, "POST", "https://storage.googleapis.com/storage/v1/b/src/o/obj/copyTo/b/dst/o/x:get", false},
+		{"read-only rpc in an escaped name", readOnly, "POST", "https://storage.googleapis.com/storage/v1/b/src/o/obj/rewriteTo/b/dst/o/x%3Alist", false},
+		{"read-only escaped rpc", readOnly, "POST", "https://cloudresourcemanager.googleapis.com/v1/projects/p%3AgetIamPolicy", false},
+		{"read-only rpc after dot segment", readOnly, "POST", "https://cloudresourcemanager.googleapis.com/v1/projects/p:setIamPolicy/..%2F..:get", false},
+		{"read-only rpc with colon in parent", readOnly, "POST", "https://cloudresourcemanager.googleapis.com/v1/projects/p:delete/x:get", false},
+		{"read-only versioned rpc", readOnly, "POST", "https://cloudasset.googleapis.com/v1p1beta1/organizations/1:searchAllResources", true},
+		{"read-only beta rpc", readOnly, "POST", "https://iam.googleapis.com/v1beta1/roles:queryGrantableRoles", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, tt.url, nil)
+			err := tt.policy.Check(r)
+			if tt.allowed && err != nil {
+				t.Errorf("Check(%s %s) = %v, want it to be allowed", tt.method, tt.url, err)
+			} else if !tt.allowed {
+				if _, ok := err.(*DeniedError); !ok {
+					t.Errorf("Check(%s %s) = %v, want a *DeniedError", tt.method, tt.url, err)
+				}
+			}
+		})
+	}
+}
+
+func TestCheckMethodOverride(t *testing.T) {
+	readOnly := testPolicy
+	readOnly.ReadOnly = true
+
+	for _, header := range []string{"X-HTTP-Method-Override", "X-HTTP-Method", "x-http-method-override"} {
+		t.Run(header, func(t *testing.T) {
+			r := httptest.NewRequest("POST", "https://storage.googleapis.com/storage/v1/b/bucket/o/obj", nil)
+			r.Header.Set(header, "DELETE")
+			if _, ok := readOnly.Check(r).(*DeniedError); !ok {
+				t.Errorf("a POST overridden with %s: DELETE was allowed in read-only mode", header)
+			}
+
+			r = httptest.NewRequest("GET", "https://storage.googleapis.com/storage/v1/b/bucket/o/obj", nil)
+			r.Header.Set(header, "DELETE")
+			if _, ok := readOnly.Check(r).(*DeniedError); !ok {
+				t.Errorf("a GET overridden with %s: DELETE was allowed in read-only mode", header)
+			}
+			if err := testPolicy.Check(r); err != nil {
+				t.Errorf("Check() = %v, want method overrides to be allowed outside read-only mode", err)
+			}
+		})
+	}
+}
+
+func TestValidate(t *testing.T) {
+	if err := testPolicy.Validate(); err != nil {
+		t.Errorf("Validate() = %v, want nil", err)
+	}
+
+	badPattern := Policy{AllowedHosts: []string{"[.googleapis.com"}, AllowedMethods: []string{http.MethodGet}}
+	if err := badPattern.Validate(); err == nil {
+		t.Error("Validate() with a malformed host pattern = nil, want an error")
+	}
+
+	lowercaseMethod := Policy{AllowedHosts: testPolicy.AllowedHosts, AllowedMethods: []string{"get"}}
+	if err := lowercaseMethod.Validate(); err == nil {
+		t.Error("Validate() with a lowercase method = nil, want an error")
+	}
+}
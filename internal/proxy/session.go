@@ -0,0 +1,307 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/spf13/viper"
+	credentialspb "google.golang.org/genproto/googleapis/iam/credentials/v1"
+
+	util "github.com/jessesomerville/ephemeral-iam/internal/eiamutil"
+	"github.com/jessesomerville/ephemeral-iam/internal/gcpclient"
+	sessionpkg "github.com/jessesomerville/ephemeral-iam/internal/session"
+	"github.com/jessesomerville/ephemeral-iam/internal/shellrc"
+)
+
+var (
+	// refreshMargin is how long before the current access token expires that
+	// a new one is generated
+	refreshMargin = time.Minute
+	// refreshRetryInterval is how long to wait before trying to generate a new
+	// access token again after a failed attempt
+	refreshRetryInterval = 15 * time.Second
+)
+
+// privilegedSession holds the state of a running privileged session that is
+// shared between the auth proxy, the sub-shell, the token refresher, and the
+// control socket
+type privilegedSession struct {
+	// requests is the number of requests sent through the auth proxy. It is
+	// the first field so that it is 64-bit aligned for atomic operations.
+	requests int64
+
+	id      string
+	svcAcct string
+	// delegates are the service accounts that svcAcct is impersonated through
+	delegates []string
+	// scopes are the OAuth scopes of the session's access tokens
+	scopes []string
+	// subject is the Google Workspace user that the session's access tokens act
+	// as through domain-wide delegation, or empty if they act as svcAcct
+	subject      string
+	project      string
+	proxyAddress string
+	// metadataAddress is the address of the session's GCE metadata server, or
+	// empty if it was not started
+	metadataAddress string
+	// credentialsFile is the application default credentials file that
+	// impersonates the service account, or empty if it was not written
+	credentialsFile string
+	gcloudConfig    string
+	kubeConfig      string
+	recording       string
+	start           time.Time
+	readOnly        bool
+
+	stopped  chan struct{}
+	stopOnce sync.Once
+
+	mu          sync.RWMutex
+	reason      string
+	end         time.Time
+	accessToken string
+	tokenExpiry time.Time
+	// kubeConfigHasToken is set once the access token is written to kubeConfig
+	kubeConfigHasToken bool
+	// changed is closed and replaced whenever the session is extended
+	changed chan struct{}
+}
+
+func newPrivilegedSession(opts SessionOptions) *privilegedSession {
+	id := util.SessionIDFromReason(opts.Reason)
+	session := &privilegedSession{
+		id:           id,
+		svcAcct:      opts.ServiceAccount,
+		delegates:    opts.Delegates,
+		scopes:       opts.Scopes,
+		subject:      opts.Subject,
+		project:      opts.Project,
+		gcloudConfig: sessionpkg.GcloudConfigPath(id),
+		kubeConfig:   sessionpkg.KubeConfigPath(id),
+		reason:       opts.Reason,
+		start:        time.Now(),
+		readOnly:     opts.ReadOnly,
+		end:          time.Now().Add(opts.Duration),
+		changed:      make(chan struct{}),
+		stopped:      make(chan struct{}),
+	}
+	session.setToken(opts.AccessToken)
+	return session
+}
+
+// token returns the access token that is currently in use
+func (s *privilegedSession) token() (string, time.Time) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.accessToken, s.tokenExpiry
+}
+
+func (s *privilegedSession) setToken(accessToken *credentialspb.GenerateAccessTokenResponse) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.accessToken = accessToken.GetAccessToken()
+	s.tokenExpiry = accessToken.GetExpireTime().AsTime()
+}
+
+// writeKubeConfig writes the current access token to the session's kubeconfig
+func (s *privilegedSession) writeKubeConfig() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := writeCredsToKubeConfig(s.kubeConfig, s.accessToken, s.tokenExpiry.Format(time.RFC3339Nano)); err != nil {
+		return err
+	}
+	s.kubeConfigHasToken = true
+	return nil
+}
+
+// refreshKubeConfig replaces the access token in the session's kubeconfig if
+// it was written there
+func (s *privilegedSession) refreshKubeConfig() error {
+	s.mu.RLock()
+	hasToken := s.kubeConfigHasToken
+	s.mu.RUnlock()
+	if !hasToken {
+		return nil
+	}
+	return s.writeKubeConfig()
+}
+
+// currentReason returns the reason that is attached to requests made during
+// the session
+func (s *privilegedSession) currentReason() string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.reason
+}
+
+// endTime returns when the session will end along with a channel that is
+// closed if the end time changes
+func (s *privilegedSession) endTime() (time.Time, <-chan struct{}) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.end, s.changed
+}
+
+// extend pushes back the end of the session by the given duration. The new
+// reason is attached to all requests made for the remainder of the session.
+func (s *privilegedSession) extend(reason string, duration time.Duration) (time.Time, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	start := s.end
+	if now := time.Now(); start.Before(now) {
+		start = now
+	}
+	newEnd := start.Add(duration)
+	if maxDuration := viper.GetDuration("session.maxduration"); time.Until(newEnd) > maxDuration {
+		return time.Time{}, fmt.Errorf("the session cannot be extended to more than %s from now", maxDuration)
+	}
+
+	s.reason = s.formatReason(reason)
+	s.end = newEnd
+	close(s.changed)
+	s.changed = make(chan struct{})
+	if err := shellrc.WriteExpiry(sessionpkg.ExpiryPath(s.id), newEnd); err != nil {
+		util.Logger.WithError(err).Error("failed to update the countdown in the privileged sub-shell's prompt")
+	}
+	return newEnd, nil
+}
+
+// writeExpiry writes the end of the session to the file that the sub-shell's
+// prompt reads it from
+func (s *privilegedSession) writeExpiry() error {
+	end, _ := s.endTime()
+	return shellrc.WriteExpiry(sessionpkg.ExpiryPath(s.id), end)
+}
+
+// formatReason formats a reason for the session so that audit logs show which
+// session, and which mode, a request was made in
+func (s *privilegedSession) formatReason(reason string) string {
+	if s.readOnly {
+		reason = util.ReadOnlyReasonPrefix + reason
+	}
+	reason = util.ReasonWithSubject(s.subject, reason)
+	return util.FormatReasonWithSessionID(s.id, reason)
+}
+
+// info returns a description of the session for the control socket
+func (s *privilegedSession) info() *sessionpkg.Info {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return &sessionpkg.Info{
+		ID:              s.id,
+		ServiceAccount:  s.svcAcct,
+		Delegates:       s.delegates,
+		Scopes:          s.scopes,
+		Subject:         s.subject,
+		Project:         s.project,
+		Reason:          s.reason,
+		Start:           s.start,
+		End:             s.end,
+		Requests:        atomic.LoadInt64(&s.requests),
+		PID:             os.Getpid(),
+		ReadOnly:        s.readOnly,
+		Recording:       s.recording,
+		CertFile:        viper.GetString("authproxy.certfile"),
+		MetadataAddress: s.metadataAddress,
+		CredentialsFile: s.credentialsFile,
+		ProxyAddress:    s.proxyAddress,
+		GcloudConfig:    s.gcloudConfig,
+		KubeConfig:      s.kubeConfig,
+	}
+}
+
+// stop ends the session before it expires
+func (s *privilegedSession) stop() {
+	s.stopOnce.Do(func() {
+		close(s.stopped)
+	})
+}
+
+// waitForEnd blocks until the session ends or is stopped, warning the user
+// when the session is about to expire
+func (s *privilegedSession) waitForEnd() {
+	warning := viper.GetDuration("session.expirywarning")
+	for {
+		end, changed := s.endTime()
+
+		warningTimer := time.NewTimer(time.Until(end.Add(-warning)))
+		endTimer := time.NewTimer(time.Until(end))
+		select {
+		case <-warningTimer.C:
+			printToShell(fmt.Sprintf(
+				"Privileged session %s expires in %s. Run `eiam session extend --reason REASON` to extend it.",
+				s.id, time.Until(end).Round(time.Second),
+			))
+			select {
+			case <-endTimer.C:
+				return
+			case <-s.stopped:
+				return
+			case <-changed:
+			}
+		case <-endTimer.C:
+			return
+		case <-s.stopped:
+			return
+		case <-changed:
+		}
+		warningTimer.Stop()
+		endTimer.Stop()
+	}
+}
+
+// refreshToken generates a new access token shortly before the current one
+// expires and swaps it into the auth proxy and the temporary kubeconfig until
+// ctx is cancelled
+func (s *privilegedSession) refreshToken(ctx context.Context) {
+	for {
+		_, expiry := s.token()
+		if end, changed := s.endTime(); !expiry.Before(end) {
+			// The current token outlives the session, so a new one is only
+			// needed if the session is extended
+			select {
+			case <-ctx.Done():
+				return
+			case <-changed:
+				continue
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Until(expiry.Add(-refreshMargin))):
+		}
+
+		for {
+			util.Logger.Debugf("Refreshing access token for %s", s.svcAcct)
+			accessToken, err := gcpclient.GenerateTemporaryAccessToken(s.svcAcct, s.subject, s.currentReason(), s.scopes, s.delegates...)
+			if err == nil {
+				s.setToken(accessToken)
+				break
+			}
+			util.Logger.WithError(err).Errorf("failed to refresh access token, retrying in %s", refreshRetryInterval)
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(refreshRetryInterval):
+			}
+		}
+
+		if err := s.refreshKubeConfig(); err != nil {
+			util.Logger.WithError(err).Error("failed to write the refreshed access token to the temp kubeconfig")
+		}
+	}
+}
+
+// printToShell writes a message to the user's terminal while the sub-shell is
+// running. The terminal is in raw mode so carriage returns are added manually.
+func printToShell(msg string) {
+	fmt.Fprintf(os.Stderr, "\r\n\x1b[33m[eiam]\x1b[0m %s\r\n", msg)
+}
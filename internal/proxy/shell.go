@@ -9,52 +9,47 @@ import (
 	"os"
 	"os/exec"
 	"os/signal"
-	"path"
+	"strings"
 	"syscall"
 
 	"github.com/creack/pty"
-	"github.com/google/uuid"
+	"github.com/spf13/viper"
 	"golang.org/x/term"
 	"k8s.io/apimachinery/pkg/runtime"
 	clientcmdapi "k8s.io/client-go/tools/clientcmd/api"
 	clientcmdapilatest "k8s.io/client-go/tools/clientcmd/api/latest"
 
-	"github.com/jessesomerville/ephemeral-iam/internal/appconfig"
 	util "github.com/jessesomerville/ephemeral-iam/internal/eiamutil"
 	errorsutil "github.com/jessesomerville/ephemeral-iam/internal/errors"
+	"github.com/jessesomerville/ephemeral-iam/internal/lifecycle"
+	"github.com/jessesomerville/ephemeral-iam/internal/recording"
+	sessionpkg "github.com/jessesomerville/ephemeral-iam/internal/session"
+	"github.com/jessesomerville/ephemeral-iam/internal/shellrc"
 )
 
-func startShell(svcAcct, accessToken, expiry string, defaultCluster map[string]string, oldState **term.State) {
-	tmpKubeConfig, err := createTempKubeConfig()
-	if err != nil {
-		util.Logger.WithError(err).Fatal("failed to create temp kubeconfig")
-	}
-	defer os.Remove(tmpKubeConfig.Name()) // Remove tmpKubeConfig after priv session ends
-
-	// Copy environment variables from user, set PS1 prompt, and set the KUBECONFIG env var
-	cmdEnv := append(os.Environ(), buildPrompt(svcAcct), fmt.Sprintf("KUBECONFIG=%s", tmpKubeConfig.Name()))
+func startShell(session *privilegedSession, lc *lifecycle.Manager, defaultCluster map[string]string, oldState **term.State) {
+	svcAcct := session.svcAcct
 
-	if len(defaultCluster) > 0 {
-		// Create the kubeconfig entry for the privileged service account
-		c := exec.Command("gcloud", "container", "clusters", "get-credentials", defaultCluster["name"], "--zone", defaultCluster["location"])
-		c.Env = cmdEnv
-		errOut := bytes.Buffer{}
-		c.Stderr = &errOut
-
-		if err := c.Run(); err != nil {
-			util.Logger.Errorf(errOut.String())
-		} else {
-			util.Logger.Infof("kubectl is now authenticated as %s", svcAcct)
-		}
-	}
-
-	if err := writeCredsToKubeConfig(tmpKubeConfig, accessToken, expiry); err != nil {
+	cmdEnv, err := sessionEnv(session, defaultCluster)
+	if err != nil {
 		util.Logger.WithError(err).Fatal("failed to write credentials to temp kubeconfig")
 	}
 
 	// Create the shell command and copy the environment variables from the previous command
-	shellCmd := exec.Command("bash")
-	shellCmd.Env = cmdEnv
+	shell, err := sessionShell()
+	if err != nil {
+		util.Logger.WithError(err).Fatal("failed to find the shell to use for the privileged sub-shell")
+	}
+	prompt := shellrc.Prompt{
+		ServiceAccount: svcAcct,
+		Project:        session.project,
+		SessionID:      session.id,
+		ExpiryFile:     sessionpkg.ExpiryPath(session.id),
+	}
+	shellCmd, err := shellrc.Command(shell, sessionpkg.Path(session.id), prompt, cmdEnv)
+	if err != nil {
+		util.Logger.WithError(err).Fatal("failed to configure the prompt of the privileged sub-shell")
+	}
 
 	util.Logger.Warn("Enter `exit` or press CTRL+D to quit privileged session")
 
@@ -63,6 +58,8 @@ func startShell(svcAcct, accessToken, expiry string, defaultCluster map[string]s
 	if err != nil {
 		util.Logger.WithError(err).Fatal("failed to start privileged sub-shell")
 	}
+	// Signals that end the session are forwarded to the sub-shell
+	lc.SetChild(shellCmd.Process)
 	defer func() {
 		if err := ptmx.Close(); err != nil {
 			util.Logger.WithError(err).Fatal("failed to close privileged sub-shell")
@@ -81,6 +78,16 @@ func startShell(svcAcct, accessToken, expiry string, defaultCluster map[string]s
 	}()
 	ch <- syscall.SIGWINCH
 
+	var output io.Writer = os.Stdout
+	if session.recording != "" {
+		recordingFile, err := startRecording(session, shellCmd.Path)
+		if err != nil {
+			util.Logger.WithError(err).Fatal("failed to start recording the privileged sub-shell")
+		}
+		defer recordingFile.Close()
+		output = io.MultiWriter(os.Stdout, recordingFile)
+	}
+
 	// Save the state of the current shell so it can be restored later
 	if *oldState, err = term.MakeRaw(int(os.Stdin.Fd())); err != nil {
 		util.Logger.WithError(err).Fatal("failed to save state of current shell")
@@ -99,41 +106,145 @@ func startShell(svcAcct, accessToken, expiry string, defaultCluster map[string]s
 	}()
 
 	// Write the output from the sub-shell to stdout
-	if _, err := io.Copy(os.Stdout, ptmx); err != nil {
+	if _, err := io.Copy(output, ptmx); err != nil {
 		// On some linux systems, this error is thrown when CTRL-D is received
 		if serr, ok := err.(*fs.PathError); ok {
 			if serr.Path == "/dev/ptmx" {
-				wg.Done()
+				session.stop()
 				return
 			}
 		} else {
 			util.Logger.WithError(err).Error("failed to write the output from the sub-shell to stdout")
 		}
 	}
-	wg.Done()
+	// End the session when the user exits the sub-shell
+	session.stop()
+}
+
+// sessionEnv returns the environment for processes started in the session. It
+// copies the user's environment and points gcloud and kubectl at the session's
+// own config files, which are configured for the service account. The user's
+// GOOGLE_APPLICATION_CREDENTIALS is removed so that client libraries don't
+// authenticate as the user instead of going through the session.
+func sessionEnv(session *privilegedSession, defaultCluster map[string]string) ([]string, error) {
+	cmdEnv := append(
+		withoutEnv(os.Environ(), envCredentials),
+		fmt.Sprintf("CLOUDSDK_CONFIG=%s", session.gcloudConfig),
+		fmt.Sprintf("KUBECONFIG=%s", session.kubeConfig),
+		fmt.Sprintf("%s=%s", sessionpkg.EnvSessionID, session.id),
+	)
+	if session.metadataAddress != "" {
+		cmdEnv = append(cmdEnv, metadataEnv(session.metadataAddress)...)
+	}
+	if session.credentialsFile != "" {
+		cmdEnv = append(cmdEnv, fmt.Sprintf("%s=%s", envCredentials, session.credentialsFile))
+	}
+
+	// kubectl talks to the clusters directly instead of through the proxy, so
+	// read-only sessions never give it the service account's token
+	if session.readOnly {
+		return cmdEnv, nil
+	}
+
+	if len(defaultCluster) > 0 {
+		// Create the kubeconfig entry for the privileged service account
+		c := exec.Command("gcloud", "container", "clusters", "get-credentials", defaultCluster["name"], "--zone", defaultCluster["location"])
+		c.Env = cmdEnv
+		errOut := bytes.Buffer{}
+		c.Stderr = &errOut
+
+		if err := c.Run(); err != nil {
+			util.Logger.Errorf(errOut.String())
+		} else {
+			util.Logger.Infof("kubectl is now authenticated as %s", session.svcAcct)
+		}
+	}
+
+	if err := session.writeKubeConfig(); err != nil {
+		return nil, err
+	}
+	return cmdEnv, nil
 }
 
-func buildPrompt(svcAcct string) string {
-	yellow := "\\[\\e[33m\\]"
-	green := "\\[\\e[36m\\]"
-	endColor := "\\[\\e[m\\]"
-	return fmt.Sprintf("PS1=\n[%s%s%s]\n[%seiam%s] > ", yellow, svcAcct, endColor, green, endColor)
+// withoutEnv returns env, which is in the form of os.Environ, without key
+func withoutEnv(env []string, key string) []string {
+	filtered := make([]string, 0, len(env))
+	for _, kv := range env {
+		if !strings.HasPrefix(kv, key+"=") {
+			filtered = append(filtered, kv)
+		}
+	}
+	return filtered
 }
 
-func createTempKubeConfig() (*os.File, error) {
-	kubeConfigDir := path.Join(appconfig.GetConfigDir(), "tmp_kube_config")
-	tmpFileName := uuid.New().String()
-	tmpKubeConfig, err := os.CreateTemp(kubeConfigDir, tmpFileName)
+// startRecording creates the session's recording file. The returned recorder
+// writes everything it is given to the file as asciicast output events.
+func startRecording(session *privilegedSession, shell string) (*recordingWriter, error) {
+	cols, rows, err := term.GetSize(int(os.Stdin.Fd()))
+	if err != nil {
+		cols, rows = 80, 24
+	}
+
+	file, err := os.OpenFile(session.recording, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o600)
 	if err != nil {
 		return nil, err
 	}
-	return tmpKubeConfig, nil
+	recorder, err := recording.NewRecorder(file, recording.Header{
+		Width:  cols,
+		Height: rows,
+		Title:  fmt.Sprintf("eiam session %s as %s", session.id, session.svcAcct),
+		Env: map[string]string{
+			"SHELL": shell,
+			"TERM":  os.Getenv("TERM"),
+		},
+	})
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	util.Logger.Infof("Recording privileged sub-shell to %s", session.recording)
+	return &recordingWriter{Recorder: recorder, file: file}, nil
 }
 
-func writeCredsToKubeConfig(tmpKubeConfig *os.File, accessToken, expiry string) error {
+// recordingWriter writes the sub-shell's output to a recording. It never
+// returns an error so that a failed recording does not interrupt the sub-shell.
+type recordingWriter struct {
+	*recording.Recorder
+	file   *os.File
+	failed bool
+}
+
+func (r *recordingWriter) Write(p []byte) (int, error) {
+	if !r.failed {
+		if _, err := r.Recorder.Write(p); err != nil {
+			r.failed = true
+			printToShell(fmt.Sprintf("Failed to record the privileged sub-shell: %v", err))
+		}
+	}
+	return len(p), nil
+}
+
+func (r *recordingWriter) Close() error {
+	return r.file.Close()
+}
+
+// sessionShell returns the shell to use for the privileged sub-shell. The
+// session.shell config value takes precedence over the user's $SHELL.
+func sessionShell() (string, error) {
+	shell := viper.GetString("session.shell")
+	if shell == "" {
+		shell = os.Getenv("SHELL")
+	}
+	if shell == "" {
+		shell = "bash"
+	}
+	return exec.LookPath(shell)
+}
+
+func writeCredsToKubeConfig(tmpKubeConfig, accessToken, expiry string) error {
 	// Read the tmpKubeConfig into a client-go config object
 	config := clientcmdapi.NewConfig()
-	configBytes, err := ioutil.ReadFile(tmpKubeConfig.Name())
+	configBytes, err := ioutil.ReadFile(tmpKubeConfig)
 	if err != nil {
 		return errorsutil.EiamError{
 			Log: util.Logger.WithError(err),
@@ -151,6 +262,9 @@ func writeCredsToKubeConfig(tmpKubeConfig *os.File, accessToken, expiry string)
 
 	// There should only be one, this is an efficient way of getting it
 	for _, authInfo := range config.AuthInfos {
+		if authInfo.AuthProvider == nil {
+			continue
+		}
 		// Write the service account's token to the temp kubeconfig
 		authInfo.AuthProvider.Config["access-token"] = accessToken
 		authInfo.AuthProvider.Config["expiry"] = expiry
@@ -165,7 +279,7 @@ func writeCredsToKubeConfig(tmpKubeConfig *os.File, accessToken, expiry string)
 			Err: err,
 		}
 	}
-	if _, err := tmpKubeConfig.Write(newConfigBytes); err != nil {
+	if err := ioutil.WriteFile(tmpKubeConfig, newConfigBytes, 0o600); err != nil {
 		return errorsutil.EiamError{
 			Log: util.Logger.WithError(err),
 			Msg: "Failed to write updated tmp kubeconfig",
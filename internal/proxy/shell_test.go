@@ -0,0 +1,131 @@
+package proxy
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	credentialspb "google.golang.org/genproto/googleapis/iam/credentials/v1"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// gkeKubeConfig is a kubeconfig like the one written by
+// `gcloud container clusters get-credentials`
+const gkeKubeConfig = `apiVersion: v1
+kind: Config
+clusters:
+- cluster:
+    server: https://203.0.113.10
+  name: gke_my-project_us-central1-a_my-cluster
+contexts:
+- context:
+    cluster: gke_my-project_us-central1-a_my-cluster
+    user: gke_my-project_us-central1-a_my-cluster
+  name: gke_my-project_us-central1-a_my-cluster
+current-context: gke_my-project_us-central1-a_my-cluster
+users:
+- name: gke_my-project_us-central1-a_my-cluster
+  user:
+    auth-provider:
+      config:
+        cmd-args: config config-helper --format=json
+        cmd-path: gcloud
+      name: gcp
+`
+
+func newTestSession(t *testing.T, readOnly bool) *privilegedSession {
+	dir, err := ioutil.TempDir("", "eiam-session")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	session := newPrivilegedSession(SessionOptions{
+		AccessToken: &credentialspb.GenerateAccessTokenResponse{
+			AccessToken: "first-token",
+			ExpireTime:  timestamppb.New(time.Now().Add(time.Hour)),
+		},
+		Reason:         "testing",
+		ServiceAccount: "target@my-project.iam.gserviceaccount.com",
+		Project:        "my-project",
+		Duration:       time.Hour,
+		ReadOnly:       readOnly,
+	})
+	session.gcloudConfig = filepath.Join(dir, "gcloud")
+	session.kubeConfig = filepath.Join(dir, "kubeconfig")
+	if err := ioutil.WriteFile(session.kubeConfig, []byte(gkeKubeConfig), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return session
+}
+
+func readKubeConfig(t *testing.T, session *privilegedSession) string {
+	data, err := ioutil.ReadFile(session.kubeConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func refreshTestToken(t *testing.T, session *privilegedSession) {
+	session.setToken(&credentialspb.GenerateAccessTokenResponse{
+		AccessToken: "second-token",
+		ExpireTime:  timestamppb.New(time.Now().Add(2 * time.Hour)),
+	})
+	if err := session.refreshKubeConfig(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSessionEnvReadOnlyKubeConfig(t *testing.T) {
+	session := newTestSession(t, true)
+	defaultCluster := map[string]string{"name": "my-cluster", "location": "us-central1-a"}
+	if _, err := sessionEnv(session, defaultCluster); err != nil {
+		t.Fatal(err)
+	}
+	refreshTestToken(t, session)
+
+	kubeConfig := readKubeConfig(t, session)
+	if strings.Contains(kubeConfig, "access-token") {
+		t.Errorf("the kubeconfig of a read-only session holds an access token:\n%s", kubeConfig)
+	}
+	if kubeConfig != gkeKubeConfig {
+		t.Errorf("the kubeconfig of a read-only session was modified:\n%s", kubeConfig)
+	}
+}
+
+func TestSessionEnvCredentials(t *testing.T) {
+	defer os.Setenv(envCredentials, os.Getenv(envCredentials))
+	os.Setenv(envCredentials, "/home/user/.config/gcloud/application_default_credentials.json")
+
+	lookup := func(env []string) []string {
+		var values []string
+		for _, kv := range env {
+			if strings.HasPrefix(kv, envCredentials+"=") {
+				values = append(values, strings.TrimPrefix(kv, envCredentials+"="))
+			}
+		}
+		return values
+	}
+
+	// A read-only session leaves the kubeconfig alone
+	session := newTestSession(t, true)
+	env, err := sessionEnv(session, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if values := lookup(env); len(values) != 0 {
+		t.Errorf("the session's environment inherited %s=%v", envCredentials, values)
+	}
+
+	session.credentialsFile = filepath.Join(filepath.Dir(session.kubeConfig), "credentials.json")
+	if env, err = sessionEnv(session, nil); err != nil {
+		t.Fatal(err)
+	}
+	if values := lookup(env); len(values) != 1 || values[0] != session.credentialsFile {
+		t.Errorf("%s = %v in the session's environment, want only %s", envCredentials, values, session.credentialsFile)
+	}
+}
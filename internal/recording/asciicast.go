@@ -0,0 +1,152 @@
+// Package recording records the output of privileged sub-shells in the
+// asciicast v2 format and plays the recordings back.
+//
+// See https://github.com/asciinema/asciinema/blob/develop/doc/asciicast-v2.md
+package recording
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// Header is the first line of an asciicast v2 recording
+type Header struct {
+	Version   int               `json:"version"`
+	Width     int               `json:"width"`
+	Height    int               `json:"height"`
+	Timestamp int64             `json:"timestamp"`
+	Title     string            `json:"title,omitempty"`
+	Env       map[string]string `json:"env,omitempty"`
+}
+
+// Recorder writes the output of a terminal as asciicast v2 output events. It
+// is safe to use from multiple goroutines.
+type Recorder struct {
+	mu      sync.Mutex
+	w       io.Writer
+	start   time.Time
+	now     func() time.Time
+	partial []byte
+}
+
+// NewRecorder writes the recording's header to w and returns a Recorder that
+// writes output events to it
+func NewRecorder(w io.Writer, header Header) (*Recorder, error) {
+	return newRecorder(w, header, time.Now)
+}
+
+func newRecorder(w io.Writer, header Header, now func() time.Time) (*Recorder, error) {
+	start := now()
+	header.Version = 2
+	header.Timestamp = start.Unix()
+	headerBytes, err := json.Marshal(header)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := fmt.Fprintf(w, "%s\n", headerBytes); err != nil {
+		return nil, err
+	}
+	return &Recorder{w: w, start: start, now: now}, nil
+}
+
+// Write records p as an output event. A multi-byte character that is split
+// across writes is held back until the rest of it is written, since each event
+// must be valid UTF-8.
+func (r *Recorder) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	data := append(r.partial, p...)
+	complete := len(data)
+	// Look for an incomplete character at the end of the data
+	for i := len(data) - 1; i >= 0 && i >= len(data)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(data[i]) {
+			if !utf8.FullRune(data[i:]) {
+				complete = i
+			}
+			break
+		}
+	}
+	r.partial = append([]byte{}, data[complete:]...)
+	if complete == 0 {
+		return len(p), nil
+	}
+
+	event, err := json.Marshal([]interface{}{
+		r.now().Sub(r.start).Seconds(),
+		"o",
+		string(data[:complete]),
+	})
+	if err != nil {
+		return 0, err
+	}
+	if _, err := fmt.Fprintf(r.w, "%s\n", event); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Replay writes the output events of a recording to w with their original
+// timing divided by speed. Pauses between events are capped at idleLimit if it
+// is greater than zero.
+func Replay(recording io.Reader, w io.Writer, speed float64, idleLimit time.Duration) error {
+	return replay(recording, w, speed, idleLimit, time.Sleep)
+}
+
+func replay(recording io.Reader, w io.Writer, speed float64, idleLimit time.Duration, sleep func(time.Duration)) error {
+	if speed <= 0 {
+		return fmt.Errorf("the playback speed must be greater than 0")
+	}
+
+	scanner := bufio.NewScanner(recording)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	if !scanner.Scan() {
+		if err := scanner.Err(); err != nil {
+			return err
+		}
+		return fmt.Errorf("the recording is empty")
+	}
+	var header Header
+	if err := json.Unmarshal(scanner.Bytes(), &header); err != nil {
+		return fmt.Errorf("failed to parse recording header: %v", err)
+	}
+	if header.Version != 2 {
+		return fmt.Errorf("unsupported asciicast version %d", header.Version)
+	}
+
+	var last float64
+	for scanner.Scan() {
+		var event []interface{}
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			return fmt.Errorf("failed to parse recording event: %v", err)
+		}
+		if len(event) != 3 {
+			return fmt.Errorf("invalid recording event: %s", scanner.Text())
+		}
+		elapsed, ok := event[0].(float64)
+		eventType, _ := event[1].(string)
+		data, _ := event[2].(string)
+		if !ok || eventType != "o" {
+			continue
+		}
+
+		pause := time.Duration((elapsed - last) / speed * float64(time.Second))
+		if idleLimit > 0 && pause > idleLimit {
+			pause = idleLimit
+		}
+		if pause > 0 {
+			sleep(pause)
+		}
+		last = elapsed
+
+		if _, err := io.WriteString(w, data); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
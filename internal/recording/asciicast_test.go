@@ -0,0 +1,92 @@
+package recording
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+func TestRecordAndReplay(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(1600000000, 0)}
+	var cast bytes.Buffer
+	r, err := newRecorder(&cast, Header{Width: 80, Height: 24, Title: "test"}, clock.Now)
+	if err != nil {
+		t.Fatalf("failed to create recorder: %v", err)
+	}
+
+	// "é" is split across two writes
+	accent := []byte("é")
+	writes := [][]byte{
+		[]byte("$ gcloud projects list\r\n"),
+		append([]byte("caf"), accent[0]),
+		append([]byte{accent[1]}, []byte("\r\n")...),
+	}
+	for i, w := range writes {
+		clock.now = clock.now.Add(time.Duration(i+1) * time.Second)
+		if _, err := r.Write(w); err != nil {
+			t.Fatalf("failed to write to recorder: %v", err)
+		}
+	}
+
+	lines := strings.Split(strings.TrimSpace(cast.String()), "\n")
+	if len(lines) != 4 {
+		t.Fatalf("recording has %d lines, want a header and 3 events:\n%s", len(lines), cast.String())
+	}
+	var header Header
+	if err := json.Unmarshal([]byte(lines[0]), &header); err != nil {
+		t.Fatalf("failed to parse header: %v", err)
+	}
+	if header.Version != 2 || header.Width != 80 || header.Height != 24 || header.Timestamp != 1600000000 {
+		t.Errorf("unexpected header: %+v", header)
+	}
+	if want := `[6,"o","é\r\n"]`; lines[3] != want {
+		t.Errorf("last event = %s, want %s", lines[3], want)
+	}
+
+	var pauses []time.Duration
+	var out bytes.Buffer
+	sleep := func(d time.Duration) { pauses = append(pauses, d) }
+	if err := replay(bytes.NewReader(cast.Bytes()), &out, 2, 2*time.Second, sleep); err != nil {
+		t.Fatalf("failed to replay recording: %v", err)
+	}
+
+	if want := "$ gcloud projects list\r\ncafé\r\n"; out.String() != want {
+		t.Errorf("replayed output = %q, want %q", out.String(), want)
+	}
+	// Events are 1s, 2s and 3s apart, played at double speed and capped at 2s
+	wantPauses := []time.Duration{500 * time.Millisecond, time.Second, 1500 * time.Millisecond}
+	if len(pauses) != len(wantPauses) {
+		t.Fatalf("replay paused %v, want %v", pauses, wantPauses)
+	}
+	for i := range pauses {
+		if pauses[i] != wantPauses[i] {
+			t.Errorf("replay paused %v, want %v", pauses, wantPauses)
+			break
+		}
+	}
+}
+
+func TestReplayInvalidRecording(t *testing.T) {
+	tests := map[string]string{
+		"empty":           "",
+		"wrong version":   `{"version":1}`,
+		"malformed event": "{\"version\":2}\n[1,\"o\"",
+	}
+	for name, cast := range tests {
+		t.Run(name, func(t *testing.T) {
+			if err := Replay(strings.NewReader(cast), &bytes.Buffer{}, 1, 0); err == nil {
+				t.Error("Replay() = nil, want an error")
+			}
+		})
+	}
+}
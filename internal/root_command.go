@@ -72,6 +72,7 @@ func (rc *RootCommand) LoadPlugins() error {
 		if p, loaded, err := rc.loadPlugin(path); err != nil {
 			return err
 		} else if loaded {
+			rc.chainPersistentPreRun(p.Command)
 			rc.AddCommand(p.Command)
 			p.Path = path
 			loadedPlugins = append(loadedPlugins, p)
@@ -84,6 +85,37 @@ func (rc *RootCommand) LoadPlugins() error {
 	return nil
 }
 
+// chainPersistentPreRun makes the persistent pre-run hooks of a plugin's
+// commands run the root command's hook first. Cobra only runs the hook of the
+// closest command that has one, so a plugin's hook would otherwise skip eiam's
+// credential setup.
+func (rc *RootCommand) chainPersistentPreRun(cmd *cobra.Command) {
+	rootHook := rc.PersistentPreRunE
+	if rootHook == nil {
+		return
+	}
+	if pluginHook := cmd.PersistentPreRunE; pluginHook != nil {
+		cmd.PersistentPreRunE = func(c *cobra.Command, args []string) error {
+			if err := rootHook(c, args); err != nil {
+				return err
+			}
+			return pluginHook(c, args)
+		}
+	} else if pluginHook := cmd.PersistentPreRun; pluginHook != nil {
+		cmd.PersistentPreRun = nil
+		cmd.PersistentPreRunE = func(c *cobra.Command, args []string) error {
+			if err := rootHook(c, args); err != nil {
+				return err
+			}
+			pluginHook(c, args)
+			return nil
+		}
+	}
+	for _, sub := range cmd.Commands() {
+		rc.chainPersistentPreRun(sub)
+	}
+}
+
 func (rc *RootCommand) PrintPlugins() {
 	var buf bytes.Buffer
 	w := tabwriter.NewWriter(&buf, 0, 4, 4, ' ', 0)
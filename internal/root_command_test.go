@@ -0,0 +1,86 @@
+package eiam_plugin
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/spf13/cobra"
+)
+
+func TestChainPersistentPreRun(t *testing.T) {
+	var calls []string
+	rc := &RootCommand{Command: cobra.Command{
+		Use: "eiam",
+		PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+			calls = append(calls, "root")
+			return nil
+		},
+	}}
+
+	plugin := &cobra.Command{
+		Use: "plugin",
+		PersistentPreRun: func(cmd *cobra.Command, args []string) {
+			calls = append(calls, "plugin")
+		},
+	}
+	sub := &cobra.Command{
+		Use: "sub",
+		PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+			calls = append(calls, "sub")
+			return nil
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			calls = append(calls, "run")
+			return nil
+		},
+	}
+	plugin.AddCommand(sub)
+	plain := &cobra.Command{
+		Use: "plain",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			calls = append(calls, "run")
+			return nil
+		},
+	}
+	plugin.AddCommand(plain)
+
+	rc.chainPersistentPreRun(plugin)
+	rc.AddCommand(plugin)
+
+	tests := []struct {
+		args []string
+		want string
+	}{
+		{[]string{"plugin", "sub"}, "root,sub,run"},
+		{[]string{"plugin", "plain"}, "root,plugin,run"},
+	}
+	for _, tt := range tests {
+		calls = nil
+		rc.SetArgs(tt.args)
+		if err := rc.Execute(); err != nil {
+			t.Fatal(err)
+		}
+		if got := strings.Join(calls, ","); got != tt.want {
+			t.Errorf("eiam %s ran %s, want %s", strings.Join(tt.args, " "), got, tt.want)
+		}
+	}
+
+	// The plugin's hook doesn't run if the root command's hook fails
+	rc.PersistentPreRunE = func(cmd *cobra.Command, args []string) error {
+		return errors.New("no credentials")
+	}
+	failing := &cobra.Command{
+		Use:               "failing",
+		PersistentPreRunE: func(cmd *cobra.Command, args []string) error { t.Error("the plugin's hook ran"); return nil },
+		Run:               func(cmd *cobra.Command, args []string) {},
+	}
+	rc.chainPersistentPreRun(failing)
+	rc.AddCommand(failing)
+	rc.SetArgs([]string{"failing"})
+	rc.SilenceErrors = true
+	rc.SilenceUsage = true
+	if err := rc.Execute(); err == nil {
+		t.Error("expected the root command's error")
+	}
+}
@@ -0,0 +1,154 @@
+package session
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"syscall"
+	"time"
+
+	util "github.com/jessesomerville/ephemeral-iam/internal/eiamutil"
+	errorsutil "github.com/jessesomerville/ephemeral-iam/internal/errors"
+)
+
+// List returns the info of every running session. The state left behind by
+// sessions that are no longer running is removed, and sessions whose status
+// can't be read are skipped with a warning.
+func List() ([]*Info, error) {
+	ids, err := socketIDs()
+	if err != nil {
+		return nil, err
+	}
+
+	sessions := []*Info{}
+	for _, id := range ids {
+		if isStale(id) {
+			util.Logger.Debugf("Removing state of stopped session %s", id)
+			if err := Remove(id); err != nil {
+				util.Logger.WithError(err).Warnf("Failed to remove state of stopped session %s", id)
+			}
+			continue
+		}
+		info, err := Status(id)
+		if err != nil {
+			util.Logger.WithError(err).Warnf("Skipping session %s, its status could not be read", id)
+			continue
+		}
+		sessions = append(sessions, info)
+	}
+	return sessions, nil
+}
+
+// Status returns the info of a running session
+func Status(id string) (*Info, error) {
+	var info Info
+	if err := call(id, http.MethodGet, "/status", nil, &info); err != nil {
+		return nil, err
+	}
+	return &info, nil
+}
+
+// Stop asks a running session to shut down
+func Stop(id string) error {
+	return call(id, http.MethodPost, "/stop", nil, nil)
+}
+
+// Extend asks a running session to extend its lifetime by the given duration
+func Extend(id, reason string, duration time.Duration) (time.Time, error) {
+	var resp ExtendResponse
+	req := ExtendRequest{Reason: reason, Duration: duration.String()}
+	if err := call(id, http.MethodPost, "/extend", req, &resp); err != nil {
+		return time.Time{}, err
+	}
+	return resp.End, nil
+}
+
+// isStale checks if nothing is listening on a session's control socket
+func isStale(id string) bool {
+	conn, err := net.Dial("unix", SocketPath(id))
+	if err != nil {
+		return errors.Is(err, syscall.ECONNREFUSED)
+	}
+	conn.Close()
+	return false
+}
+
+// call sends a request to the control socket of a session and decodes the
+// response into out
+func call(id, method, path string, in, out interface{}) error {
+	socketPath := SocketPath(id)
+	client := &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", socketPath)
+			},
+		},
+		Timeout: time.Minute,
+	}
+
+	var body bytes.Buffer
+	if in != nil {
+		if err := json.NewEncoder(&body).Encode(in); err != nil {
+			return errorsutil.EiamError{
+				Log: util.Logger.WithError(err),
+				Msg: "Failed to encode session control request",
+				Err: err,
+			}
+		}
+	}
+	req, err := http.NewRequest(method, "http://eiam"+path, &body)
+	if err != nil {
+		return errorsutil.EiamError{
+			Log: util.Logger.WithError(err),
+			Msg: "Failed to create session control request",
+			Err: err,
+		}
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return errorsutil.EiamError{
+			Log: util.Logger.WithError(err),
+			Msg: fmt.Sprintf("Failed to connect to session %s. Is it still running?", id),
+			Err: err,
+		}
+	}
+	defer resp.Body.Close()
+
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return errorsutil.EiamError{
+			Log: util.Logger.WithError(err),
+			Msg: "Failed to read session control response",
+			Err: err,
+		}
+	}
+	if resp.StatusCode != http.StatusOK {
+		var errResp ErrorResponse
+		if err := json.Unmarshal(respBody, &errResp); err != nil || errResp.Error == "" {
+			errResp.Error = resp.Status
+		}
+		err := fmt.Errorf("%s", errResp.Error)
+		return errorsutil.EiamError{
+			Log: util.Logger.WithError(err),
+			Msg: fmt.Sprintf("Session %s rejected the request", id),
+			Err: err,
+		}
+	}
+	if out != nil {
+		if err := json.Unmarshal(respBody, out); err != nil {
+			return errorsutil.EiamError{
+				Log: util.Logger.WithError(err),
+				Msg: "Failed to decode session control response",
+				Err: err,
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,121 @@
+package session
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	util "github.com/jessesomerville/ephemeral-iam/internal/eiamutil"
+	errorsutil "github.com/jessesomerville/ephemeral-iam/internal/errors"
+)
+
+const journalName = "journal.json"
+
+// journalGracePeriod is how long a session directory without a journal is left
+// alone, since the journal is written right after the directory is created
+var journalGracePeriod = time.Minute
+
+// Journal records the state that a session creates so that it can be cleaned
+// up if the session is not shut down properly
+type Journal struct {
+	ID           string    `json:"id"`
+	PID          int       `json:"pid"`
+	Start        time.Time `json:"start"`
+	GcloudConfig string    `json:"gcloudConfig"`
+	KubeConfig   string    `json:"kubeConfig"`
+}
+
+// JournalPath returns the path to the journal of the given session
+func JournalPath(id string) string {
+	return filepath.Join(Path(id), journalName)
+}
+
+func writeJournal(id string) error {
+	journal := Journal{
+		ID:           id,
+		PID:          os.Getpid(),
+		Start:        time.Now(),
+		GcloudConfig: GcloudConfigPath(id),
+		KubeConfig:   KubeConfigPath(id),
+	}
+	journalBytes, err := json.MarshalIndent(journal, "", "  ")
+	if err != nil {
+		return errorsutil.EiamError{
+			Log: util.Logger.WithError(err),
+			Msg: "Failed to encode session journal",
+			Err: err,
+		}
+	}
+	if err := ioutil.WriteFile(JournalPath(id), journalBytes, 0o600); err != nil {
+		return errorsutil.EiamError{
+			Log: util.Logger.WithError(err),
+			Msg: fmt.Sprintf("Failed to write session journal %s", JournalPath(id)),
+			Err: err,
+		}
+	}
+	return nil
+}
+
+func readJournal(id string) (*Journal, error) {
+	journalBytes, err := ioutil.ReadFile(JournalPath(id))
+	if err != nil {
+		return nil, err
+	}
+	var journal Journal
+	if err := json.Unmarshal(journalBytes, &journal); err != nil {
+		return nil, err
+	}
+	return &journal, nil
+}
+
+// RemoveStale removes the state of sessions whose process is no longer running,
+// e.g. because it was killed or crashed, and returns their IDs. Sessions whose
+// state can't be removed are skipped with a warning.
+func RemoveStale() ([]string, error) {
+	entries, err := os.ReadDir(Dir())
+	if os.IsNotExist(err) {
+		return []string{}, nil
+	} else if err != nil {
+		return nil, errorsutil.EiamError{
+			Log: util.Logger.WithError(err),
+			Msg: "Failed to read session directory",
+			Err: err,
+		}
+	}
+
+	removed := []string{}
+	for _, entry := range entries {
+		if !entry.IsDir() || !isAbandoned(entry.Name()) {
+			continue
+		}
+		if err := Remove(entry.Name()); err != nil {
+			util.Logger.WithError(err).Warnf("Failed to remove the state of abandoned session %s", entry.Name())
+			continue
+		}
+		removed = append(removed, entry.Name())
+	}
+	return removed, nil
+}
+
+// isAbandoned checks if the process that created a session is gone
+func isAbandoned(id string) bool {
+	journal, err := readJournal(id)
+	if err != nil {
+		info, statErr := os.Stat(Path(id))
+		return statErr == nil && time.Since(info.ModTime()) > journalGracePeriod
+	}
+	return !processRunning(journal.PID)
+}
+
+func processRunning(pid int) bool {
+	if pid <= 0 {
+		return false
+	}
+	err := syscall.Kill(pid, 0)
+	return err == nil || errors.Is(err, syscall.EPERM)
+}
@@ -0,0 +1,255 @@
+package session
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+
+	"github.com/jessesomerville/ephemeral-iam/internal/appconfig"
+	util "github.com/jessesomerville/ephemeral-iam/internal/eiamutil"
+	errorsutil "github.com/jessesomerville/ephemeral-iam/internal/errors"
+)
+
+// EnvSessionID is the environment variable that holds the ID of the privileged
+// session that a sub-shell belongs to
+const EnvSessionID = "EIAM_SESSION_ID"
+
+const (
+	socketName       = "control.sock"
+	gcloudConfigName = "gcloud"
+	kubeConfigName   = "kubeconfig"
+	expiryName       = "expiry"
+	credentialsName  = "credentials.json"
+	recordingSuffix  = ".cast"
+)
+
+// Info describes a running privileged session
+type Info struct {
+	ID             string    `json:"id"`
+	ServiceAccount string    `json:"serviceAccount"`
+	Delegates      []string  `json:"delegates,omitempty"`
+	Scopes         []string  `json:"scopes,omitempty"`
+	Subject        string    `json:"subject,omitempty"`
+	Project        string    `json:"project"`
+	Reason         string    `json:"reason"`
+	Start          time.Time `json:"start"`
+	End            time.Time `json:"end"`
+	Requests       int64     `json:"requests"`
+	PID            int       `json:"pid"`
+	ReadOnly       bool      `json:"readOnly"`
+	ProxyAddress   string    `json:"proxyAddress"`
+	GcloudConfig   string    `json:"gcloudConfig"`
+	KubeConfig     string    `json:"kubeConfig"`
+	CertFile       string    `json:"certFile"`
+	// MetadataAddress is the address of the session's GCE metadata server, if
+	// it was started
+	MetadataAddress string `json:"metadataAddress,omitempty"`
+	// CredentialsFile is the application default credentials file that
+	// impersonates the service account, if it was written
+	CredentialsFile string `json:"credentialsFile,omitempty"`
+	Recording       string `json:"recording,omitempty"`
+}
+
+// Remaining returns how much longer the session will last
+func (i *Info) Remaining() time.Duration {
+	if remaining := time.Until(i.End); remaining > 0 {
+		return remaining
+	}
+	return 0
+}
+
+// ExtendRequest is the body of a request to extend a running session
+type ExtendRequest struct {
+	Reason   string `json:"reason"`
+	Duration string `json:"duration"`
+}
+
+// ExtendResponse is the body of the response to an ExtendRequest
+type ExtendResponse struct {
+	End time.Time `json:"end"`
+}
+
+// ErrorResponse is returned by the control socket when a request fails
+type ErrorResponse struct {
+	Error string `json:"error"`
+}
+
+// Dir returns the directory that holds the state of running sessions
+func Dir() string {
+	return filepath.Join(appconfig.GetConfigDir(), "sessions")
+}
+
+// Path returns the directory that holds the state of the given session
+func Path(id string) string {
+	return filepath.Join(Dir(), id)
+}
+
+// SocketPath returns the path to the control socket for the given session
+func SocketPath(id string) string {
+	return filepath.Join(Path(id), socketName)
+}
+
+// GcloudConfigPath returns the path to the gcloud configuration directory that
+// is used by the given session
+func GcloudConfigPath(id string) string {
+	return filepath.Join(Path(id), gcloudConfigName)
+}
+
+// KubeConfigPath returns the path to the kubeconfig that is used by the given
+// session
+func KubeConfigPath(id string) string {
+	return filepath.Join(Path(id), kubeConfigName)
+}
+
+// CredentialsPath returns the path to the application default credentials file
+// that impersonates the given session's service account
+func CredentialsPath(id string) string {
+	return filepath.Join(Path(id), credentialsName)
+}
+
+// ExpiryPath returns the path to the file that the given session's prompt reads
+// its end time from
+func ExpiryPath(id string) string {
+	return filepath.Join(Path(id), expiryName)
+}
+
+// RecordingPath returns the path to write a new recording of the given
+// session's sub-shell to. Recordings are kept in the auth proxy's log directory
+// so that they outlive the session.
+func RecordingPath(id string) string {
+	timestamp := time.Now().Format("20060102150405")
+	return filepath.Join(viper.GetString("authproxy.logdir"), fmt.Sprintf("%s_%s%s", timestamp, id, recordingSuffix))
+}
+
+// FindRecording returns the path to the recording of the given session
+func FindRecording(id string) (string, error) {
+	matches, err := filepath.Glob(filepath.Join(viper.GetString("authproxy.logdir"), "*_"+id+recordingSuffix))
+	if err == nil && len(matches) == 0 {
+		err = fmt.Errorf("no recording found for session %s", id)
+	}
+	if err != nil {
+		return "", errorsutil.EiamError{
+			Log: util.Logger.WithError(err),
+			Msg: "Failed to find session recording",
+			Err: err,
+		}
+	}
+	return matches[len(matches)-1], nil
+}
+
+// Create creates the directory that holds the state of the given session and
+// journals the files that the session will create. Only the current user is
+// able to read it.
+func Create(id string) error {
+	if err := os.MkdirAll(Path(id), 0o700); err != nil {
+		return errorsutil.EiamError{
+			Log: util.Logger.WithError(err),
+			Msg: fmt.Sprintf("Failed to create session directory %s", Path(id)),
+			Err: err,
+		}
+	}
+	return writeJournal(id)
+}
+
+// Remove deletes the state of the given session
+func Remove(id string) error {
+	if err := os.RemoveAll(Path(id)); err != nil {
+		return errorsutil.EiamError{
+			Log: util.Logger.WithError(err),
+			Msg: fmt.Sprintf("Failed to remove session directory %s", Path(id)),
+			Err: err,
+		}
+	}
+	return nil
+}
+
+// Listen creates the control socket for the given session. Only the current
+// user is able to connect to it.
+func Listen(id string) (net.Listener, error) {
+	socketPath := SocketPath(id)
+	// Remove a socket left behind by a session that was not shut down properly
+	if err := os.Remove(socketPath); err != nil && !os.IsNotExist(err) {
+		return nil, errorsutil.EiamError{
+			Log: util.Logger.WithError(err),
+			Msg: fmt.Sprintf("Failed to remove stale control socket %s", socketPath),
+			Err: err,
+		}
+	}
+
+	l, err := net.Listen("unix", socketPath)
+	if err != nil {
+		return nil, errorsutil.EiamError{
+			Log: util.Logger.WithError(err),
+			Msg: fmt.Sprintf("Failed to create control socket %s", socketPath),
+			Err: err,
+		}
+	}
+	if err := os.Chmod(socketPath, 0o600); err != nil {
+		l.Close()
+		return nil, errorsutil.EiamError{
+			Log: util.Logger.WithError(err),
+			Msg: fmt.Sprintf("Failed to update the file permissions for %s", socketPath),
+			Err: err,
+		}
+	}
+	return l, nil
+}
+
+// ResolveID determines which session a command should act on. If no ID is
+// provided, the session that the current sub-shell belongs to is used. Outside
+// of a privileged sub-shell, the only running session is used.
+func ResolveID(id string) (string, error) {
+	if id != "" {
+		return id, nil
+	}
+	if envID := os.Getenv(EnvSessionID); envID != "" {
+		return envID, nil
+	}
+
+	ids, err := socketIDs()
+	if err != nil {
+		return "", err
+	}
+	switch len(ids) {
+	case 0:
+		err = fmt.Errorf("no privileged sessions are running")
+	case 1:
+		return ids[0], nil
+	default:
+		err = fmt.Errorf("multiple privileged sessions are running, please provide one of: %s", strings.Join(ids, ", "))
+	}
+	return "", errorsutil.EiamError{
+		Log: util.Logger.WithError(err),
+		Msg: "Failed to determine which session to use",
+		Err: err,
+	}
+}
+
+func socketIDs() ([]string, error) {
+	entries, err := os.ReadDir(Dir())
+	if os.IsNotExist(err) {
+		return []string{}, nil
+	} else if err != nil {
+		return nil, errorsutil.EiamError{
+			Log: util.Logger.WithError(err),
+			Msg: "Failed to read session directory",
+			Err: err,
+		}
+	}
+
+	ids := []string{}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		if _, err := os.Stat(SocketPath(entry.Name())); err == nil {
+			ids = append(ids, entry.Name())
+		}
+	}
+	return ids, nil
+}
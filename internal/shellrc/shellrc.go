@@ -0,0 +1,234 @@
+// Package shellrc starts the user's shell for a privileged sub-shell. The eiam
+// prompt is set by generated rc files which load the user's own rc files first,
+// so that their aliases, functions and history settings are kept.
+//
+// The prompt shows how much longer the session will last. The shell reads the
+// end of the session from an expiry file each time the prompt is drawn, so the
+// countdown stays current when the session is extended.
+package shellrc
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Prompt holds the values shown in the privileged sub-shell's prompt
+type Prompt struct {
+	ServiceAccount string
+	Project        string
+	SessionID      string
+	// ExpiryFile is the file written by WriteExpiry that holds the end of the
+	// session
+	ExpiryFile string
+}
+
+// shortIDLength is the number of characters of the session ID that are shown
+// in the prompt
+const shortIDLength = 8
+
+// shortID returns the start of the session ID, which is enough to tell
+// sessions apart
+func (p Prompt) shortID() string {
+	if len(p.SessionID) > shortIDLength {
+		return p.SessionID[:shortIDLength]
+	}
+	return p.SessionID
+}
+
+// WriteExpiry writes the end of the session to the expiry file that the prompt
+// reads. The file is replaced atomically so a prompt is never drawn from a
+// partially written file.
+func WriteExpiry(path string, end time.Time) error {
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, []byte(strconv.FormatInt(end.Unix(), 10)+"\n"), 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+const (
+	bashRCName = "bashrc"
+	zshDirName = "zsh"
+	fishRCName = "config.fish"
+
+	// envUserZDOTDIR holds the user's ZDOTDIR while zsh is pointed at the
+	// generated rc files
+	envUserZDOTDIR = "EIAM_USER_ZDOTDIR"
+)
+
+// Command returns the command that starts shell as an interactive shell with
+// the eiam prompt. The rc files it needs are written to dir, and env is the
+// environment that the shell is started with.
+func Command(shell, dir string, prompt Prompt, env []string) (*exec.Cmd, error) {
+	// Don't modify the caller's environment
+	env = append([]string{}, env...)
+
+	var (
+		cmd *exec.Cmd
+		err error
+	)
+	switch filepath.Base(shell) {
+	case "bash":
+		cmd, err = bashCommand(shell, dir, prompt)
+	case "zsh":
+		cmd, err = zshCommand(shell, dir, prompt, env)
+	case "fish":
+		cmd, err = fishCommand(shell, dir, prompt)
+	default:
+		// Other shells don't have a common way to load extra rc files or run a
+		// function from the prompt, so only a plain prompt without the
+		// countdown is set
+		cmd = exec.Command(shell)
+		cmd.Env = append(env, fmt.Sprintf("PS1=[%s] [%s] [eiam %s] > ", prompt.ServiceAccount, prompt.Project, prompt.shortID()))
+		return cmd, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	cmd.Env = append(env, cmd.Env...)
+	return cmd, nil
+}
+
+// remainingFunc is a function for bash and zsh that prints how much longer the
+// session will last
+const remainingFunc = `__eiam_remaining() {
+    local expiry left
+    read -r expiry 2>/dev/null < %s || expiry=0
+    left=$(( expiry - $(date +%%s) ))
+    if [ "$left" -le 0 ]; then
+        printf 'expired'
+    elif [ "$left" -ge 3600 ]; then
+        printf '%%dh%%02dm left' $(( left / 3600 )) $(( left %% 3600 / 60 ))
+    else
+        printf '%%dm left' $(( (left + 59) / 60 ))
+    fi
+}
+`
+
+func bashCommand(shell, dir string, prompt Prompt) (*exec.Cmd, error) {
+	// The countdown is a command substitution, which bash runs every time the
+	// prompt is drawn
+	rc := fmt.Sprintf(`[ -f ~/.bashrc ] && . ~/.bashrc
+`+remainingFunc+`PS1=%s
+`, Quote(prompt.ExpiryFile), Quote(fmt.Sprintf(
+		`\n[\[\e[33m\]%s\[\e[m\]] [\[\e[32m\]%s\[\e[m\]] [\[\e[31m\]$(__eiam_remaining)\[\e[m\]]\n[\[\e[36m\]eiam %s\[\e[m\]] > `,
+		prompt.ServiceAccount, prompt.Project, prompt.shortID(),
+	)))
+
+	rcPath := filepath.Join(dir, bashRCName)
+	if err := ioutil.WriteFile(rcPath, []byte(rc), 0o600); err != nil {
+		return nil, err
+	}
+	return exec.Command(shell, "--rcfile", rcPath, "-i"), nil
+}
+
+func zshCommand(shell, dir string, prompt Prompt, env []string) (*exec.Cmd, error) {
+	zdotdir := filepath.Join(dir, zshDirName)
+	if err := os.MkdirAll(zdotdir, 0o700); err != nil {
+		return nil, err
+	}
+
+	// zsh reads its rc files from ZDOTDIR, so it is pointed at the generated
+	// files which switch ZDOTDIR back to the user's before loading theirs
+	zshenv := fmt.Sprintf(`ZDOTDIR="$%[1]s"
+[ -f "$ZDOTDIR/.zshenv" ] && . "$ZDOTDIR/.zshenv"
+%[1]s="$ZDOTDIR"
+ZDOTDIR=%[2]s
+`, envUserZDOTDIR, Quote(zdotdir))
+	// The prompt is rebuilt by a precmd hook so that the user's PROMPT_SUBST
+	// setting doesn't need to be changed. Percent signs are escaped since the
+	// prompt is still subject to prompt expansion.
+	zshrc := fmt.Sprintf(`ZDOTDIR="$%s"
+[ -f "$ZDOTDIR/.zshrc" ] && . "$ZDOTDIR/.zshrc"
+`+remainingFunc+`__eiam_prompt() {
+    PROMPT=%s"$(__eiam_remaining)"%s
+}
+precmd_functions+=(__eiam_prompt)
+__eiam_prompt
+`, envUserZDOTDIR, Quote(prompt.ExpiryFile),
+		Quote(fmt.Sprintf("\n[%%F{yellow}%s%%f] [%%F{green}%s%%f] [%%F{red}", zshEscape(prompt.ServiceAccount), zshEscape(prompt.Project))),
+		Quote(fmt.Sprintf("%%f]\n[%%F{cyan}eiam %s%%f] > ", prompt.shortID())),
+	)
+
+	if err := ioutil.WriteFile(filepath.Join(zdotdir, ".zshenv"), []byte(zshenv), 0o600); err != nil {
+		return nil, err
+	}
+	if err := ioutil.WriteFile(filepath.Join(zdotdir, ".zshrc"), []byte(zshrc), 0o600); err != nil {
+		return nil, err
+	}
+
+	userZDOTDIR := lookupEnv(env, "ZDOTDIR")
+	if userZDOTDIR == "" {
+		userZDOTDIR = lookupEnv(env, "HOME")
+	}
+	cmd := exec.Command(shell, "-i")
+	cmd.Env = []string{
+		fmt.Sprintf("%s=%s", envUserZDOTDIR, userZDOTDIR),
+		fmt.Sprintf("ZDOTDIR=%s", zdotdir),
+	}
+	return cmd, nil
+}
+
+func fishCommand(shell, dir string, prompt Prompt) (*exec.Cmd, error) {
+	rc := fmt.Sprintf(`function __eiam_remaining
+    set -l expiry (cat %[4]s 2>/dev/null; or echo 0)
+    set -l left (math $expiry - (date +%%s))
+    if test $left -le 0
+        printf 'expired'
+    else if test $left -ge 3600
+        printf '%%dh%%02dm left' (math -s0 $left / 3600) (math -s0 "($left %% 3600) / 60")
+    else
+        printf '%%dm left' (math -s0 "($left + 59) / 60")
+    end
+end
+
+function fish_prompt
+    echo
+    echo '['(set_color yellow)%[1]s(set_color normal)'] ['(set_color green)%[2]s(set_color normal)'] ['(set_color red)(__eiam_remaining)(set_color normal)']'
+    echo -n '['(set_color cyan)'eiam '%[3]s(set_color normal)'] > '
+end
+`, fishQuote(prompt.ServiceAccount), fishQuote(prompt.Project), fishQuote(prompt.shortID()), fishQuote(prompt.ExpiryFile))
+
+	rcPath := filepath.Join(dir, fishRCName)
+	if err := ioutil.WriteFile(rcPath, []byte(rc), 0o600); err != nil {
+		return nil, err
+	}
+	// Init commands run after the user's config.fish has been loaded
+	return exec.Command(shell, "--interactive", "--init-command", "source "+fishQuote(rcPath)), nil
+}
+
+// Quote quotes s so that it is not expanded by a POSIX shell
+func Quote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// fishQuote quotes s so that it is not expanded by fish, which escapes quotes
+// and backslashes differently than POSIX shells
+func fishQuote(s string) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	return "'" + strings.ReplaceAll(s, "'", `\'`) + "'"
+}
+
+// zshEscape escapes percent signs so that zsh's prompt expansion shows them
+// as they are
+func zshEscape(s string) string {
+	return strings.ReplaceAll(s, "%", "%%")
+}
+
+// lookupEnv returns the value of key in env, which is in the form of
+// os.Environ. If key is set more than once, the last value is used.
+func lookupEnv(env []string, key string) string {
+	value := ""
+	for _, kv := range env {
+		if strings.HasPrefix(kv, key+"=") {
+			value = strings.TrimPrefix(kv, key+"=")
+		}
+	}
+	return value
+}
@@ -0,0 +1,154 @@
+package shellrc
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testPrompt = Prompt{
+	ServiceAccount: "example@my-project.iam.gserviceaccount.com",
+	Project:        "my-project",
+	SessionID:      "0123456789abcdef",
+}
+
+// runShell starts the shell with the generated rc files in a fake home
+// directory and runs script in it. The session ends two hours from now.
+func runShell(t *testing.T, shell, userRC, userRCContents, script string) string {
+	t.Helper()
+	shellPath, err := exec.LookPath(shell)
+	if err != nil {
+		t.Skipf("%s is not installed", shell)
+	}
+
+	home := t.TempDir()
+	userRCPath := filepath.Join(home, userRC)
+	if err := os.MkdirAll(filepath.Dir(userRCPath), 0o700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(userRCPath, []byte(userRCContents), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	prompt := testPrompt
+	prompt.ExpiryFile = filepath.Join(dir, "expiry")
+	if err := WriteExpiry(prompt.ExpiryFile, time.Now().Add(2*time.Hour+30*time.Second)); err != nil {
+		t.Fatal(err)
+	}
+
+	env := []string{"HOME=" + home, "PATH=" + os.Getenv("PATH"), "TERM=dumb"}
+	cmd, err := Command(shellPath, dir, prompt, env)
+	if err != nil {
+		t.Fatalf("Command() failed: %v", err)
+	}
+	cmd.Args = append(cmd.Args, "-c", script)
+	out, err := cmd.Output()
+	if err != nil {
+		t.Fatalf("%s failed: %v\n%s", shell, err, out)
+	}
+	return string(out)
+}
+
+func TestBash(t *testing.T) {
+	out := runShell(t, "bash", ".bashrc", "USER_RC_LOADED=yes\n", `echo "$USER_RC_LOADED"; echo "${PS1@P}"`)
+	if !strings.Contains(out, "yes") {
+		t.Errorf("the user's .bashrc was not loaded:\n%s", out)
+	}
+	checkPrompt(t, out)
+}
+
+// checkPrompt checks that the prompt in out shows the session's details and
+// how much longer it will last
+func checkPrompt(t *testing.T, out string) {
+	t.Helper()
+	for _, want := range []string{testPrompt.ServiceAccount, testPrompt.Project, "eiam 01234567", "2h00m left"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("the prompt does not include %q:\n%s", want, out)
+		}
+	}
+	if strings.Contains(out, testPrompt.SessionID) {
+		t.Errorf("the prompt includes the full session ID:\n%s", out)
+	}
+}
+
+func TestBashExpired(t *testing.T) {
+	if _, err := exec.LookPath("bash"); err != nil {
+		t.Skip("bash is not installed")
+	}
+	dir := t.TempDir()
+	prompt := testPrompt
+	prompt.ExpiryFile = filepath.Join(dir, "expiry")
+
+	for name, expiry := range map[string]*time.Time{
+		"expired":        timePtr(time.Now().Add(-time.Minute)),
+		"no expiry file": nil,
+	} {
+		t.Run(name, func(t *testing.T) {
+			os.Remove(prompt.ExpiryFile)
+			if expiry != nil {
+				if err := WriteExpiry(prompt.ExpiryFile, *expiry); err != nil {
+					t.Fatal(err)
+				}
+			}
+			cmd, err := Command("bash", dir, prompt, []string{"HOME=" + t.TempDir(), "PATH=" + os.Getenv("PATH")})
+			if err != nil {
+				t.Fatalf("Command() failed: %v", err)
+			}
+			cmd.Args = append(cmd.Args, "-c", `echo "${PS1@P}"`)
+			out, err := cmd.CombinedOutput()
+			if err != nil {
+				t.Fatalf("bash failed: %v\n%s", err, out)
+			}
+			if !strings.Contains(string(out), "expired") || strings.Contains(string(out), "left") {
+				t.Errorf("the prompt does not show that the session expired:\n%s", out)
+			}
+			if strings.Contains(string(out), "No such file") {
+				t.Errorf("the prompt printed an error:\n%s", out)
+			}
+		})
+	}
+}
+
+func timePtr(t time.Time) *time.Time {
+	return &t
+}
+
+func TestZsh(t *testing.T) {
+	out := runShell(t, "zsh", ".zshrc", "USER_RC_LOADED=yes\n", `echo "$USER_RC_LOADED"; echo "$PROMPT"; echo "$ZDOTDIR"`)
+	if !strings.Contains(out, "yes") {
+		t.Errorf("the user's .zshrc was not loaded:\n%s", out)
+	}
+	checkPrompt(t, out)
+	if strings.Contains(out, "/"+zshDirName+"\n") {
+		t.Errorf("ZDOTDIR still points at the generated rc files:\n%s", out)
+	}
+}
+
+func TestFish(t *testing.T) {
+	out := runShell(t, "fish", ".config/fish/config.fish", "set -g USER_RC_LOADED yes\n", `echo $USER_RC_LOADED; fish_prompt`)
+	if !strings.Contains(out, "yes") {
+		t.Errorf("the user's config.fish was not loaded:\n%s", out)
+	}
+	checkPrompt(t, out)
+}
+
+func TestOtherShell(t *testing.T) {
+	cmd, err := Command("/bin/sh", t.TempDir(), testPrompt, []string{"HOME=/tmp"})
+	if err != nil {
+		t.Fatalf("Command() failed: %v", err)
+	}
+	if len(cmd.Args) != 1 {
+		t.Errorf("unexpected arguments for sh: %v", cmd.Args)
+	}
+	ps1 := lookupEnv(cmd.Env, "PS1")
+	for _, want := range []string{testPrompt.ServiceAccount, testPrompt.Project, "eiam 01234567"} {
+		if !strings.Contains(ps1, want) {
+			t.Errorf("PS1 = %q, want it to include %q", ps1, want)
+		}
+	}
+}
@@ -1,7 +1,10 @@
 package options
 
 import (
+	"time"
+
 	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
 
 	util "github.com/jessesomerville/ephemeral-iam/internal/eiamutil"
 	errorsutil "github.com/jessesomerville/ephemeral-iam/internal/errors"
@@ -16,12 +19,25 @@ const (
 // YesOption designates whether to prompt for confirmation or not
 var YesOption = false
 
+// AccountOption is the gcloud account to use as the source identity
+var AccountOption string
+
 // Flag names and shorthands
 var (
+	AccountFlag             = flagName{"account", ""}
+	CredentialsFileFlag     = flagName{"credentials-file", ""}
+	DelegateFlag            = flagName{"delegate", ""}
+	DurationFlag            = flagName{"duration", "d"}
+	MetadataServerFlag      = flagName{"metadata-server", ""}
 	ProjectFlag             = flagName{"project", "p"}
+	ReadOnlyFlag            = flagName{"read-only", ""}
 	ReasonFlag              = flagName{"reason", "R"}
+	RecordFlag              = flagName{"record", ""}
 	RegionFlag              = flagName{"region", "r"}
+	ScopesFlag              = flagName{"scopes", ""}
 	ServiceAccountEmailFlag = flagName{"service-account-email", "s"}
+	SessionIDFlag           = flagName{"session-id", "i"}
+	SubjectFlag             = flagName{"subject", ""}
 	YesFlag                 = flagName{"yes", "y"}
 	ZoneFlag                = flagName{"zone", "z"}
 )
@@ -34,18 +50,49 @@ type flagName struct {
 // CmdConfig holds the values passed to a command
 type CmdConfig struct {
 	ComputeInstance     string
+	CredentialsFile     bool
+	Delegates           []string
+	Duration            time.Duration
+	MetadataServer      bool
 	Project             string
 	PubSubTopic         string
+	ReadOnly            bool
 	Reason              string
+	Record              bool
 	Region              string
+	Scopes              []string
 	ServiceAccountEmail string
+	SessionID           string
 	StorageBucket       string
+	Subject             string
 	Zone                string
 }
 
 // AddPersistentFlags add persistent flags to the root command
 func AddPersistentFlags(fs *pflag.FlagSet) {
 	fs.BoolVarP(&YesOption, YesFlag.Name, YesFlag.Shorthand, YesOption, "Assume 'yes' to all prompts")
+	fs.StringVar(&AccountOption, AccountFlag.Name, viper.GetString("auth.account"), "The gcloud account to impersonate service accounts as. Defaults to auth.account, or the application default credentials")
+}
+
+// AddDelegateFlag adds the --delegate flag to the command
+func AddDelegateFlag(fs *pflag.FlagSet, delegates *[]string) {
+	fs.StringSliceVar(delegates, DelegateFlag.Name, []string{}, "A service account to impersonate the service account through. Repeat the flag for each hop of the delegation chain, in order")
+}
+
+// AddScopesFlag adds the --scopes flag to the command
+func AddScopesFlag(fs *pflag.FlagSet, scopes *[]string) {
+	fs.StringSliceVar(scopes, ScopesFlag.Name, []string{}, "Comma-separated OAuth scopes of the service account's access token. Defaults to the service account's scope profile, or session.defaultscopes")
+}
+
+// AddSubjectFlag adds the --subject flag to the command
+func AddSubjectFlag(fs *pflag.FlagSet, subject *string) {
+	fs.StringVar(subject, SubjectFlag.Name, "", "A Google Workspace user for the access token to act as, through the service account's domain-wide delegation")
+}
+
+// AddDurationFlag adds the --duration/-d flag to the command
+func AddDurationFlag(fs *pflag.FlagSet, duration *time.Duration) {
+	defaultVal := viper.GetDuration("session.defaultduration")
+	fs.DurationVarP(duration, DurationFlag.Name, DurationFlag.Shorthand, defaultVal, "How long the privileged session should last. Cannot exceed the session.maxduration config value")
 }
 
 // AddProjectFlag adds the --project/-p flag to the command
@@ -107,6 +154,31 @@ func AddReasonFlag(fs *pflag.FlagSet, reason *string, required bool) {
 	}
 }
 
+// AddReadOnlyFlag adds the --read-only flag
+func AddReadOnlyFlag(fs *pflag.FlagSet, readOnly *bool) {
+	fs.BoolVar(readOnly, ReadOnlyFlag.Name, viper.GetBool("authproxy.readonly"), "Only allow requests that read resources, such as GET requests and getIamPolicy calls")
+}
+
+// AddMetadataServerFlag adds the --metadata-server flag
+func AddMetadataServerFlag(fs *pflag.FlagSet, metadataServer *bool) {
+	fs.BoolVar(metadataServer, MetadataServerFlag.Name, viper.GetBool("session.metadataserver"), "Start a local GCE metadata server that serves the service account's access token to any local process. Requests made with the token are neither policy-checked nor audited by the auth proxy")
+}
+
+// AddCredentialsFileFlag adds the --credentials-file flag
+func AddCredentialsFileFlag(fs *pflag.FlagSet, credentialsFile *bool) {
+	fs.BoolVar(credentialsFile, CredentialsFileFlag.Name, viper.GetBool("session.credentialsfile"), "Set GOOGLE_APPLICATION_CREDENTIALS in the privileged sub-shell to a credentials file that impersonates the service account")
+}
+
+// AddRecordFlag adds the --record flag
+func AddRecordFlag(fs *pflag.FlagSet, record *bool) {
+	fs.BoolVar(record, RecordFlag.Name, viper.GetBool("session.record"), "Record the privileged sub-shell so it can be played back with 'eiam session replay'")
+}
+
+// AddSessionIDFlag adds the --session-id/-i flag
+func AddSessionIDFlag(fs *pflag.FlagSet, sessionID *string) {
+	fs.StringVarP(sessionID, SessionIDFlag.Name, SessionIDFlag.Shorthand, "", "The ID of the privileged session. Defaults to the current session if only one is running")
+}
+
 // CheckRequired ensures that a command's required flags have been set
 func CheckRequired(flag *pflag.Flag) {
 	for annot, val := range flag.Annotations {